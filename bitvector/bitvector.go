@@ -3,6 +3,7 @@ package bitvector
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"sort"
 )
 
@@ -83,7 +84,7 @@ func MustScan(s string) *BitVector {
 	return bv
 }
 
-// Uint64 returns the integer value of the first 64 bits.
+// Uint32 returns the integer value of the first 32 bits.
 func (bv *BitVector) Uint32() uint32 {
 	if bv.size <= 8 {
 		return uint32(bv.bits[0])
@@ -105,9 +106,9 @@ func FromUint32(v uint32, size int) *BitVector {
 	} else if size <= 16 {
 		bits = []uint8{uint8(v), uint8((v & 0xff00) >> 8)}
 	} else if size <= 24 {
-		bits = []uint8{uint8(v), uint8((v & 0xff00) >> 8), uint8((v & 0xff000) >> 16)}
+		bits = []uint8{uint8(v), uint8((v & 0xff00) >> 8), uint8((v & 0xff0000) >> 16)}
 	} else {
-		bits = []uint8{uint8(v), uint8((v & 0xff00) >> 8), uint8((v & 0xff000) >> 16), uint8((v & 0xff000000) >> 24)}
+		bits = []uint8{uint8(v), uint8((v & 0xff00) >> 8), uint8((v & 0xff0000) >> 16), uint8((v & 0xff000000) >> 24)}
 	}
 
 	return &BitVector{
@@ -116,10 +117,88 @@ func FromUint32(v uint32, size int) *BitVector {
 	}
 }
 
+// Uint64 returns the integer value of the first 64 bits.
+func (bv *BitVector) Uint64() uint64 {
+	var v uint64
+	for i := 0; i < 8 && i < len(bv.bits); i++ {
+		v |= uint64(bv.bits[i]) << (8 * uint(i))
+	}
+	return v
+}
+
+// FromUint64 constructs BitVector of the size from v.  The bits beyond
+// the size are ignored.
+func FromUint64(v uint64, size int) *BitVector {
+	// mask up to valid bits
+	if size < 64 {
+		v &= ^(^uint64(0) << uint(size))
+	}
+	bv := New(size)
+	for i := 0; i < 8 && i < len(bv.bits); i++ {
+		bv.bits[i] = uint8(v >> (8 * uint(i)))
+	}
+	return bv
+}
+
 func (bv *BitVector) ByteSize() int {
 	return (bv.size + 7) >> 3
 }
 
+// Equal returns true if the sizes and the bits are the same.
+func (bv *BitVector) Equal(other *BitVector) bool {
+	return bv.size == other.size && bytes.Equal(bv.bits, other.bits)
+}
+
+// Clone returns a copy that does not share the bits.
+func (bv *BitVector) Clone() *BitVector {
+	res := New(bv.size)
+	copy(res.bits, bv.bits)
+	return res
+}
+
+// And returns a new BitVector of bitwise AND.  It panics if the sizes differ.
+func (bv *BitVector) And(other *BitVector) *BitVector {
+	return bv.combine(other, func(x, y uint8) uint8 { return x & y })
+}
+
+// Or returns a new BitVector of bitwise OR.  It panics if the sizes differ.
+func (bv *BitVector) Or(other *BitVector) *BitVector {
+	return bv.combine(other, func(x, y uint8) uint8 { return x | y })
+}
+
+// Xor returns a new BitVector of bitwise XOR.  It panics if the sizes differ.
+func (bv *BitVector) Xor(other *BitVector) *BitVector {
+	return bv.combine(other, func(x, y uint8) uint8 { return x ^ y })
+}
+
+// Not returns a new BitVector with all the bits flipped.
+func (bv *BitVector) Not() *BitVector {
+	res := New(bv.size)
+	for i := range res.bits {
+		res.bits[i] = ^bv.bits[i]
+	}
+	res.clearPadding()
+	return res
+}
+
+func (bv *BitVector) combine(other *BitVector, op func(x, y uint8) uint8) *BitVector {
+	if bv.size != other.size {
+		panic(fmt.Sprintf("BitVector size mismatch: %d and %d", bv.size, other.size))
+	}
+	res := New(bv.size)
+	for i := range res.bits {
+		res.bits[i] = op(bv.bits[i], other.bits[i])
+	}
+	return res
+}
+
+// clearPadding clears the unused bits in the last byte.
+func (bv *BitVector) clearPadding() {
+	if rem := uint(bv.size & 0x7); rem != 0 {
+		bv.bits[len(bv.bits)-1] &= ^(uint8(0xff) << rem)
+	}
+}
+
 // A slice of BitVector
 type Sort []*BitVector
 
@@ -140,7 +219,8 @@ func (s Sort) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
-// Hamming calculates the hamming distance of two bit vectors.
+// Hamming calculates the hamming distance of two bit vectors.  This is
+// the popcount of x.Xor(y), computed without allocating the result.
 func Hamming(x, y *BitVector) int {
 	dist := 0
 
@@ -151,6 +231,26 @@ func Hamming(x, y *BitVector) int {
 	return dist
 }
 
+// PopCount returns the number of set bits.
+func (bv *BitVector) PopCount() int {
+	count := 0
+	for _, b := range bv.bits {
+		count += int(popcnt[b])
+	}
+	return count
+}
+
+// Jaccard calculates the jaccard distance of two bit vectors, that is,
+// 1 - popcount(x & y) / popcount(x | y) with the range of [0, 1].  Two
+// empty vectors have the distance 0.  It panics if the sizes differ.
+func Jaccard(x, y *BitVector) float64 {
+	union := x.Or(y).PopCount()
+	if union == 0 {
+		return 0
+	}
+	return 1 - float64(x.And(y).PopCount())/float64(union)
+}
+
 // ByHamming embeds Sort and extends Less()
 type ByHamming struct {
 	Sort
@@ -164,7 +264,7 @@ func (s *ByHamming) Less(i, j int) bool {
 	return dist_i < dist_j
 }
 
-// SortFrom sorts s by the hamming distance from c
+// From sorts s by the hamming distance from c
 func (s Sort) From(c *BitVector) {
 	sorter := &ByHamming{s, c}
 	sort.Sort(sorter)
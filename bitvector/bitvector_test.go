@@ -25,6 +25,19 @@ func (_ *S) TestBasic(c *C) {
 	c.Check(bv.String(), Equals, "10011000 00000000")
 }
 
+func (_ *S) TestUnalignedSize(c *C) {
+	for _, size := range []int{1, 7, 9, 12, 15, 20, 31} {
+		bv := New(size)
+		c.Check(len(bv.bits), Equals, bv.ByteSize())
+		last := uint(size - 1)
+		bv.Set(last)
+		c.Check(bv.Get(last), Equals, true, Commentf("size = %d", size))
+		c.Check(FromUint32(bv.Uint32(), size).Get(last), Equals, true, Commentf("size = %d", size))
+		bv.Unset(last)
+		c.Check(bv.Get(last), Equals, false, Commentf("size = %d", size))
+	}
+}
+
 func (_ *S) TestScan(c *C) {
 	c.Check(MustScan("01010101 10101010").String(), Equals, "01010101 10101010")
 }
@@ -47,13 +60,114 @@ func (_ *S) TestUint32(c *C) {
 	c.Check(bv3.Uint32(), Equals, uint32(1))
 }
 
+func (_ *S) TestUint64(c *C) {
+	bv := New(64)
+	bv.Set(0)
+	bv.Set(33)
+	bv.Set(63)
+	c.Check(bv.Uint64(), Equals, uint64(1<<63|1<<33|1))
+	// Uint32 stays in the lower bits
+	c.Check(bv.Uint32(), Equals, uint32(1))
+
+	c.Check(FromUint64(bv.Uint64(), 64).String(), Equals, bv.String())
+
+	// trim size, bit(63) and bit(33) are cut off
+	c.Check(FromUint64(bv.Uint64(), 40).Uint64(), Equals, uint64(1<<33|1))
+	c.Check(FromUint64(bv.Uint64(), 33).Uint64(), Equals, uint64(1))
+
+	// narrow vectors agree with FromUint32
+	c.Check(FromUint64(0x1ff, 12).Uint64(), Equals, uint64(FromUint32(0x1ff, 12).Uint32()))
+}
+
 func (_ *S) TestHamming(c *C) {
 	c.Check(
 		Hamming(MustScan("11111111"), MustScan("00000000")),
 		Equals, 8)
 }
 
-func ExampleSortFrom() {
+func (_ *S) TestEqualClone(c *C) {
+	x := MustScan("10110000 01")
+	y := x.Clone()
+	c.Check(x.Equal(y), Equals, true)
+	c.Check(y.String(), Equals, "10110000 01")
+
+	// Clone is independent
+	y.Set(1)
+	c.Check(x.Equal(y), Equals, false)
+	c.Check(x.String(), Equals, "10110000 01")
+	x.Unset(0)
+	c.Check(y.String(), Equals, "11110000 01")
+
+	// the same bits with different size
+	c.Check(New(9).Equal(New(10)), Equals, false)
+	c.Check(New(10).Equal(New(10)), Equals, true)
+}
+
+func (_ *S) TestLogical(c *C) {
+	x := MustScan("11110000 10101010 110")
+	y := MustScan("10101010 11110000 011")
+
+	c.Check(x.And(y).String(), Equals, "10100000 10100000 010")
+	c.Check(x.Or(y).String(), Equals, "11111010 11111010 111")
+	c.Check(x.Xor(y).String(), Equals, "01011010 01011010 101")
+	c.Check(x.Not().String(), Equals, "00001111 01010101 001")
+
+	// Not keeps the padding bits clear
+	c.Check(Hamming(x.Not(), x), Equals, 19)
+	c.Check(Hamming(x, y), Equals, 10)
+
+	// operands are not modified
+	c.Check(x.String(), Equals, "11110000 10101010 110")
+	c.Check(y.String(), Equals, "10101010 11110000 011")
+}
+
+func (_ *S) TestLogicalSizeMismatch(c *C) {
+	x := MustScan("11110000 1")
+	y := MustScan("11110000 11")
+	c.Check(func() { x.And(y) }, PanicMatches, "BitVector size mismatch: 9 and 10")
+	c.Check(func() { x.Or(y) }, PanicMatches, "BitVector size mismatch: 9 and 10")
+	c.Check(func() { x.Xor(y) }, PanicMatches, "BitVector size mismatch: 9 and 10")
+}
+
+func (_ *S) TestPopCount(c *C) {
+	c.Check(New(0).PopCount(), Equals, 0)
+	c.Check(New(20).PopCount(), Equals, 0)
+	c.Check(New(20).Not().PopCount(), Equals, 20)
+	c.Check(MustScan("10110000 01").PopCount(), Equals, 4)
+}
+
+func (_ *S) TestJaccard(c *C) {
+	empty := New(12)
+	full := New(12).Not()
+	c.Check(Jaccard(empty, empty), Equals, 0.0)
+	c.Check(Jaccard(full, full), Equals, 0.0)
+	c.Check(Jaccard(empty, full), Equals, 1.0)
+	// and = 2, or = 4
+	c.Check(Jaccard(MustScan("11100000 0000"), MustScan("01110000 0000")), Equals, 0.5)
+	c.Check(func() { Jaccard(New(8), New(9)) }, PanicMatches, "BitVector size mismatch.*")
+}
+
+func (_ *S) TestSortFrom(c *C) {
+	center := MustScan("10010001 1")
+	data := []*BitVector{
+		MustScan("01101110 0"), // 9
+		MustScan("10010001 1"), // 0
+		MustScan("00000000 0"), // 4
+		MustScan("10010000 1"), // 1
+		MustScan("11111111 1"), // 5
+	}
+
+	Sort(data).From(center)
+	dists := []int{}
+	for _, bv := range data {
+		dists = append(dists, Hamming(center, bv))
+	}
+	c.Check(dists, DeepEquals, []int{0, 1, 4, 5, 9})
+	c.Check(data[0].String(), Equals, "10010001 1")
+	c.Check(data[len(data)-1].String(), Equals, "01101110 0")
+}
+
+func ExampleSort_From() {
 	data := []*BitVector{
 		MustScan("00000000"),
 		MustScan("11111111"),
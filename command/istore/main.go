@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/AlpacaDB/istore/istore"
 	"github.com/golang/glog"
@@ -11,11 +18,114 @@ import (
 func main() {
 	laddr := flag.String("l", ":8592", "listen address")
 	dbfile := flag.String("d", "/tmp/metadb", "datagbase file path")
+	fileroot := flag.String("fileroot", "", "comma separated directories file:// can read from (disabled if empty)")
+	cacheType := flag.String("cache", "memory", "cache type, memory|disk|leveldb|none")
+	cacheDir := flag.String("cachedir", "/tmp/istorecache", "directory for disk cache")
+	cacheSize := flag.Int("cachesize", 5*(1<<30), "cache size limit in bytes")
+	derivedDB := flag.Bool("deriveddb", false, "keep the image processing outputs in the database across restarts")
+	derivedDBSize := flag.Int("deriveddbsize", 5*(1<<30), "size limit in bytes of the image processing outputs in the database (negative for no limit)")
+	timeout := flag.Duration("timeout", time.Minute, "timeout of each upstream fetch up to the headers (negative for no limit)")
+	retries := flag.Int("retries", 2, "number of retries on transient upstream failures (negative for none)")
+	retryBackoff := flag.Duration("retrybackoff", 100*time.Millisecond, "wait before the first retry, doubled for each")
+	maxBodyBytes := flag.Int64("maxbodybytes", 1<<20, "request body size limit in bytes (negative for no limit)")
+	maxInputBytes := flag.Int64("maxinputbytes", 64<<20, "upstream object size limit of the image transforms in bytes (negative for no limit)")
+	maxInputPixels := flag.Int64("maxinputpixels", 100*1000*1000, "image size limit of the transforms in pixels (negative for no limit)")
+	userAgent := flag.String("useragent", "istore", "User-Agent of upstream requests")
+	hostConcurrency := flag.Int("hostconcurrency", 4, "upstream fetches in flight per host (negative for no limit)")
+	hostRate := flag.Float64("hostrate", 10, "upstream fetches per second per host (negative for no limit)")
+	hostWait := flag.Duration("hostwait", 10*time.Second, "wait for the per host limits before failing with 429")
+	caFile := flag.String("cafile", "", "comma separated PEM files of the CAs trusted for upstream https")
+	clientCert := flag.String("clientcert", "", "PEM file of the client certificate for upstream https")
+	clientKey := flag.String("clientkey", "", "PEM file of the client key for upstream https")
+	maxTransforms := flag.Int("maxtransforms", 0, "image transforms in flight (0 for GOMAXPROCS, negative for no limit)")
+	maxFrames := flag.Int("maxframes", 0, "video frame extractions in flight (0 for a quarter of GOMAXPROCS, negative for no limit)")
+	transformQueue := flag.Int("transformqueue", 64, "transforms waiting for the limits before failing with 503 (negative for no limit)")
+	insecure := flag.Bool("insecure", false, "skip verifying upstream https certificates (development only)")
+	tokenFile := flag.String("tokenfile", "", "file of the API tokens, one per line, required in Authorization (no auth if empty)")
+	public := flag.String("public", "", "comma separated path prefixes served without the API tokens")
+	expandWorkers := flag.Int("expandworkers", 2, "_expand jobs run at once in the background")
+	jobRetention := flag.Duration("jobretention", time.Hour, "how long the finished jobs are kept for _jobs")
+	shutdownTimeout := flag.Duration("shutdowntimeout", 30*time.Second, "wait for the requests in flight on SIGINT or SIGTERM")
 	flag.Parse()
-	handler := istore.NewServer(*dbfile)
+	var caFiles []string
+	if *caFile != "" {
+		caFiles = strings.Split(*caFile, ",")
+	}
+	var fileRoots []string
+	if *fileroot != "" {
+		fileRoots = strings.Split(*fileroot, ",")
+	}
+	var tokens []string
+	if *tokenFile != "" {
+		data, err := ioutil.ReadFile(*tokenFile)
+		if err != nil {
+			glog.Fatal("tokenfile: ", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if token := strings.TrimSpace(line); token != "" && !strings.HasPrefix(token, "#") {
+				tokens = append(tokens, token)
+			}
+		}
+		if len(tokens) == 0 {
+			glog.Fatal("tokenfile: no tokens in ", *tokenFile)
+		}
+	}
+	var publicPaths []string
+	if *public != "" {
+		publicPaths = strings.Split(*public, ",")
+	}
+	handler := istore.NewServerOptions(*dbfile, istore.Options{
+		CacheType:          *cacheType,
+		CacheDir:           *cacheDir,
+		CacheMaxBytes:      *cacheSize,
+		DerivedDB:          *derivedDB,
+		DerivedDBMaxBytes:  *derivedDBSize,
+		UserAgent:          *userAgent,
+		HostConcurrency:    *hostConcurrency,
+		HostRate:           *hostRate,
+		HostWait:           *hostWait,
+		MaxTransforms:      *maxTransforms,
+		MaxFrames:          *maxFrames,
+		TransformQueue:     *transformQueue,
+		CAFiles:            caFiles,
+		ClientCert:         *clientCert,
+		ClientKey:          *clientKey,
+		InsecureSkipVerify: *insecure,
+		ExpandWorkers:      *expandWorkers,
+		JobRetention:       *jobRetention,
+		FileRoots:          fileRoots,
+		Tokens:             tokens,
+		PublicPaths:        publicPaths,
+		FetchTimeout:       *timeout,
+		FetchRetries:       *retries,
+		RetryBackoff:       *retryBackoff,
+		MaxBodyBytes:       *maxBodyBytes,
+		MaxInputBytes:      *maxInputBytes,
+		MaxInputPixels:     *maxInputPixels,
+	})
+	srv := &http.Server{Addr: *laddr, Handler: handler}
+	stopped := make(chan struct{})
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-c
+		glog.Infof("Shutting down by %v", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			glog.Error("Shutdown: ", err)
+		}
+		if err := handler.Shutdown(ctx); err != nil {
+			glog.Error("Shutdown: ", err)
+		}
+		close(stopped)
+	}()
+
 	glog.Infof("Listening on %v using DB at %v", *laddr, *dbfile)
-	err := http.ListenAndServe(*laddr, handler)
-	if err != nil {
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		glog.Fatal("ListenAndServe: ", err)
 	}
+	<-stopped
+	glog.Flush()
 }
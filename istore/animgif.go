@@ -0,0 +1,155 @@
+package istore
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// _MaxGIFPixels bounds the pixels of all the frames of the animated GIF.
+const _MaxGIFPixels = 64 << 20
+
+// decodeAnimatedGIF decodes input if it is a GIF of more than one frame,
+// into anim and its frames composited on the canvas one after another by
+// the disposals.  Otherwise anim is nil, and the returned reader reads
+// input from the start.
+func decodeAnimatedGIF(input io.Reader) (io.Reader, *gif.GIF, []image.Image, error) {
+	head := make([]byte, 6)
+	n, err := io.ReadFull(input, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, nil, err
+	}
+	input = io.MultiReader(bytes.NewReader(head[:n]), input)
+	if !bytes.HasPrefix(head, []byte("GIF8")) {
+		return input, nil, nil, nil
+	}
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil || len(anim.Image) < 2 {
+		// left to image.Decode
+		return bytes.NewReader(data), nil, nil, nil
+	}
+
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if int64(len(anim.Image))*int64(bounds.Dx())*int64(bounds.Dy()) > _MaxGIFPixels {
+		return nil, nil, nil, &StatusError{http.StatusBadRequest,
+			fmt.Sprintf("too large animated gif of %d frames, add first_frame=true", len(anim.Image))}
+	}
+	frames := make([]image.Image, len(anim.Image))
+	canvas := image.NewNRGBA(bounds)
+	for i, p := range anim.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+		draw.Draw(canvas, p.Bounds(), p, p.Bounds().Min, draw.Over)
+		frames[i] = cloneNRGBA(canvas)
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, p.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return nil, anim, frames, nil
+}
+
+func cloneNRGBA(m *image.NRGBA) *image.NRGBA {
+	c := *m
+	c.Pix = append([]uint8(nil), m.Pix...)
+	return &c
+}
+
+// encodeAnimatedGIF encodes frames with the delays, the disposals and the
+// loop count of anim.  The palette of anim is kept if it has all the
+// colors, e.g. after crop and flip, otherwise the frames share the palette
+// of median cut.  Each frame covers the canvas, so the ones with the
+// transparent pixels are disposed to the background.
+func encodeAnimatedGIF(anim *gif.GIF, frames []image.Image) ([]byte, error) {
+	pal := anim.Image[0].Palette
+	if !inPalette(frames, pal) {
+		transparent := false
+		for _, m := range frames {
+			transparent = transparent || hasTransparent(m)
+		}
+		n := 256
+		if transparent {
+			n--
+		}
+		pal = medianCutPalette(frames, n)
+		if transparent || len(pal) == 0 {
+			pal = append(pal, color.Transparent)
+		}
+	}
+
+	out := &gif.GIF{LoopCount: anim.LoopCount}
+	for i, m := range frames {
+		bounds := m.Bounds()
+		dst := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), pal)
+		draw.Draw(dst, dst.Bounds(), m, bounds.Min, draw.Src)
+		disposal := byte(gif.DisposalNone)
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		if hasTransparent(m) {
+			disposal = gif.DisposalBackground
+		}
+		out.Image = append(out.Image, dst)
+		out.Delay = append(out.Delay, anim.Delay[i])
+		out.Disposal = append(out.Disposal, disposal)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// medianCutPalette returns the palette of up to n colors by median cut of
+// the pixels sampled from frames.
+func medianCutPalette(frames []image.Image, n int) color.Palette {
+	var samples colorBox
+	for _, m := range frames {
+		samples = append(samples, samplePixels(m, quantizeSide)...)
+	}
+	pal := color.Palette{}
+	for _, box := range medianCut(samples, n) {
+		pal = append(pal, box.average())
+	}
+	return pal
+}
+
+// inPalette reports whether pal has all the colors of frames.
+func inPalette(frames []image.Image, pal color.Palette) bool {
+	colors := map[[4]uint32]bool{}
+	for _, c := range pal {
+		r, g, b, a := c.RGBA()
+		colors[[4]uint32{r, g, b, a}] = true
+	}
+	for _, m := range frames {
+		bounds := m.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, a := m.At(x, y).RGBA()
+				if !colors[[4]uint32{r, g, b, a}] {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,816 @@
+package istore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// applyStep is an apply function in the chain with its arguments.
+type applyStep struct {
+	name string
+	args Values
+	// proc is nil for frame, or if the step changes nothing
+	proc imageProc
+	// version identifies the other input of the step, such as the image of
+	// overlay
+	version string
+	// input is the size of the other input
+	input image.Point
+}
+
+// opsParams names the arguments of each function in the ops syntax.  They
+// are all required but the ones after opsMinArgs.  The rects or the shapes
+// at the last takes the rest of the arguments as a whole.
+var opsParams = map[string][]string{
+	"adjustBrightness": {"percentage"},
+	"adjustContrast":   {"percentage"},
+	"adjustGamma":      {"gamma"},
+	"adjustHue":        {"percentage"},
+	"adjustSaturation": {"percentage"},
+	"adjustSigmoid":    {"midpoint", "factor"},
+	"autocrop":         {"tolerance"},
+	"autoorient":       {},
+	"blur":             {"sigma"},
+	"blurRegion":       {"sigma", "rects"},
+	"border":           {"width", "color"},
+	"clip":             {"start", "duration", "fps", "w", "format", "end"},
+	"convert":          {"format"},
+	"convolve":         {"divisor", "offset", "kernel"},
+	"crop":             {"x1", "y1", "x2", "y2", "rel"},
+	"cropCenter":       {"w", "h"},
+	"drawRect":         {"rects"},
+	"drawshape":        {"shapes"},
+	"drawtext":         {"text", "x", "y", "size", "r", "g", "b", "bg", "w"},
+	"edges":            {},
+	"fill":             {"w", "h", "anchor"},
+	"fit":              {"w", "h"},
+	"flipH":            {},
+	"flipV":            {},
+	"frame":            {"sec", "ms", "n", "w", "h"},
+	"gif":              {"start", "end", "fps", "w"},
+	"grayscale":        {},
+	"histogram":        {"bins"},
+	"hsl":              {"h", "s", "l"},
+	"invert":           {},
+	"normalize":        {"clip"},
+	"overlay":          {"src", "pos", "opacity", "scale", "x", "y", "width"},
+	"pad":              {"w", "h", "bg", "gravity", "upscale"},
+	"palette":          {"n", "save", "count"},
+	"phash":            {"save"},
+	"pixelate":         {"block", "rects"},
+	"probe":            {},
+	"quantize":         {"colors", "dither"},
+	"redact":           {"mode", "rects"},
+	"dominant":         {},
+	"rotate":           {"angle", "bg"},
+	"round":            {"radius", "shape"},
+	"sepia":            {},
+	"sharpen":          {"sigmoid"},
+	"sprite":           {"start", "end", "step", "cols", "w", "manifest"},
+	"stats":            {"save"},
+	"tint":             {"color", "strength"},
+	"transpose":        {},
+	"transverse":       {},
+	"vignette":         {"strength"},
+	"resize":           {"w", "h"},
+	"thumbnail":        {"w", "h", "format", "gravity", "upscale"},
+}
+
+var opsMinArgs = map[string]int{
+	"autocrop":  0,
+	"border":    1,
+	"clip":      2,
+	"convolve":  0,
+	"crop":      4,
+	"drawtext":  1,
+	"fill":      2,
+	"frame":     0,
+	"gif":       2,
+	"histogram": 0,
+	"hsl":       0,
+	"normalize": 0,
+	"overlay":   1,
+	"palette":   0,
+	"phash":     0,
+	"pixelate":  0,
+	"stats":     0,
+	"quantize":  0,
+	"pad":       2,
+	"rotate":    1,
+	"round":     0,
+	"sprite":    2,
+	"thumbnail": 1,
+	"tint":      1,
+	"vignette":  0,
+}
+
+// isVideoStep tells if the step of name takes the video, not the image.
+func isVideoStep(name string) bool {
+	return name == "frame" || name == "gif" || name == "clip" || name == "sprite" || name == "probe"
+}
+
+// parseApply returns the apply chain of r, by one of the pipeline parameter
+//
+//	?pipeline=crop(0,0,500,500)|resize(200,0)|grayscale
+//
+// the ops parameter
+//
+//	?ops=crop:0,0,500,500|resize:200,0|grayscale
+//
+// the JSON body of the steps with the parameters
+//
+//	[{"apply": "crop", "x1": 0, "y1": 0, "x2": 500, "y2": 500}, ...]
+//
+// or the repeated apply parameters, each followed by its arguments
+//
+//	?apply=crop&x1=0&y1=0&x2=500&y2=500&apply=resize&w=200&h=0
+//
+// The parameters before the first apply belong to it.  An unknown function
+// or bad arguments fail with 400 naming the step, and the frames of video
+// of more pixels than maxPixels with 413.
+func parseApply(r *http.Request, maxPixels int64) ([]applyStep, error) {
+	var steps []applyStep
+	var err error
+	query := r.URL.Query()
+	if pipeline := query.Get("pipeline"); pipeline != "" {
+		steps, err = parseOps(pipeline, splitCall)
+	} else if ops := query.Get("ops"); ops != "" {
+		steps, err = parseOps(ops, splitColon)
+	} else if isJSON(r.Header.Get("Content-Type")) && r.Body != nil {
+		steps, err = parsePipelineJSON(r.Body)
+	} else {
+		steps = parseApplyQuery(r.URL.RawQuery)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range steps {
+		step := &steps[i]
+		if step.name == "frame" {
+			if i > 0 {
+				return nil, stepError(i, step.name, fmt.Errorf("frame must be the first"))
+			}
+			if _, err := parseFrameArgs(step.args, maxPixels); err != nil {
+				return nil, stepError(i, step.name, err)
+			}
+			continue
+		}
+		if step.name == "gif" {
+			if len(steps) > 1 {
+				return nil, stepError(i, step.name, fmt.Errorf("gif must be alone"))
+			}
+			if _, err := parseGIFArgs(step.args, maxPixels); err != nil {
+				return nil, stepError(i, step.name, err)
+			}
+			continue
+		}
+		if step.name == "clip" {
+			if len(steps) > 1 {
+				return nil, stepError(i, step.name, fmt.Errorf("clip must be alone"))
+			}
+			if _, err := parseClipArgs(step.args, maxPixels); err != nil {
+				return nil, stepError(i, step.name, err)
+			}
+			continue
+		}
+		if step.name == "probe" {
+			if len(steps) > 1 {
+				return nil, stepError(i, step.name, fmt.Errorf("probe must be alone"))
+			}
+			continue
+		}
+		if step.name == "sprite" {
+			if len(steps) > 1 {
+				return nil, stepError(i, step.name, fmt.Errorf("sprite must be alone"))
+			}
+			if _, err := parseSpriteArgs(step.args, maxPixels); err != nil {
+				return nil, stepError(i, step.name, err)
+			}
+			continue
+		}
+		if analyzers[step.name] {
+			if i < len(steps)-1 {
+				return nil, stepError(i, step.name, fmt.Errorf("%s must be the last", step.name))
+			}
+			if _, err := analyze(nil, "", step); err != nil {
+				return nil, stepError(i, step.name, err)
+			}
+			continue
+		}
+		if step.proc, err = applyProc(step.name, step.args); err != nil {
+			return nil, stepError(i, step.name, err)
+		}
+		if _, err := imageFormat(step.args.Get("format")); err != nil {
+			return nil, stepError(i, step.name, err)
+		}
+	}
+	return steps, nil
+}
+
+func stepError(i int, name string, err error) error {
+	code, ok := errorStatus(err)
+	if !ok {
+		code = http.StatusBadRequest
+	}
+	return &StatusError{code, fmt.Sprintf("step %d (%s): %v", i+1, name, causeOf(err))}
+}
+
+// splitColon splits op of the ops parameter into the name and the
+// arguments, as name:args.
+func splitColon(op string) (name, args string, err error) {
+	pair := strings.SplitN(op, ":", 2)
+	if len(pair) == 2 {
+		return pair[0], pair[1], nil
+	}
+	return op, "", nil
+}
+
+// splitCall splits op of the pipeline parameter into the name and the
+// arguments, as name(args).
+func splitCall(op string) (name, args string, err error) {
+	i := strings.IndexByte(op, '(')
+	if i < 0 {
+		return op, "", nil
+	}
+	if !strings.HasSuffix(op, ")") {
+		return op[:i], "", fmt.Errorf("unclosed parenthesis")
+	}
+	return op[:i], op[i+1 : len(op)-1], nil
+}
+
+func parseOps(ops string, split func(string) (string, string, error)) ([]applyStep, error) {
+	var steps []applyStep
+	for i, op := range strings.Split(ops, "|") {
+		name, rawArgs, err := split(strings.TrimSpace(op))
+		name = strings.TrimSpace(name)
+		if err != nil {
+			return nil, stepError(i, name, err)
+		}
+		params, ok := opsParams[name]
+		if !ok {
+			return nil, stepError(i, name, fmt.Errorf("unknown function"))
+		}
+		var args []string
+		if rawArgs != "" {
+			// none of the functions without the parameters takes the rest
+			if n := len(params); n > 0 && (params[n-1] == "rects" || params[n-1] == "shapes" || params[n-1] == "kernel") {
+				args = strings.SplitN(rawArgs, ",", n)
+			} else {
+				args = strings.Split(rawArgs, ",")
+			}
+		}
+		min, ok := opsMinArgs[name]
+		if !ok {
+			min = len(params)
+		}
+		if len(args) < min || len(args) > len(params) {
+			if min == len(params) {
+				return nil, stepError(i, name, fmt.Errorf("takes %d arguments, got %d", min, len(args)))
+			}
+			return nil, stepError(i, name, fmt.Errorf("takes %d to %d arguments, got %d", min, len(params), len(args)))
+		}
+		step := applyStep{name: name, args: Values{url.Values{}}}
+		for j, arg := range args {
+			step.args.Set(params[j], strings.TrimSpace(arg))
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func isJSON(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediatype == "application/json"
+}
+
+// parsePipelineJSON reads the steps from the JSON array of objects, each
+// with the function in "apply" and the parameters of numbers, strings,
+// bools, or arrays of them for the repeated ones like rects.  A rect or a
+// text of drawtext may also be an object like
+// {"x1": 0, "y1": 0, "x2": 100, "y2": 100}.
+func parsePipelineJSON(body io.Reader) ([]applyStep, error) {
+	var ops []map[string]interface{}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	if err := dec.Decode(&ops); err != nil {
+		var mberr *http.MaxBytesError
+		if errors.As(err, &mberr) {
+			return nil, &StatusError{http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request body exceeds %d bytes", mberr.Limit)}
+		}
+		return nil, &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid pipeline: %v", err)}
+	}
+
+	var steps []applyStep
+	for i, op := range ops {
+		name, _ := op["apply"].(string)
+		if name == "" {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Sprintf("step %d: apply is missing", i+1)}
+		}
+		step := applyStep{name: name, args: Values{url.Values{}}}
+		for key, value := range op {
+			if key == "apply" {
+				continue
+			}
+			if key == "shapes" {
+				// parsed by parseShapes as a whole
+				data, err := json.Marshal(value)
+				if err != nil {
+					return nil, stepError(i, name, err)
+				}
+				step.args.Add(key, string(data))
+				continue
+			}
+			values, ok := value.([]interface{})
+			if !ok {
+				values = []interface{}{value}
+			}
+			for _, v := range values {
+				switch v := v.(type) {
+				case string, json.Number, bool:
+					step.args.Add(key, fmt.Sprint(v))
+				case map[string]interface{}:
+					rect, err := joinSubValues(v)
+					if (key != "rects" && key != "texts") || err != nil {
+						return nil, stepError(i, name, fmt.Errorf("invalid %s %v", key, v))
+					}
+					step.args.Add(key, rect)
+				default:
+					return nil, stepError(i, name, fmt.Errorf("invalid %s %v", key, v))
+				}
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// joinSubValues joins the object of numbers or strings into the form of
+// parseSubValues, escaping the values.
+func joinSubValues(obj map[string]interface{}) (string, error) {
+	var kvs []string
+	for k, v := range obj {
+		switch v.(type) {
+		case string, json.Number, bool:
+			kvs = append(kvs, k+"/"+url.PathEscape(fmt.Sprint(v)))
+		default:
+			return "", fmt.Errorf("invalid %s %v", k, v)
+		}
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ","), nil
+}
+
+// parseApplyQuery splits the query by apply keeping the order.
+func parseApplyQuery(query string) []applyStep {
+	var steps []applyStep
+	pending := url.Values{}
+	for _, kv := range strings.Split(query, "&") {
+		pair := strings.SplitN(kv, "=", 2)
+		key, err := url.QueryUnescape(pair[0])
+		if err != nil || key == "" {
+			continue
+		}
+		value := ""
+		if len(pair) == 2 {
+			if value, err = url.QueryUnescape(pair[1]); err != nil {
+				continue
+			}
+		}
+		if key == "apply" {
+			if value != "" {
+				steps = append(steps, applyStep{name: value, args: Values{url.Values{}}})
+			}
+		} else if len(steps) == 0 {
+			pending.Add(key, value)
+		} else {
+			steps[len(steps)-1].args.Add(key, value)
+		}
+	}
+	if len(steps) > 0 {
+		for k, v := range pending {
+			steps[0].args.Values[k] = append(v, steps[0].args.Values[k]...)
+		}
+	}
+	return steps
+}
+
+// analyzers are the functions at the end of the chain that output JSON
+// instead of the image.
+var analyzers = map[string]bool{
+	"histogram": true,
+	"palette":   true,
+	"dominant":  true,
+	"phash":     true,
+	"stats":     true,
+}
+
+// applyKey identifies the output of steps encoded by enc.  The arguments
+// are sorted by Encode(), but the steps keep the order.
+func applyKey(steps []applyStep, enc encodeOptions) string {
+	keys := make([]string, len(steps))
+	for i, step := range steps {
+		keys[i] = step.name + "?" + step.args.Encode()
+		if step.version != "" {
+			keys[i] += "@" + step.version
+		}
+	}
+	return strings.Join(keys, "|") + "#" + enc.key()
+}
+
+// runApply runs steps on input, decoding once and encoding once at the
+// end by enc.  The output is in the format given by the last step with it,
+// or in the input format, unless the last step is one of analyzers.  The
+// header has Content-Type, and the placement of pad if any.  It returns nil
+// data if all the steps change nothing, unless metadata=strip takes the
+// metadata out of the JPEG input.  The input is decoded by dec, scaled
+// down for the first step if it resizes the JPEG small enough.
+func runApply(ctx context.Context, input io.Reader, steps []applyStep, enc encodeOptions, dec decodeOptions) (data []byte, header http.Header, err error) {
+	header = http.Header{}
+	var m image.Image
+	var format string
+	// src is the input bytes to keep or strip the metadata, to orient, or
+	// to take the page
+	var src []byte
+	autoorient := false
+	for _, step := range steps {
+		autoorient = autoorient || step.name == "autoorient"
+	}
+	if (enc.Metadata != "" || enc.Orient || autoorient || enc.Page > 0) && !isVideoStep(steps[0].name) {
+		if src, err = ioutil.ReadAll(input); err != nil {
+			return nil, nil, err
+		}
+		if enc.Page > 0 {
+			if src, err = tiffPage(src, enc.Page); err != nil {
+				return nil, nil, err
+			}
+		}
+		input = bytes.NewReader(src)
+	}
+	// the index of steps[0] in the chain
+	first := 0
+	if steps[0].name == "gif" || steps[0].name == "clip" {
+		p, _ := parseGIFArgs(steps[0].args, dec.MaxPixels)
+		if steps[0].name == "clip" {
+			p, _ = parseClipArgs(steps[0].args, dec.MaxPixels)
+		}
+		var mediatype string
+		if data, mediatype, err = videoClip(ctx, input, p, enc); err != nil {
+			return nil, nil, err
+		}
+		header.Set("Content-Type", mediatype)
+		return data, header, nil
+	}
+	if steps[0].name == "probe" {
+		info, err := probe(ctx, input)
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, err = json.Marshal(info); err != nil {
+			return nil, nil, err
+		}
+		header.Set("Content-Type", "application/json")
+		return data, header, nil
+	}
+	if steps[0].name == "sprite" {
+		p, _ := parseSpriteArgs(steps[0].args, dec.MaxPixels)
+		var mediatype string
+		if data, mediatype, err = videoSprite(ctx, input, p, enc); err != nil {
+			return nil, nil, err
+		}
+		header.Set("Content-Type", mediatype)
+		return data, header, nil
+	}
+	if steps[0].name == "frame" {
+		p, _ := parseFrameArgs(steps[0].args, dec.MaxPixels)
+		var pts time.Duration
+		if data, pts, err = frame(ctx, input, *p); err != nil {
+			return nil, nil, err
+		}
+		header.Set(FramePtsHeader, strconv.FormatFloat(pts.Seconds(), 'f', -1, 64))
+		if len(steps) == 1 {
+			header.Set("Content-Type", "image/jpeg")
+			return data, header, nil
+		}
+		if m, format, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return nil, nil, err
+		}
+		steps = steps[1:]
+		first = 1
+	}
+	var analyzer *applyStep
+	if last := steps[len(steps)-1]; analyzers[last.name] {
+		analyzer = &last
+		steps = steps[:len(steps)-1]
+	}
+
+	orientation := 1
+	if enc.Orient || autoorient {
+		orientation = jpegOrientation(src)
+	}
+
+	// the animated GIF input, whose first frame is m and the rest frames
+	var anim *gif.GIF
+	var frames []image.Image
+	output := ""
+	alpha := false
+	changes := (enc.Orient && orientation != 1) || enc.Page > 0 || enc.reencodes()
+	for _, step := range steps {
+		changes = changes || step.proc != nil
+		alpha = alpha || step.name == "round"
+		if f, _ := imageFormat(step.args.Get("format")); f != "" {
+			output = f
+		}
+	}
+	if m == nil {
+		identity := changes && output == "" && analyzer == nil && !enc.reencodes() && onlyResizes(steps)
+		resizing := firstResize(steps)
+		if identity || resizing >= 0 {
+			// the size from the header, to pass the identity through, or to
+			// decode the JPEG scaled down
+			peeked := new(bytes.Buffer)
+			config, configFormat, err := image.DecodeConfig(io.TeeReader(input, peeked))
+			input = io.MultiReader(peeked, input)
+			size := image.Pt(config.Width, config.Height)
+			if err == nil && identity && identityResizes(steps, size) {
+				changes = false
+			}
+			if err == nil && resizing >= 0 && configFormat == "jpeg" {
+				transposed := enc.Orient && orientation >= 5
+				if transposed {
+					size = image.Pt(size.Y, size.X)
+				}
+				var proc imageProc
+				if dec.MinSize, proc = resizeOnDecode(steps[resizing], size); proc != nil {
+					steps = append([]applyStep(nil), steps...)
+					steps[resizing].proc = proc
+				}
+				if transposed {
+					dec.MinSize = image.Pt(dec.MinSize.Y, dec.MinSize.X)
+				}
+			}
+		}
+		if !changes && output == "" && analyzer == nil {
+			if enc.Metadata == metadataStrip {
+				if data, err := stripJPEGMetadata(src); err == nil {
+					header.Set("Content-Type", "image/jpeg")
+					return data, header, nil
+				}
+			}
+			return nil, nil, nil
+		}
+		if input, err = rejectAnimatedWebP(input); err != nil {
+			return nil, nil, err
+		}
+		if !enc.FirstFrame && analyzer == nil && (output == "" || output == "gif") {
+			var decoded io.Reader
+			if decoded, anim, frames, err = decodeAnimatedGIF(input); err != nil {
+				return nil, nil, err
+			}
+			if anim != nil {
+				m, format, frames = frames[0], "gif", frames[1:]
+			} else {
+				input = decoded
+			}
+		}
+		if m == nil {
+			if m, format, err = decodeImage(ctx, input, dec); err != nil {
+				return nil, nil, err
+			}
+		}
+		if enc.Orient {
+			m = exifOrient(orientation)(m)
+		}
+	}
+
+	for i, step := range steps {
+		if step.proc == nil {
+			continue
+		}
+		if err := checkPixels(outputSize(step, m.Bounds().Size()), dec.MaxPixels); err != nil {
+			return nil, nil, stepError(first+i, step.name, err)
+		}
+		if step.name == "pad" {
+			// the placement by the last pad, to map the coordinates
+			p, _ := parsePad(step.args)
+			rect := p.placement(m.Bounds().Size())
+			header.Set(PadLeftHeader, strconv.Itoa(rect.Min.X))
+			header.Set(PadTopHeader, strconv.Itoa(rect.Min.Y))
+		}
+		if step.name == "autoorient" {
+			m = exifOrient(orientation)(m)
+		} else {
+			m = step.proc(m)
+			for k := range frames {
+				frames[k] = step.proc(frames[k])
+			}
+		}
+		if m.Bounds().Empty() {
+			return nil, nil, stepError(first+i, step.name, fmt.Errorf("empty image"))
+		}
+	}
+	if analyzer != nil {
+		v, err := analyze(m, format, analyzer)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Set("Content-Type", "application/json")
+		data, err = json.Marshal(v)
+		return data, header, err
+	}
+	if output != "" {
+		format = output
+	} else {
+		format = outputFormat(format)
+	}
+	if alpha && format == "jpeg" {
+		// JPEG would lose the transparent corners
+		format = "png"
+	}
+	header.Set("Content-Type", "image/"+format)
+	if anim != nil {
+		data, err = encodeAnimatedGIF(anim, append([]image.Image{m}, frames...))
+		return data, header, err
+	}
+	if data, err = encodeImage(m, format, enc); err != nil {
+		return nil, nil, err
+	}
+	if format == "jpeg" && enc.Metadata == metadataKeep {
+		// the input other than JPEG has nothing to keep
+		oriented := (enc.Orient || autoorient) && orientation != 1
+		if kept, err := keptJPEGMetadata(src, m.Bounds().Size(), oriented); err == nil {
+			data, err = insertJPEGSegments(data, kept)
+			return data, header, err
+		}
+	}
+	return data, header, nil
+}
+
+// onlyResizes reports whether resize is the only function of steps that
+// changes the image.
+func onlyResizes(steps []applyStep) bool {
+	for _, step := range steps {
+		if step.proc != nil && step.name != "resize" {
+			return false
+		}
+	}
+	return true
+}
+
+// firstResize returns the index of the first step changing the image if
+// it resizes it, or -1.
+func firstResize(steps []applyStep) int {
+	for i, step := range steps {
+		if step.proc == nil {
+			continue
+		}
+		if step.name == "resize" || step.name == "thumbnail" {
+			return i
+		}
+		break
+	}
+	return -1
+}
+
+// resizeOnDecode returns the size the resize or the thumbnail step needs
+// of the image of size, and the proc of the step to replace, which resizes
+// to the size from size even if the image is decoded scaled, or nil if the
+// step takes the scaled image as well.  The size is zero if the image is
+// not to be scaled.
+func resizeOnDecode(step applyStep, size image.Point) (image.Point, imageProc) {
+	if step.name == "resize" {
+		wh, _ := step.args.ints("w", "h")
+		out := resizedSize(wh[0], wh[1], size)
+		return out, resize(out.X, out.Y)
+	}
+	w, h, upscale := thumbnailArgs(step.args)
+	if !upscale && (w > size.X || h > size.Y) {
+		// kept as is
+		return image.Point{}, nil
+	}
+	if w == 0 || h == 0 {
+		out := resizedSize(w, h, size)
+		return out, resize(out.X, out.Y)
+	}
+	return image.Pt(w, h), nil
+}
+
+// thumbnailArgs returns the size and the upscale of the thumbnail step,
+// whose arguments are already checked.
+func thumbnailArgs(args Values) (w, h int, upscale bool) {
+	whs, _ := args.ints("w", "h", "size")
+	w, h = whs[0], whs[1]
+	if whs[2] > 0 {
+		w, h = whs[2], whs[2]
+	}
+	upscale, _ = strconv.ParseBool(args.Get("upscale"))
+	return w, h, upscale
+}
+
+// outputSize returns the size of the largest image the step makes on the
+// way from the image of size, to check it before the step allocates it.
+func outputSize(step applyStep, size image.Point) image.Point {
+	switch step.name {
+	case "resize":
+		wh, _ := step.args.ints("w", "h")
+		return resizedSize(wh[0], wh[1], size)
+	case "thumbnail":
+		w, h, upscale := thumbnailArgs(step.args)
+		return thumbnailSize(w, h, upscale, size)
+	case "fill":
+		// resized to cover w x h as the thumbnail
+		wh, _ := step.args.ints("w", "h")
+		return thumbnailSize(wh[0], wh[1], true, size)
+	case "pad":
+		// the canvas, not smaller than the image fitted into it
+		p, _ := parsePad(step.args)
+		return image.Pt(p.width, p.height)
+	case "border":
+		// clamped not to overflow, far over any limit
+		width, _ := step.args.ints("width")
+		b := minInt(width[0], math.MaxInt32/4)
+		return size.Add(image.Pt(2*b, 2*b))
+	case "overlay":
+		// the overlay scaled to the width of the image, if larger
+		o, _ := parseOverlay(step.args)
+		if o.width > 0 && step.input.X > 0 {
+			scaled := scaledSize(step.input, o.width*float64(size.X)/float64(step.input.X))
+			if scaled.X*scaled.Y > size.X*size.Y {
+				return scaled
+			}
+		}
+	}
+	return size
+}
+
+// identityResizes reports whether every resize of steps keeps the image
+// in size as is.
+func identityResizes(steps []applyStep, size image.Point) bool {
+	for _, step := range steps {
+		if step.proc != nil {
+			wh, _ := step.args.ints("w", "h")
+			if resizedSize(wh[0], wh[1], size) != size {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// analyze runs the analyzer step on m.  It only checks the arguments if m
+// is nil.
+func analyze(m image.Image, format string, step *applyStep) (interface{}, error) {
+	switch step.name {
+	case "histogram":
+		bins, err := histogramBins(step.args)
+		if err != nil || m == nil {
+			return nil, err
+		}
+		return imageHistogram(m, bins), nil
+	case "palette":
+		n, err := paletteColors(step.args)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseSave(step.args); err != nil || m == nil {
+			return nil, err
+		}
+		return imagePalette(m, n), nil
+	case "dominant":
+		if m == nil {
+			return nil, nil
+		}
+		palette := imagePalette(m, _DefaultPaletteColors)
+		if len(palette.Colors) == 0 {
+			return nil, &StatusError{http.StatusUnprocessableEntity, "no opaque pixel"}
+		}
+		return palette.Colors[0], nil
+	case "phash":
+		if _, err := parseSave(step.args); err != nil || m == nil {
+			return nil, err
+		}
+		return &Phash{fmt.Sprintf("%016x", imagePhash(m))}, nil
+	case "stats":
+		if _, err := parseSave(step.args); err != nil || m == nil {
+			return nil, err
+		}
+		return imageStats(m, format), nil
+	}
+	return nil, fmt.Errorf("unknown analyzer %s", step.name)
+}
@@ -0,0 +1,39 @@
+package istore
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// authorized checks the token of r in Authorization, either "Bearer" or
+// "ApiKey", against Tokens.  The paths under PublicPaths and every path
+// without Tokens are open.
+func (s *Server) authorized(r *http.Request) bool {
+	if len(s.opts.Tokens) == 0 {
+		return true
+	}
+	for _, prefix := range s.opts.PublicPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+
+	auth := r.Header.Get("Authorization")
+	i := strings.IndexByte(auth, ' ')
+	if i < 0 {
+		return false
+	}
+	scheme, token := auth[:i], strings.TrimSpace(auth[i+1:])
+	if !strings.EqualFold(scheme, "Bearer") && !strings.EqualFold(scheme, "ApiKey") {
+		return false
+	}
+	ok := false
+	for _, t := range s.opts.Tokens {
+		// compares all, not to tell which one is close
+		if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
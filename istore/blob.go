@@ -0,0 +1,64 @@
+package istore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GCSFetcher retrieves objects from Google Cloud Storage by gs://bucket/object
+// URL.  Client should be authorized for private buckets, e.g. by oauth2.
+// It is not registered by default; use Server.RegisterFetcher("gs", ...).
+type GCSFetcher struct {
+	Client *http.Client
+	// Endpoint defaults to https://storage.googleapis.com
+	Endpoint string
+}
+
+// Fetch implements Fetcher.Fetch()
+func (f *GCSFetcher) Fetch(ctx context.Context, u *url.URL) (*http.Response, error) {
+	endpoint := f.Endpoint
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	if u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid gs URL %s", u)
+	}
+
+	// escaped, so that the object names with '?' or '%' stay in the path
+	return blobGet(ctx, f.Client, endpoint+"/"+u.Host+u.EscapedPath())
+}
+
+// AzureBlobFetcher retrieves objects from Azure Blob Storage by
+// azblob://account/container/blob URL.  Client should be authorized for
+// private containers, or SAS token may be given in the query string.
+type AzureBlobFetcher struct {
+	Client *http.Client
+}
+
+// Fetch implements Fetcher.Fetch()
+func (f *AzureBlobFetcher) Fetch(ctx context.Context, u *url.URL) (*http.Response, error) {
+	blob := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || !strings.Contains(blob, "/") {
+		return nil, fmt.Errorf("invalid azblob URL %s", u)
+	}
+
+	target := "https://" + u.Host + ".blob.core.windows.net" + u.EscapedPath()
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	return blobGet(ctx, f.Client, target)
+}
+
+func blobGet(ctx context.Context, client *http.Client, target string) (*http.Response, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req.WithContext(ctx))
+}
@@ -0,0 +1,89 @@
+package istore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// BulkItem is an item to register by _bulk.
+type BulkItem struct {
+	Path     string          `json:"path"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// BulkResult is the status of a BulkItem, with the _id if it is written.
+type BulkResult struct {
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	ItemId ItemId `json:"_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Bulk registers the JSON array of BulkItem in a single batch, as many
+// POST or PUT of the metadata at once.  The status of each item is
+// returned in the order, 201 for the new ones, 200 for the existing ones,
+// or 400 for the bad ones that are skipped.  Unlike ServePost, it does
+// not extract nor compute the metadata.
+func (s *Server) Bulk(w http.ResponseWriter, r *http.Request) {
+	var items []BulkItem
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		bodyError(w, err, "unrecognized items")
+		return
+	}
+
+	batch := new(leveldb.Batch)
+	overwrite := r.Method == "POST"
+	results := make([]BulkResult, len(items))
+	seen := map[string]bool{}
+	for i, item := range items {
+		result := &results[i]
+		result.Path = item.Path
+		if err := checkObjectPath(item.Path); err != nil {
+			result.Status, result.Error = http.StatusBadRequest, err.Error()
+			continue
+		}
+		// PutObject does not see the batch
+		if seen[item.Path] {
+			result.Status, result.Error = http.StatusBadRequest, "duplicate path"
+			continue
+		}
+		value := ""
+		if len(item.Metadata) > 0 && string(item.Metadata) != "null" {
+			// checked before PutObject allocates the id
+			var usermeta map[string]interface{}
+			if err := json.Unmarshal(item.Metadata, &usermeta); err != nil {
+				result.Status, result.Error = http.StatusBadRequest, fmt.Sprintf("invalid metadata: %v", err)
+				continue
+			}
+			value = string(item.Metadata)
+		}
+		metabytes, isnew, err := s.PutObject([]byte(item.Path), value, batch, overwrite)
+		if err != nil {
+			glog.Error(err)
+			result.Status, result.Error = http.StatusInternalServerError, "Error"
+			continue
+		}
+		seen[item.Path] = true
+		meta := ItemMeta{}
+		if _, err := meta.UnmarshalMsg(metabytes); err == nil {
+			result.ItemId = meta.ItemId
+		}
+		result.Status = http.StatusOK
+		if isnew {
+			result.Status = http.StatusCreated
+		}
+	}
+
+	if err := s.Db.Write(batch, nil); err != nil {
+		glog.Error("bulk put failed: ", err)
+		writeError(w, http.StatusInternalServerError, "failed to write the objects")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
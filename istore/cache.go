@@ -0,0 +1,163 @@
+package istore
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/AlpacaDB/istore/lru"
+	"github.com/golang/glog"
+	"github.com/gregjones/httpcache"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const _DefaultCacheMaxBytes = 5 * (1 << 30) // 5 GB
+
+// cacheUsage is implemented by caches that can report their usage.
+type cacheUsage interface {
+	Len() int
+	Bytes() int
+}
+
+// cachePurger is implemented by caches that can remove all the entries.
+type cachePurger interface {
+	Purge()
+}
+
+// newCache creates the cache by opts, or returns opts.Cache if given.  It
+// returns nil for "none".  "leveldb" keeps the cache in db.
+func newCache(opts *Options, db *leveldb.DB) httpcache.Cache {
+	if opts.Cache != nil {
+		if opts.CacheType == "" {
+			opts.CacheType = "custom"
+		}
+		return opts.Cache
+	}
+	maxBytes := opts.CacheMaxBytes
+	if maxBytes == 0 {
+		maxBytes = _DefaultCacheMaxBytes
+	}
+
+	switch opts.CacheType {
+	case "none":
+		return nil
+	case "disk":
+		cache, err := lru.NewDisk(opts.CacheDir, maxBytes)
+		if err == nil {
+			return cache
+		}
+		glog.Error("falling back to memory cache: ", err)
+	case "leveldb":
+		if db == nil {
+			glog.Error("falling back to memory cache: no leveldb")
+			break
+		}
+		cache, err := newDBCache(db, maxBytes)
+		if err == nil {
+			return cache
+		}
+		glog.Error("falling back to memory cache: ", err)
+	case "", "memory":
+	default:
+		glog.Error("unknown cache type ", opts.CacheType, ", falling back to memory cache")
+	}
+	opts.CacheType = "memory"
+	return lru.New(maxBytes)
+}
+
+type CacheStats struct {
+	Type     string `json:"type"`
+	Entries  int    `json:"entries"`
+	Bytes    int    `json:"bytes"`
+	MaxBytes int    `json:"max_bytes"`
+}
+
+type Stats struct {
+	Cache   CacheStats `json:"cache"`
+	Derived CacheStats `json:"derived"`
+	// DerivedDB is reported if Options.DerivedDB.
+	DerivedDB *CacheStats `json:"derived_db,omitempty"`
+	// InFlight is the number of upstream fetches in flight per host.
+	InFlight map[string]int `json:"inflight"`
+	// Transforms and Frames are the image transforms and the video frame
+	// extractions in flight and queued.
+	Transforms WorkStats `json:"transforms"`
+	Frames     WorkStats `json:"frames"`
+}
+
+func (s *Server) Stats() *Stats {
+	stats := &Stats{
+		Cache: CacheStats{
+			Type:     s.opts.CacheType,
+			MaxBytes: s.opts.CacheMaxBytes,
+		},
+	}
+	if stats.Cache.MaxBytes == 0 {
+		stats.Cache.MaxBytes = _DefaultCacheMaxBytes
+	}
+	if usage, ok := s.Cache.(cacheUsage); ok {
+		stats.Cache.Entries = usage.Len()
+		stats.Cache.Bytes = usage.Bytes()
+	}
+	if s.derived != nil {
+		stats.Derived = CacheStats{
+			Type:     "memory",
+			Entries:  s.derived.Len(),
+			Bytes:    s.derived.Bytes(),
+			MaxBytes: s.opts.DerivedMaxBytes,
+		}
+	}
+	if s.derivedDB != nil {
+		stats.DerivedDB = &CacheStats{
+			Type:     "leveldb",
+			Entries:  s.derivedDB.Len(),
+			Bytes:    s.derivedDB.Bytes(),
+			MaxBytes: s.opts.DerivedDBMaxBytes,
+		}
+	}
+	stats.InFlight = s.limiter.inflight()
+	stats.Transforms = s.transforms.stats()
+	stats.Frames = s.frames.stats()
+
+	return stats
+}
+
+func (s *Server) ServeStats(w http.ResponseWriter, r *http.Request) {
+	w.Header()["Content-type"] = []string{"application/json"}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(s.Stats()); err != nil {
+		glog.Error(err)
+	}
+}
+
+// CachePurge removes the cache of the target URL given by "url" parameter,
+// or everything if not given.  The URL may also be an istore path.  The
+// transformed outputs in memory are purged only when purging everything.
+func (s *Server) CachePurge(w http.ResponseWriter, r *http.Request) {
+	target := r.FormValue("url")
+	if Url := extractTargetURL(target); Url != "" {
+		target = Url
+	}
+	if target == "" && s.derived != nil {
+		s.derived.Purge()
+	}
+	if s.derivedDB != nil {
+		s.derivedDB.Delete(target)
+	}
+	if s.Cache == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if target == "" {
+		purger, ok := s.Cache.(cachePurger)
+		if !ok {
+			writeError(w, http.StatusNotImplemented, "cache does not support purge")
+			return
+		}
+		purger.Purge()
+	} else {
+		s.Cache.Delete(target)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
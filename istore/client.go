@@ -2,37 +2,353 @@ package istore
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/golang/glog"
 )
 
-type roundTripper struct{}
-
 // RoundTrip implements http.RoundTripper.RoundTrip()
 func (s *Server) RoundTrip(req *http.Request) (*http.Response, error) {
-	switch req.URL.Scheme {
-	case "file":
-		return fileGet(req)
-	case "http", "https":
-		client := &http.Client{}
-		return client.Do(req)
-	case "self":
-		return s.selfGet(req)
+	fetcher := s.Fetcher(req.URL.Scheme)
+	if fetcher == nil {
+		return nil, &UnknownSchemeError{Scheme: req.URL.Scheme}
+	}
+
+	if hf, ok := fetcher.(HeadFetcher); ok && req.Method == "HEAD" {
+		fetcher = FetcherFunc(hf.Head)
+	}
+
+	// self is resolved by GetApply, which coalesces by itself.  Coalescing
+	// here would make a self-referencing URL wait for itself.  Neither
+	// timeout nor retry is applied to self, as the fetches in it are.
+	if req.URL.Scheme == "self" {
+		return fetcher.Fetch(req.Context(), req.URL)
+	}
+
+	ctx := req.Context()
+	header := s.forwardedHeader(req.Header)
+	if len(header) > 0 {
+		ctx = context.WithValue(ctx, forwardedHeaderKey{}, header)
+	}
+	// only the inputs of the transforms are shared, and the others, such as
+	// the plain GETs, stream the body through by their own fetch
+	var own *http.Response
+	if limit, ok := sharedInput(ctx); ok && req.Method == "GET" {
+		// the forwarded headers may be credentials, so the callers with
+		// different ones must not share the response
+		key := "fetch\n" + req.URL.String()
+		if len(header) > 0 {
+			var buf bytes.Buffer
+			header.Write(&buf)
+			key += "\n" + buf.String()
+		}
+		// so is the depth, or a loop back to istore would wait for itself
+		if depth := selfDepth(ctx); depth > 0 {
+			key += fmt.Sprintf("\n%s: %d", SelfDepthHeader, depth)
+		}
+		v, err := s.flights.DoContext(req.Context(), key, func() (interface{}, error) {
+			return s.fetchShared(ctx, fetcher, req.URL, limit, &own)
+		})
+		if err == nil {
+			return v.(*fetchedResponse).newResponse(req), nil
+		}
+		if err != errNotShared {
+			return nil, err
+		}
+	}
+
+	resp := own
+	if resp == nil {
+		var err error
+		if resp, err = s.fetchRetry(ctx, fetcher, req.URL, nil); err != nil {
+			return nil, err
+		}
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// sharedInputKey is the context key marking the fetch of the input of the
+// transforms, which is read whole and shared by the concurrent requests
+// for the same object.  The value is the limit of the size of it.
+type sharedInputKey struct{}
+
+// withSharedInput marks the fetch by ctx as the input of the transforms,
+// which fails with 413 if larger than limit bytes, unless limit is 0.
+func withSharedInput(ctx context.Context, limit int64) context.Context {
+	return context.WithValue(ctx, sharedInputKey{}, limit)
+}
+
+func sharedInput(ctx context.Context) (limit int64, ok bool) {
+	limit, ok = ctx.Value(sharedInputKey{}).(int64)
+	return
+}
+
+// sharedInputBytes is the size of the shared input held in memory if it is
+// not limited.  It is replaced in test.
+var sharedInputBytes int64 = 32 << 20
+
+// errNotShared tells the callers waiting for fetchShared to fetch by
+// themselves.
+var errNotShared = errors.New("too large to share")
+
+// fetchShared fetches u with the body read up to limit, failing with 413
+// beyond it, before reading the body if Content-Length tells so.  If not
+// limited, a body larger than sharedInputBytes is not held in memory but
+// streamed to the caller who fetched it as own, and the others fail with
+// errNotShared.  The error statuses are not limited.
+func (s *Server) fetchShared(ctx context.Context, fetcher Fetcher, u *url.URL, limit int64, own **http.Response) (*fetchedResponse, error) {
+	var body []byte
+	resp, err := s.fetchRetry(ctx, fetcher, u, func(resp *http.Response) error {
+		body = nil
+		refuse := limit
+		if resp.StatusCode >= 400 {
+			refuse = 0
+		}
+		hold := refuse
+		if refuse <= 0 {
+			hold = sharedInputBytes
+		}
+		if refuse > 0 && resp.ContentLength > refuse {
+			return inputTooLarge(refuse)
+		}
+		if resp.ContentLength > hold {
+			return nil
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, io.LimitReader(resp.Body, hold+1)); err != nil {
+			return err
+		}
+		if int64(buf.Len()) <= hold {
+			body = buf.Bytes()
+			return resp.Body.Close()
+		}
+		if refuse > 0 {
+			return inputTooLarge(refuse)
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buf, resp.Body), resp.Body}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		*own = resp
+		return nil, errNotShared
+	}
+	return &fetchedResponse{resp, body}, nil
+}
+
+// fetchedResponse is a response with the body read, shared by the callers.
+type fetchedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+// newResponse returns a copy of the response that can be consumed.
+func (f *fetchedResponse) newResponse(req *http.Request) *http.Response {
+	resp := *f.resp
+	resp.Header = http.Header{}
+	for k, v := range f.resp.Header {
+		resp.Header[k] = append([]string(nil), v...)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(f.body))
+	resp.Request = req
+	return &resp
+}
+
+// requestFetcher adapts a function that takes *http.Request to Fetcher.
+func requestFetcher(get func(*http.Request) (*http.Response, error)) Fetcher {
+	return FetcherFunc(func(ctx context.Context, u *url.URL) (*http.Response, error) {
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return get(req.WithContext(ctx))
+	})
+}
+
+// httpHead sends HEAD to http(s).  It falls back to GET if the upstream
+// doesn't allow HEAD.
+func (s *Server) httpHead(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpGet(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		resp.Body.Close()
+		glog.Info(u, " does not allow HEAD, falling back to GET")
+		return requestFetcher(s.httpGet).Fetch(ctx, u)
+	}
+	return resp, nil
+}
+
+// forwardedHeaderKey is the context key of the headers to send upstream.
+type forwardedHeaderKey struct{}
+
+// forwardHeader copies ForwardHeaders of r to req if it goes to http(s).
+// Such req bypasses the cache not to leak the response to the others.
+func (s *Server) forwardHeader(req, r *http.Request) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return
+	}
+	header := s.forwardedHeader(r.Header)
+	if len(header) == 0 {
+		return
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Cache-Control", "no-cache, no-store")
+}
+
+// forwardedHeader returns the ForwardHeaders in header.
+func (s *Server) forwardedHeader(header http.Header) http.Header {
+	forwarded := http.Header{}
+	for _, name := range s.opts.ForwardHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if v, ok := header[name]; ok {
+			forwarded[name] = append([]string(nil), v...)
+		}
+	}
+	return forwarded
+}
+
+// httpGet sends req, either GET or HEAD, with the UserAgent, HostHeaders
+// and the forwarded headers over the transport by the TLS options.  It
+// doesn't follow redirects by itself; they are returned to Server.Client
+// so that each hop is cached and checked by checkRedirect.
+func (s *Server) httpGet(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", s.opts.UserAgent)
+	for k, v := range s.opts.HostHeaders[req.URL.Host] {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if header, ok := req.Context().Value(forwardedHeaderKey{}).(http.Header); ok {
+		for k, v := range header {
+			req.Header[k] = v
+		}
+	}
+	if depth := selfDepth(req.Context()); depth > 0 {
+		req.Header.Set(SelfDepthHeader, strconv.Itoa(depth))
+	}
+
+	client := &http.Client{
+		Transport: s.transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return client.Do(req)
+}
+
+// _DefaultMaxRedirects limits the redirects per fetch if not configured.
+const _DefaultMaxRedirects = 5
+
+// checkRedirect follows up to MaxRedirects redirects, only to http(s) so
+// that a remote can't make us read local files or other schemes.
+func (s *Server) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > s.opts.MaxRedirects {
+		return &StatusError{http.StatusBadGateway,
+			fmt.Sprintf("stopped after %d redirects from %s", s.opts.MaxRedirects, via[0].URL)}
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return &StatusError{http.StatusForbidden,
+			fmt.Sprintf("redirect from %s to %s is not allowed", via[len(via)-1].URL, req.URL)}
+	}
+	return nil
+}
+
+// localFileGet serves file:// only under the FileRoots.
+func (s *Server) localFileGet(req *http.Request) (*http.Response, error) {
+	filename, err := s.resolveFilePath(req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	return openFile(req, filename)
+}
+
+// resolveFilePath returns the canonical path of p after checking it lies
+// under one of the FileRoots, following symlinks.
+func (s *Server) resolveFilePath(p string) (string, error) {
+	if len(s.opts.FileRoots) == 0 {
+		return "", &StatusError{http.StatusForbidden, "file access is disabled"}
+	}
+
+	forbidden := &StatusError{http.StatusForbidden, fmt.Sprintf("file access to %s is forbidden", p)}
+	// reject parent reference outright, with either separator
+	for _, seg := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if seg == ".." {
+			return "", forbidden
+		}
+	}
+	p = filepath.Clean(p)
+	if !filepath.IsAbs(p) {
+		return "", forbidden
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// check before telling it does not exist
+			if !underRoots(p, s.opts.FileRoots) {
+				return "", forbidden
+			}
+			return "", &StatusError{http.StatusNotFound, fmt.Sprintf("%s not found", p)}
+		}
+		return "", err
+	}
+
+	roots := make([]string, 0, len(s.opts.FileRoots))
+	for _, root := range s.opts.FileRoots {
+		if r, err := filepath.EvalSymlinks(root); err == nil {
+			roots = append(roots, r)
+		} else {
+			glog.Error("file root is not accessible ", err)
+		}
+	}
+	if !underRoots(resolved, roots) {
+		return "", forbidden
 	}
 
-	return nil, fmt.Errorf("unknown scheme %s", req.URL.Scheme)
+	return resolved, nil
 }
 
-func fileGet(req *http.Request) (*http.Response, error) {
-	filename := req.URL.Path
+// underRoots returns true if p is one of the roots or under it.
+func underRoots(p string, roots []string) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(filepath.Clean(root), p)
+		if err != nil {
+			continue
+		}
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
 
+// openFile responds with the content of filename.  Content-type is guessed
+// by the requested path.
+func openFile(req *http.Request, filename string) (*http.Response, error) {
 	content, err := os.Open(filename)
 	if err != nil {
 		// Return 404 if not found
@@ -61,7 +377,7 @@ func fileGet(req *http.Request) (*http.Response, error) {
 		Body:       content,
 	}
 
-	ctype := mime.TypeByExtension(filepath.Ext(filename))
+	ctype := mime.TypeByExtension(filepath.Ext(req.URL.Path))
 	if ctype == "" {
 		var buf [512]byte // see net/http/sniff.go
 		n, _ := io.ReadFull(content, buf[:])
@@ -83,13 +399,213 @@ func fileGet(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
-func (s *Server) selfGet(req *http.Request) (*http.Response, error) {
-	newurl := req.URL.String()[len("self://"):]
-	newreq, err := http.NewRequest("GET", newurl, nil)
+// dataGet decodes data URI (RFC 2397), such as data:image/png;base64,iVBORw0...
+func dataGet(ctx context.Context, u *url.URL) (*http.Response, error) {
+	uri := u.Opaque
+	if u.RawQuery != "" {
+		uri += "?" + u.RawQuery
+	}
+
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return nil, fmt.Errorf("malformed data URI: missing ','")
+	}
+	mediatype, payload := uri[:comma], uri[comma+1:]
+
+	isBase64 := strings.HasSuffix(mediatype, ";base64")
+	if isBase64 {
+		mediatype = mediatype[:len(mediatype)-len(";base64")]
+	}
+	// RFC 2397: the type defaults to text/plain, and charset to US-ASCII
+	// only if the whole mediatype is omitted.
+	if mediatype == "" {
+		mediatype = "text/plain;charset=US-ASCII"
+	} else if strings.HasPrefix(mediatype, ";") {
+		mediatype = "text/plain" + mediatype
+	}
+	if _, _, err := mime.ParseMediaType(mediatype); err != nil {
+		return nil, fmt.Errorf("malformed data URI: %v", err)
+	}
+
+	unescaped, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed data URI: %v", err)
+	}
+	content := []byte(unescaped)
+	if isBase64 {
+		// accept both padded and unpadded forms
+		content, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(unescaped, "="))
+		if err != nil {
+			return nil, fmt.Errorf("malformed data URI: %v", err)
+		}
+	}
+
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+	}
+	resp.Header.Set("Content-type", mediatype)
+	resp.Header.Set("Content-length", fmt.Sprintf("%d", len(content)))
+
+	return resp, nil
+}
+
+// selfEscapes is the escaping table of the path part in self URL.  '%'
+// must come first so unescaping goes exactly one level.
+var selfEscapes = []string{
+	"%", "%25",
+	"?", "%3F",
+	"&", "%26",
+}
+
+var selfEscaper, selfUnescaper = func() (*strings.Replacer, *strings.Replacer) {
+	unescapes := make([]string, 0, len(selfEscapes)*2)
+	for i := 0; i < len(selfEscapes); i += 2 {
+		from, to := selfEscapes[i], selfEscapes[i+1]
+		unescapes = append(unescapes, to, from, strings.ToLower(to), from)
+	}
+	return strings.NewReplacer(selfEscapes...), strings.NewReplacer(unescapes...)
+}()
+
+// selfURL returns self URL of the istore path p, to which a raw query
+// can be appended.
+func selfURL(p string) string {
+	return "self://" + selfEscaper.Replace(p)
+}
+
+// splitSelfURL splits self URL by the last raw '?', and returns the
+// istore path unescaped one level and the query.
+func splitSelfURL(u string) (path, query string) {
+	rest := strings.TrimPrefix(u, "self://")
+	if i := strings.LastIndex(rest, "?"); i >= 0 {
+		rest, query = rest[:i], rest[i+1:]
+	}
+	return selfUnescaper.Replace(rest), query
+}
+
+// unescapeSentSelf unescapes self URL sent in the request line once as
+// HTTP does, but keeps selfEscapes, which are of the self URL itself.
+func unescapeSentSelf(u string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(u); i++ {
+		if u[i] != '%' {
+			b.WriteByte(u[i])
+			continue
+		}
+		if i+2 >= len(u) {
+			return "", url.EscapeError(u[i:])
+		}
+		v, err := strconv.ParseUint(u[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", url.EscapeError(u[i : i+3])
+		}
+		if c := string(rune(v)); selfEscaper.Replace(c) != c {
+			b.WriteString(u[i : i+3])
+		} else {
+			b.WriteByte(byte(v))
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// newTargetRequest makes the request to fetch Url.  self URL is kept raw
+// in Opaque as its escaping is different from the standard one.
+func newTargetRequest(ctx context.Context, Url string) (*http.Request, error) {
+	if !strings.HasPrefix(Url, "self://") {
+		return http.NewRequestWithContext(ctx, "GET", Url, nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "self:", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = &url.URL{Scheme: "self", Opaque: Url[len("self:"):]}
+	return req, nil
+}
+
+// selfChainKey is the context key of the paths visited by GetApply, the
+// outermost first.
+type selfChainKey struct{}
+
+// remoteDepthKey is the context key of the depth told by SelfDepthHeader.
+type remoteDepthKey struct{}
+
+// _DefaultMaxSelfDepth limits the nesting of self URLs if not configured.
+const _DefaultMaxSelfDepth = 8
+
+// SelfDepthHeader carries the nesting depth to http(s) fetches, so that
+// a loop through istore itself, e.g. by a redirect back to it, is also
+// limited by MaxSelfDepth.
+const SelfDepthHeader = "X-Istore-Depth"
+
+func selfChain(ctx context.Context) []string {
+	chain, _ := ctx.Value(selfChainKey{}).([]string)
+	return chain
+}
+
+// selfDepth returns the nesting depth of ctx including the remote one.
+func selfDepth(ctx context.Context) int {
+	depth, _ := ctx.Value(remoteDepthKey{}).(int)
+	return depth + len(selfChain(ctx))
+}
+
+// withRemoteDepth takes the depth from SelfDepthHeader of r.
+func withRemoteDepth(r *http.Request) *http.Request {
+	depth, err := strconv.Atoi(r.Header.Get(SelfDepthHeader))
+	if err != nil || depth <= 0 {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), remoteDepthKey{}, depth))
+}
+
+// withSelfChain appends path to the visited paths in ctx.  It fails with
+// 508 if the path has been visited, that is, the self URLs make a loop, or
+// if the nesting exceeds MaxSelfDepth.
+func (s *Server) withSelfChain(ctx context.Context, path string) (context.Context, error) {
+	chain := selfChain(ctx)
+	for _, p := range chain {
+		if p == path {
+			return nil, &StatusError{http.StatusLoopDetected,
+				"self URL loop: " + strings.Join(append(chain, path), " -> ")}
+		}
+	}
+	if depth := selfDepth(ctx); depth > s.opts.MaxSelfDepth {
+		visited := chain
+		if remote := depth - len(chain); remote > 0 {
+			visited = append([]string{fmt.Sprintf("(%d levels by %s)", remote, SelfDepthHeader)}, chain...)
+		}
+		return nil, &StatusError{http.StatusLoopDetected,
+			fmt.Sprintf("self URL nested more than %d levels: %s",
+				s.opts.MaxSelfDepth, strings.Join(append(visited, path), " -> "))}
+	}
+	// copy so that the sibling requests don't share the backing array
+	chain = append(chain[:len(chain):len(chain)], path)
+	return context.WithValue(ctx, selfChainKey{}, chain), nil
+}
+
+// selfGet serves self URL by GetApply on the path in it.
+func (s *Server) selfGet(ctx context.Context, u *url.URL) (*http.Response, error) {
+	return s.selfRequest(ctx, "GET", u)
+}
+
+// selfHead is selfGet by HEAD, which is passed down to the target.
+func (s *Server) selfHead(ctx context.Context, u *url.URL) (*http.Response, error) {
+	return s.selfRequest(ctx, "HEAD", u)
+}
+
+func (s *Server) selfRequest(ctx context.Context, method string, u *url.URL) (*http.Response, error) {
+	path, query := splitSelfURL(u.String())
+	newreq, err := http.NewRequestWithContext(ctx, method, "/", nil)
 	if err != nil {
-		glog.Error("Error in newurl ", newurl)
 		return nil, err
 	}
+	newreq.URL = &url.URL{Path: path, RawQuery: query}
 	return s.GetApply(newreq)
 }
 
@@ -98,4 +614,7 @@ func (s *Server) selfGet(req *http.Request) (*http.Response, error) {
 // 2nd level := self://http://example.com/foo/bar/video.flv%3Fabc=xyz%26def=1?param=value
 // 3rd level := self://self://http://example.com/foo/bar/video.flv%253Fabc=xyz%2526def=1%3Fparam=value
 // => to make self url, escape query of the path part, append raw '?' query
-//    and to use self url, split by '?', use the query, de-escape the path including internal query part.
+//    and to use self url, split by the last '?', use the query, de-escape the path including internal query part.
+//    The escaping is selfEscapes, used by both selfURL() and splitSelfURL().
+//    The key of self URL target is written in the request to istore as is,
+//    with the query of the self URL after the raw '?' (see sentSelfPath).
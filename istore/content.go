@@ -0,0 +1,129 @@
+package istore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// _PathContent is the prefix of the contents stored by POST with store,
+// keyed by their SHA-256 so the objects of the same content share one.
+// _PathStored is the prefix of the storedContent of each object path.
+const (
+	_PathContent = "sys.content."
+	_PathStored  = "sys.stored."
+)
+
+// storedContent is the reference from an object to its stored content,
+// with the headers served along.
+type storedContent struct {
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// parseStore parses store of POST, false by default.
+func parseStore(r *http.Request) (bool, error) {
+	s := r.FormValue("store")
+	if s == "" {
+		return false, nil
+	}
+	store, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, &StatusError{http.StatusBadRequest, "invalid store " + strconv.Quote(s)}
+	}
+	return store, nil
+}
+
+// storeContent fetches the target of key and puts its content and the
+// reference to it into batch.  The content is limited by MaxInputBytes.
+func (s *Server) storeContent(ctx context.Context, key string, batch *leveldb.Batch) error {
+	Url := extractTargetURL(key)
+	if Url == "" {
+		return &StatusError{http.StatusBadRequest, "target not found in path " + key}
+	}
+	resp, err := s.fetchTarget(ctx, Url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body := resp.Body
+	if s.opts.MaxInputBytes > 0 {
+		limited := &limitedBody{ReadCloser: body, limit: s.opts.MaxInputBytes}
+		if resp.ContentLength > s.opts.MaxInputBytes {
+			return limited.tooLarge()
+		}
+		body = limited
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(content)
+	stored := storedContent{
+		SHA256:       hex.EncodeToString(sum[:]),
+		Size:         int64(len(content)),
+		ContentType:  resp.Header.Get("Content-Type"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	ref, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(_PathContent+stored.SHA256), content)
+	batch.Put([]byte(_PathStored+key), ref)
+	return nil
+}
+
+// storedResponse returns the content stored for key as the response of
+// its target, or nil if none, in which case the target is fetched as
+// usual.  The ETag is the SHA-256 of the content.
+func (s *Server) storedResponse(key string) *http.Response {
+	ref, err := s.Db.Get([]byte(_PathStored+key), nil)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			glog.Error(err)
+		}
+		return nil
+	}
+	var stored storedContent
+	if err := json.Unmarshal(ref, &stored); err != nil {
+		glog.Error("broken stored content of ", key, ": ", err)
+		return nil
+	}
+	content, err := s.Db.Get([]byte(_PathContent+stored.SHA256), nil)
+	if err != nil {
+		glog.Error("missing stored content of ", key, ": ", err)
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("Content-Length", strconv.Itoa(len(content)))
+	header.Set("Etag", strconv.Quote(stored.SHA256))
+	if stored.ContentType != "" {
+		header.Set("Content-Type", stored.ContentType)
+	}
+	if stored.LastModified != "" {
+		header.Set("Last-Modified", stored.LastModified)
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+	}
+}
@@ -0,0 +1,164 @@
+package istore
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// convolveArgs is the arguments of convolve.
+type convolveArgs struct {
+	// kernel is the square weights in the row-major order, 3x3 or 5x5.
+	kernel  []float64
+	size    int
+	divisor float64
+	offset  float64
+}
+
+// parseConvolve reads kernel of 9 or 25 numbers separated by commas, or
+// repeated as by the JSON array, divisor (default the sum of kernel, or 1
+// if it is 0) and offset (default 0) of convolve.
+func parseConvolve(args Values) (*convolveArgs, error) {
+	s := strings.Join(args.Values["kernel"], ",")
+	if s == "" {
+		return nil, fmt.Errorf("kernel is required")
+	}
+	p := &convolveArgs{}
+	for _, w := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("invalid kernel weight %q", w)
+		}
+		p.kernel = append(p.kernel, f)
+	}
+	switch len(p.kernel) {
+	case 9:
+		p.size = 3
+	case 25:
+		p.size = 5
+	default:
+		return nil, fmt.Errorf("kernel must have 9 or 25 weights, got %d", len(p.kernel))
+	}
+
+	for _, w := range p.kernel {
+		p.divisor += w
+	}
+	if p.divisor == 0 {
+		p.divisor = 1
+	}
+	fs, err := args.floats("divisor", "offset")
+	if err != nil {
+		return nil, err
+	}
+	if args.Get("divisor") != "" {
+		if p.divisor = fs[0]; p.divisor == 0 || math.IsNaN(p.divisor) || math.IsInf(p.divisor, 0) {
+			return nil, fmt.Errorf("invalid divisor %v", fs[0])
+		}
+	}
+	if p.offset = fs[1]; math.IsNaN(p.offset) || math.IsInf(p.offset, 0) {
+		return nil, fmt.Errorf("invalid offset %v", p.offset)
+	}
+	return p, nil
+}
+
+// convolve applies the kernel to R, G and B of m, each sum divided by the
+// divisor and added the offset.  The pixels beyond the edges repeat the
+// edges, and the alpha is kept.
+func convolve(p *convolveArgs) imageProc {
+	return func(m image.Image) image.Image {
+		src := imaging.Clone(m)
+		return convolveNRGBA(src, p)
+	}
+}
+
+// convolveNRGBA convolves src over its Pix, reading the neighbors by the
+// offsets of the rows and the columns clamped in advance.
+func convolveNRGBA(src *image.NRGBA, p *convolveArgs) *image.NRGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	half := p.size / 2
+	// cols[x+k] is the offset in a row of the column k-half away from x
+	cols := make([]int, w+2*half)
+	for i := range cols {
+		cols[i] = clampInt(i-half, 0, w-1) * 4
+	}
+	rows := make([]int, p.size)
+	weights := make([]float64, len(p.kernel))
+	for i, k := range p.kernel {
+		weights[i] = k / p.divisor
+	}
+	for y := 0; y < h; y++ {
+		for k := range rows {
+			rows[k] = clampInt(y+k-half, 0, h-1) * src.Stride
+		}
+		d := dst.Pix[y*dst.Stride:]
+		for x := 0; x < w; x++ {
+			var r, g, b float64
+			i := 0
+			for _, row := range rows {
+				for _, col := range cols[x : x+p.size] {
+					s := src.Pix[row+col : row+col+3]
+					r += float64(s[0]) * weights[i]
+					g += float64(s[1]) * weights[i]
+					b += float64(s[2]) * weights[i]
+					i++
+				}
+			}
+			o := x * 4
+			d[o] = clampUint8(r + p.offset)
+			d[o+1] = clampUint8(g + p.offset)
+			d[o+2] = clampUint8(b + p.offset)
+			d[o+3] = src.Pix[y*src.Stride+o+3]
+		}
+	}
+	return dst
+}
+
+// edges renders the magnitude of the Sobel gradient of the luma of m in
+// grayscale, repeating the edges of m.
+func edges() imageProc {
+	return func(m image.Image) image.Image {
+		gray := imaging.Grayscale(m)
+		w, h := gray.Rect.Dx(), gray.Rect.Dy()
+		dst := image.NewGray(image.Rect(0, 0, w, h))
+		luma := func(x, y int) float64 {
+			return float64(gray.Pix[clampInt(y, 0, h-1)*gray.Stride+clampInt(x, 0, w-1)*4])
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				tl, t, tr := luma(x-1, y-1), luma(x, y-1), luma(x+1, y-1)
+				l, r := luma(x-1, y), luma(x+1, y)
+				bl, b, br := luma(x-1, y+1), luma(x, y+1), luma(x+1, y+1)
+				gx := (tr + 2*r + br) - (tl + 2*l + bl)
+				gy := (bl + 2*b + br) - (tl + 2*t + tr)
+				dst.Pix[y*dst.Stride+x] = clampUint8(math.Sqrt(gx*gx + gy*gy))
+			}
+		}
+		return dst
+	}
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// clampUint8 rounds v into 0..255.
+func clampUint8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
@@ -0,0 +1,114 @@
+package istore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// CopyObject copies the metadata of the object at from to the path to, or
+// moves it if move.  The copy gets a new _id, while the move keeps the _id
+// and its reverse mapping follows the new path unless new_id is true.  It
+// fails with 404 if from is missing, and 409 if to exists unless overwrite
+// is true, in which case the copy keeps the _id of the existing one.
+func (s *Server) CopyObject(w http.ResponseWriter, r *http.Request, move bool) {
+	from, to := r.FormValue("from"), r.FormValue("to")
+	for _, path := range []string{from, to} {
+		if err := checkObjectPath(path); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s: %q", err, path))
+			return
+		}
+	}
+	if from == to {
+		writeError(w, http.StatusBadRequest, "from and to are the same")
+		return
+	}
+	var flags [2]bool
+	for i, name := range []string{"overwrite", "new_id"} {
+		if v := r.FormValue(name); v != "" {
+			var err error
+			if flags[i], err = strconv.ParseBool(v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s %q", name, v))
+				return
+			}
+		}
+	}
+	overwrite, newId := flags[0], flags[1]
+
+	data, err := s.Db.Get([]byte(from), nil)
+	if err == leveldb.ErrNotFound {
+		writeError(w, http.StatusNotFound, from+" not found")
+		return
+	} else if err != nil {
+		glog.Error(err)
+		writeError(w, http.StatusInternalServerError, "failed to read "+from)
+		return
+	}
+	meta := ItemMeta{}
+	if _, err := meta.UnmarshalMsg(data); err != nil {
+		glog.Error("failed to parse msgpack from db ", err)
+		writeError(w, http.StatusInternalServerError, "broken metadata of "+from)
+		return
+	}
+	existing := ItemMeta{}
+	if olddata, err := s.Db.Get([]byte(to), nil); err == nil {
+		if !overwrite {
+			writeError(w, http.StatusConflict, fmt.Sprintf("%s already exists", to))
+			return
+		}
+		existing.UnmarshalMsg(olddata)
+	}
+
+	batch := new(leveldb.Batch)
+	metabytes := data
+	isnew := existing.ItemId == 0
+	if move && !newId {
+		// the _id of the overwritten one is gone
+		if existing.ItemId != 0 && existing.ItemId != meta.ItemId {
+			batch.Delete(existing.ItemId.Key())
+		}
+		batch.Put([]byte(to), data)
+		batch.Put(meta.ItemId.Key(), []byte(to))
+	} else {
+		value := ""
+		if meta.MetaData != nil {
+			b, err := json.Marshal(meta.MetaData)
+			if err != nil {
+				glog.Error(err)
+				writeError(w, http.StatusInternalServerError, "broken metadata of "+from)
+				return
+			}
+			value = string(b)
+		}
+		// replaces the metadata as PUT
+		if metabytes, isnew, err = s.PutObject([]byte(to), value, batch, false); err != nil {
+			glog.Error(err)
+			writeError(w, http.StatusInternalServerError, "failed to put "+to)
+			return
+		}
+		if move {
+			batch.Delete(meta.ItemId.Key())
+		}
+	}
+	if move {
+		batch.Delete([]byte(from))
+	}
+
+	if err := s.Db.Write(batch, nil); err != nil {
+		glog.Error(fmt.Sprintf("copy failed from %s to %s: %v", from, to, err))
+		writeError(w, http.StatusInternalServerError, "failed to write "+to)
+		return
+	}
+
+	if isnew {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	msgp.UnmarshalAsJSON(w, metabytes)
+}
@@ -0,0 +1,159 @@
+package istore
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	levelutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const _PathCache = "sys.cache."
+
+// dbCache is the httpcache.Cache in the leveldb under _PathCache, which
+// evicts the least recently used entries when the total size exceeds
+// maxBytes.  Each value is prefixed by the time it is written, from which
+// the recency is restored on restart.
+type dbCache struct {
+	db           *leveldb.DB
+	maxBytes     int
+	currentBytes int
+	ll           *list.List
+	cache        map[string]*list.Element
+	mu           sync.Mutex
+}
+
+type dbCacheEntry struct {
+	key  string
+	size int
+}
+
+func newDBCache(db *leveldb.DB, maxBytes int) (*dbCache, error) {
+	c := &dbCache{
+		db:       db,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		cache:    map[string]*list.Element{},
+	}
+
+	type stored struct {
+		dbCacheEntry
+		written int64
+	}
+	var entries []stored
+	iter := db.NewIterator(levelutil.BytesPrefix([]byte(_PathCache)), nil)
+	for iter.Next() {
+		value := iter.Value()
+		if len(value) < 8 {
+			continue
+		}
+		key := string(iter.Key()[len(_PathCache):])
+		written := int64(binary.BigEndian.Uint64(value))
+		entries = append(entries, stored{dbCacheEntry{key, len(value) - 8}, written})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	// from the oldest, so the latest comes to the front.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].written < entries[j].written })
+	for i := range entries {
+		entry := entries[i].dbCacheEntry
+		c.cache[entry.key] = c.ll.PushFront(&entry)
+		c.currentBytes += entry.size
+	}
+	c.evict()
+
+	return c, nil
+}
+
+func (c *dbCache) Set(key string, value []byte) {
+	data := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+	copy(data[8:], value)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.db.Put([]byte(_PathCache+key), data, nil); err != nil {
+		glog.Error("failed to store the cache: ", err)
+		return
+	}
+	if ee, ok := c.cache[key]; ok {
+		c.ll.MoveToFront(ee)
+		c.currentBytes -= ee.Value.(*dbCacheEntry).size
+		ee.Value.(*dbCacheEntry).size = len(value)
+	} else {
+		c.cache[key] = c.ll.PushFront(&dbCacheEntry{key, len(value)})
+	}
+	c.currentBytes += len(value)
+	c.evict()
+}
+
+func (c *dbCache) Get(key string) (value []byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, hit := c.cache[key]
+	if !hit {
+		return nil, false
+	}
+	data, err := c.db.Get([]byte(_PathCache+key), nil)
+	if err != nil || len(data) < 8 {
+		c.removeElement(ele)
+		return nil, false
+	}
+	c.ll.MoveToFront(ele)
+	return data[8:], true
+}
+
+func (c *dbCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ele, hit := c.cache[key]; hit {
+		c.removeElement(ele)
+	}
+}
+
+func (c *dbCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.ll.Len() > 0 {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *dbCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *dbCache) Bytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currentBytes
+}
+
+func (c *dbCache) evict() {
+	for c.maxBytes > 0 && c.currentBytes > c.maxBytes && c.ll.Len() > 0 {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *dbCache) removeElement(e *list.Element) {
+	entry := e.Value.(*dbCacheEntry)
+	if err := c.db.Delete([]byte(_PathCache+entry.key), nil); err != nil {
+		glog.Error("failed to delete the cache: ", err)
+	}
+	c.ll.Remove(e)
+	delete(c.cache, entry.key)
+	c.currentBytes -= entry.size
+}
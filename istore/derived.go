@@ -0,0 +1,288 @@
+package istore
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	levelutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	_DefaultDerivedMaxBytes   = 1 << 30       // 1 GB
+	_DefaultDerivedDBMaxBytes = 5 * (1 << 30) // 5 GB
+)
+
+// derivedKey returns the cache key of the output transformed from resp by
+// steps and encoded by enc.  The upstream version is identified by ETag,
+// Last-Modified, or the content hash in this order, so the key changes
+// when the upstream changes.  It may read and replace resp.Body.
+func derivedKey(Url string, resp *http.Response, steps []applyStep, enc encodeOptions) (string, error) {
+	version := resp.Header.Get("Etag")
+	if version == "" {
+		version = resp.Header.Get("Last-Modified")
+	}
+	if version == "" {
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(content))
+		sum := sha1.Sum(content)
+		version = hex.EncodeToString(sum[:])
+	}
+
+	return Url + "\n" + version + "\n" + applyKey(steps, enc), nil
+}
+
+// applyDerived returns the output transformed from resp by steps and
+// encoded by enc.
+// It looks for the cache first, and concurrent calls for the same output
+// share one transformation.  resp.Body is closed.
+func (s *Server) applyDerived(key string, resp *http.Response, r *http.Request, steps []applyStep, enc encodeOptions) (*http.Response, error) {
+	defer resp.Body.Close()
+
+	v, err := s.flights.DoContext(r.Context(), "apply\n"+key, func() (interface{}, error) {
+		if s.derived != nil {
+			if data, ok := s.derived.Get(key); ok {
+				return data, nil
+			}
+		}
+		if s.derivedDB != nil {
+			if data, ok := s.derivedDB.Get(key); ok {
+				if s.derived != nil {
+					s.derived.Set(key, data)
+				}
+				return data, nil
+			}
+		}
+
+		newresp, err := s.handleApply(resp, r, steps, enc)
+		if err != nil {
+			// the decoders may hide the error of the body
+			if body, ok := resp.Body.(*limitedBody); ok && body.exceeded() {
+				return nil, body.tooLarge()
+			}
+			return nil, err
+		}
+		data, err := httputil.DumpResponse(newresp, true)
+		newresp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if newresp != resp {
+			if s.derived != nil {
+				s.derived.Set(key, data)
+			}
+			if s.derivedDB != nil {
+				s.derivedDB.Set(key, data)
+			}
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(v.([]byte))), r)
+}
+
+// derivedDB keeps the transformed outputs in the leveldb under
+// _PathDerived, keyed by the URL, the upstream version and the steps.  The
+// outputs of the other versions of the URL are removed on Set, so they do
+// not pile up as the upstream changes, and the least recently used ones
+// are evicted when the total size exceeds maxBytes.  Each value is
+// prefixed by the time it is written as in dbCache.
+type derivedDB struct {
+	db           *leveldb.DB
+	maxBytes     int
+	currentBytes int
+	ll           *list.List
+	// outputs is by the leveldb key
+	outputs map[string]*list.Element
+	mu      sync.Mutex
+}
+
+func newDerivedDB(db *leveldb.DB, maxBytes int) *derivedDB {
+	d := &derivedDB{
+		db:       db,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		outputs:  map[string]*list.Element{},
+	}
+
+	type stored struct {
+		dbCacheEntry
+		written int64
+	}
+	var entries []stored
+	iter := db.NewIterator(levelutil.BytesPrefix([]byte(_PathDerived)), nil)
+	for iter.Next() {
+		value := iter.Value()
+		if len(value) < 8 {
+			continue
+		}
+		written := int64(binary.BigEndian.Uint64(value))
+		entries = append(entries, stored{dbCacheEntry{string(iter.Key()), len(value) - 8}, written})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		glog.Error("failed to count the derived outputs: ", err)
+	}
+
+	// from the oldest, so the latest comes to the front.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].written < entries[j].written })
+	for i := range entries {
+		entry := entries[i].dbCacheEntry
+		d.outputs[entry.key] = d.ll.PushFront(&entry)
+		d.currentBytes += entry.size
+	}
+	d.evict()
+	return d
+}
+
+// dbKey returns the leveldb key of the derivedKey, and the prefix of its
+// URL.
+func (d *derivedDB) dbKey(key string) (dbkey, prefix string) {
+	// Url + "\n" + version + "\n" + steps
+	parts := strings.SplitN(key, "\n", 3)
+	prefix = _PathDerived + parts[0] + "\x00"
+	return prefix + strings.Join(parts[1:], "\x00"), prefix
+}
+
+func (d *derivedDB) Get(key string) ([]byte, bool) {
+	dbkey, _ := d.dbKey(key)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ele, hit := d.outputs[dbkey]
+	if !hit {
+		return nil, false
+	}
+	data, err := d.db.Get([]byte(dbkey), nil)
+	if err != nil || len(data) < 8 {
+		if err != nil && err != leveldb.ErrNotFound {
+			glog.Error(err)
+		}
+		d.removeElement(ele)
+		return nil, false
+	}
+	d.ll.MoveToFront(ele)
+	return data[8:], true
+}
+
+func (d *derivedDB) Set(key string, value []byte) {
+	dbkey, prefix := d.dbKey(key)
+	// the prefix of the version
+	current := dbkey[:strings.LastIndex(dbkey, "\x00")+1]
+	data := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+	copy(data[8:], value)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	batch := new(leveldb.Batch)
+	var removed []string
+	iter := d.db.NewIterator(levelutil.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		if k := string(iter.Key()); k == dbkey || !strings.HasPrefix(k, current) {
+			batch.Delete(iter.Key())
+			removed = append(removed, k)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		glog.Error(err)
+		return
+	}
+	batch.Put([]byte(dbkey), data)
+	if err := d.db.Write(batch, nil); err != nil {
+		glog.Error("failed to store the derived output: ", err)
+		return
+	}
+	d.forget(removed)
+	d.outputs[dbkey] = d.ll.PushFront(&dbCacheEntry{dbkey, len(value)})
+	d.currentBytes += len(value)
+	d.evict()
+}
+
+// Delete removes the outputs of Url, or all if Url is empty.
+func (d *derivedDB) Delete(Url string) {
+	prefix := _PathDerived
+	if Url != "" {
+		prefix += Url + "\x00"
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	batch := new(leveldb.Batch)
+	var removed []string
+	iter := d.db.NewIterator(levelutil.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+		removed = append(removed, string(iter.Key()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		glog.Error(err)
+		return
+	}
+	if err := d.db.Write(batch, nil); err != nil {
+		glog.Error("failed to delete the derived outputs: ", err)
+		return
+	}
+	d.forget(removed)
+}
+
+func (d *derivedDB) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ll.Len()
+}
+
+func (d *derivedDB) Bytes() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.currentBytes
+}
+
+func (d *derivedDB) evict() {
+	for d.maxBytes > 0 && d.currentBytes > d.maxBytes && d.ll.Len() > 0 {
+		d.removeElement(d.ll.Back())
+	}
+}
+
+func (d *derivedDB) removeElement(e *list.Element) {
+	entry := e.Value.(*dbCacheEntry)
+	if err := d.db.Delete([]byte(entry.key), nil); err != nil {
+		glog.Error("failed to delete the derived output: ", err)
+	}
+	d.forget([]string{entry.key})
+}
+
+// forget drops the entries of the leveldb keys already deleted.
+func (d *derivedDB) forget(dbkeys []string) {
+	for _, dbkey := range dbkeys {
+		if e, ok := d.outputs[dbkey]; ok {
+			d.ll.Remove(e)
+			delete(d.outputs, dbkey)
+			d.currentBytes -= e.Value.(*dbCacheEntry).size
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package istore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// errNotJPEG is returned by parseExif for the input other than JPEG.
+var errNotJPEG = errors.New("not a JPEG")
+
+// the EXIF tags read by parseExif
+const (
+	exifMake             = 0x010f
+	exifModel            = 0x0110
+	exifOrientation      = 0x0112
+	exifDateTime         = 0x0132
+	exifIFDPointer       = 0x8769
+	exifGPSPointer       = 0x8825
+	exifDateTimeOriginal = 0x9003
+	exifPixelXDimension  = 0xa002
+	exifPixelYDimension  = 0xa003
+	gpsLatitudeRef       = 0x0001
+	gpsLatitude          = 0x0002
+	gpsLongitudeRef      = 0x0003
+	gpsLongitude         = 0x0004
+	gpsAltitudeRef       = 0x0005
+	gpsAltitude          = 0x0006
+)
+
+// parseExif reads the EXIF of the JPEG input into the fields of make,
+// model, orientation, datetime, datetime_original, width, height, lat, lon
+// and alt, omitting the missing ones.  The coordinates are in decimal
+// degrees, negative for south and west.  The dimensions are of the frame
+// if EXIF does not have them.  It reads up to the image data.
+func parseExif(input io.Reader) (map[string]interface{}, error) {
+	reader := bufio.NewReader(input)
+	var soi [2]byte
+	if _, err := io.ReadFull(reader, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, errNotJPEG
+	}
+
+	fields := map[string]interface{}{}
+	var width, height int
+	for {
+		marker, err := nextMarker(reader)
+		if err != nil {
+			return nil, err
+		}
+		// start of scan, or end of image
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(reader, size[:]); err != nil {
+			return nil, err
+		}
+		length := int64(binary.BigEndian.Uint16(size[:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("invalid JPEG segment length")
+		}
+		segment := io.LimitReader(reader, length)
+
+		switch {
+		case marker == 0xe1:
+			data, err := ioutil.ReadAll(segment)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.HasPrefix(data, []byte("Exif\x00\x00")) {
+				if err := parseTIFF(data[6:], fields); err != nil {
+					return nil, err
+				}
+			}
+		// start of frame, except DHT, JPG and DAC
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			var sof [5]byte
+			if _, err := io.ReadFull(segment, sof[:]); err != nil {
+				return nil, err
+			}
+			height = int(binary.BigEndian.Uint16(sof[1:3]))
+			width = int(binary.BigEndian.Uint16(sof[3:5]))
+		}
+		if _, err := io.Copy(ioutil.Discard, segment); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := fields["width"]; !ok && width > 0 {
+		fields["width"] = width
+		fields["height"] = height
+	}
+	return fields, nil
+}
+
+// jpegOrientation returns the EXIF orientation of the JPEG data, 1 if it
+// has none or is not JPEG.
+func jpegOrientation(data []byte) int {
+	fields, err := parseExif(bytes.NewReader(data))
+	if err != nil {
+		return 1
+	}
+	if o, ok := fields["orientation"].(int); ok && o >= 1 && o <= 8 {
+		return o
+	}
+	return 1
+}
+
+// nextMarker skips to the next marker and returns its code.
+func nextMarker(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xff {
+			continue
+		}
+		// fill bytes
+		for b == 0xff {
+			if b, err = reader.ReadByte(); err != nil {
+				return 0, err
+			}
+		}
+		if b != 0 {
+			return b, nil
+		}
+	}
+}
+
+// tiff reads the IFD entries of the TIFF header in EXIF.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+var errTIFF = errors.New("invalid EXIF")
+
+func parseTIFF(data []byte, fields map[string]interface{}) error {
+	if len(data) < 8 {
+		return errTIFF
+	}
+	t := &tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return errTIFF
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return errTIFF
+	}
+
+	ifd0, err := t.ifd(t.order.Uint32(data[4:]))
+	if err != nil {
+		return err
+	}
+	t.setString(fields, "make", ifd0[exifMake])
+	t.setString(fields, "model", ifd0[exifModel])
+	t.setInt(fields, "orientation", ifd0[exifOrientation])
+	t.setDateTime(fields, "datetime", ifd0[exifDateTime])
+
+	if p, ok := t.uint(ifd0[exifIFDPointer]); ok {
+		ifd, err := t.ifd(p)
+		if err != nil {
+			return err
+		}
+		t.setDateTime(fields, "datetime_original", ifd[exifDateTimeOriginal])
+		w, wok := t.uint(ifd[exifPixelXDimension])
+		h, hok := t.uint(ifd[exifPixelYDimension])
+		if wok && hok {
+			fields["width"] = int(w)
+			fields["height"] = int(h)
+		}
+	}
+
+	if p, ok := t.uint(ifd0[exifGPSPointer]); ok {
+		ifd, err := t.ifd(p)
+		if err != nil {
+			return err
+		}
+		lat, latok := t.degrees(ifd[gpsLatitude])
+		lon, lonok := t.degrees(ifd[gpsLongitude])
+		if latok && lonok {
+			if t.string(ifd[gpsLatitudeRef]) == "S" {
+				lat = -lat
+			}
+			if t.string(ifd[gpsLongitudeRef]) == "W" {
+				lon = -lon
+			}
+			fields["lat"] = lat
+			fields["lon"] = lon
+		}
+		if alt, ok := t.rationals(ifd[gpsAltitude]); ok && len(alt) == 1 {
+			// 1 is below the sea level
+			if ref := ifd[gpsAltitudeRef]; ref != nil && len(ref.value) > 0 && ref.value[0] == 1 {
+				alt[0] = -alt[0]
+			}
+			fields["alt"] = alt[0]
+		}
+	}
+	return nil
+}
+
+// typeSizes is the byte size of the TIFF types by the code.
+var typeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8,
+}
+
+// ifd reads the entries of the IFD at offset, omitting the unknown types.
+func (t *tiff) ifd(offset uint32) (map[uint16]*tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, errTIFF
+	}
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	if uint64(offset)+2+uint64(n)*12 > uint64(len(t.data)) {
+		return nil, errTIFF
+	}
+
+	entries := map[uint16]*tiffEntry{}
+	for i := uint32(0); i < n; i++ {
+		e := t.data[offset+2+i*12:]
+		tag := t.order.Uint16(e)
+		entry := &tiffEntry{typ: t.order.Uint16(e[2:]), count: t.order.Uint32(e[4:])}
+		size, ok := typeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(entry.count)
+		if total <= 4 {
+			entry.value = e[8 : 8+total]
+		} else {
+			p := uint64(t.order.Uint32(e[8:]))
+			if p+total > uint64(len(t.data)) {
+				continue
+			}
+			entry.value = t.data[p : p+total]
+		}
+		entries[tag] = entry
+	}
+	return entries, nil
+}
+
+// next returns the offset of the IFD after the one at offset, 0 if none.
+func (t *tiff) next(offset uint32) (uint32, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return 0, errTIFF
+	}
+	end := uint64(offset) + 2 + uint64(t.order.Uint16(t.data[offset:]))*12
+	if end+4 > uint64(len(t.data)) {
+		return 0, errTIFF
+	}
+	return t.order.Uint32(t.data[end:]), nil
+}
+
+func (t *tiff) string(e *tiffEntry) string {
+	if e == nil || e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (t *tiff) uint(e *tiffEntry) (uint32, bool) {
+	if e == nil || e.count == 0 {
+		return 0, false
+	}
+	switch e.typ {
+	case 3:
+		return uint32(t.order.Uint16(e.value)), true
+	case 4:
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+func (t *tiff) rationals(e *tiffEntry) ([]float64, bool) {
+	if e == nil || e.typ != 5 {
+		return nil, false
+	}
+	values := make([]float64, e.count)
+	for i := range values {
+		num := t.order.Uint32(e.value[i*8:])
+		den := t.order.Uint32(e.value[i*8+4:])
+		if den == 0 {
+			return nil, false
+		}
+		values[i] = float64(num) / float64(den)
+	}
+	return values, true
+}
+
+// degrees reads degrees, minutes and seconds into decimal degrees.
+func (t *tiff) degrees(e *tiffEntry) (float64, bool) {
+	dms, ok := t.rationals(e)
+	if !ok || len(dms) != 3 {
+		return 0, false
+	}
+	return dms[0] + dms[1]/60 + dms[2]/3600, true
+}
+
+func (t *tiff) setString(fields map[string]interface{}, name string, e *tiffEntry) {
+	if s := t.string(e); s != "" {
+		fields[name] = s
+	}
+}
+
+func (t *tiff) setInt(fields map[string]interface{}, name string, e *tiffEntry) {
+	if n, ok := t.uint(e); ok {
+		fields[name] = int(n)
+	}
+}
+
+// setDateTime sets "2006:01:02 15:04:05" as "2006-01-02T15:04:05", which
+// has no time zone.
+func (t *tiff) setDateTime(fields map[string]interface{}, name string, e *tiffEntry) {
+	s := t.string(e)
+	if len(s) != len("2006:01:02 15:04:05") {
+		return
+	}
+	fields[name] = strings.Replace(s[:10], ":", "-", 2) + "T" + s[11:]
+}
+
+// extractMeta merges the metadata extracted from the target of key into
+// the JSON value, under the name of extract.  Only "exif" is supported.
+func (s *Server) extractMeta(ctx context.Context, key, extract, value string) (string, error) {
+	if extract != "exif" {
+		return "", &StatusError{http.StatusBadRequest, fmt.Sprintf("unknown extract %s", extract)}
+	}
+	Url := extractTargetURL(key)
+	if Url == "" {
+		return "", &StatusError{http.StatusBadRequest, fmt.Sprintf("target not found in path %s", key)}
+	}
+
+	usermeta := map[string]interface{}{}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &usermeta); err != nil {
+			return "", &StatusError{http.StatusBadRequest, fmt.Sprintf("unrecognized metadata: %v", err)}
+		}
+	}
+
+	resp, err := s.fetchTarget(ctx, Url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	fields, err := parseExif(resp.Body)
+	if err == errNotJPEG {
+		return "", &StatusError{http.StatusUnsupportedMediaType, "exif needs a JPEG"}
+	} else if err != nil {
+		return "", &StatusError{http.StatusUnprocessableEntity, fmt.Sprintf("unreadable JPEG: %v", err)}
+	}
+	usermeta[extract] = fields
+
+	data, err := json.Marshal(usermeta)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// fetchTarget fetches Url for the metadata of the object, failing with 502
+// unless 200.  It is read whole, so shared as the input of the transforms
+// and limited by MaxInputBytes.
+func (s *Server) fetchTarget(ctx context.Context, Url string) (*http.Response, error) {
+	req, err := newTargetRequest(withSharedInput(ctx, s.opts.MaxInputBytes), Url)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{http.StatusBadGateway,
+			fmt.Sprintf("remote URL %q returned status: %v", Url, resp.Status)}
+	}
+	return resp, nil
+}
@@ -0,0 +1,138 @@
+package istore
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"strings"
+
+	"github.com/AlpacaDB/istore/lsh"
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// FeatureKey is the reserved key of MetaData for the feature vector
+// computed by compute=feature.
+const FeatureKey = "_feature"
+
+// FeatureSize is the length of the feature vector, which is the vecsize of
+// the index created by FeatureKey.
+const FeatureSize = featureBins * featureBins * featureBins
+
+// featureBins is the number of bins per RGB channel.
+const featureBins = 4
+
+// _IndexBySuffix is appended to the index key for the metadata key it is
+// created by.
+const _IndexBySuffix = ".by"
+
+// imageFeature returns the color histogram of m, the fraction of the
+// pixels in each of the FeatureSize RGB cubes.
+func imageFeature(m image.Image) []float32 {
+	vec := make([]float32, FeatureSize)
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := m.At(x, y).RGBA()
+			// 16 bits per channel
+			bin := func(v uint32) int { return int(v * featureBins >> 16) }
+			vec[(bin(r)*featureBins+bin(g))*featureBins+bin(b)]++
+		}
+	}
+	if n := float32(bounds.Dx() * bounds.Dy()); n > 0 {
+		for i := range vec {
+			vec[i] /= n
+		}
+	}
+	return vec
+}
+
+// computeMeta merges the value computed from the target of key into the
+// JSON value, under FeatureKey for "feature", the only one supported.  It
+// returns the vector along.
+func (s *Server) computeMeta(ctx context.Context, key, compute, value string) (string, []float32, error) {
+	if compute != "feature" {
+		return "", nil, &StatusError{http.StatusBadRequest, fmt.Sprintf("unknown compute %s", compute)}
+	}
+	Url := extractTargetURL(key)
+	if Url == "" {
+		return "", nil, &StatusError{http.StatusBadRequest, fmt.Sprintf("target not found in path %s", key)}
+	}
+
+	usermeta := map[string]interface{}{}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &usermeta); err != nil {
+			return "", nil, &StatusError{http.StatusBadRequest, fmt.Sprintf("unrecognized metadata: %v", err)}
+		}
+	}
+
+	resp, err := s.fetchTarget(ctx, Url)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := s.readImage(resp)
+	if err != nil {
+		return "", nil, err
+	}
+	m, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, &StatusError{http.StatusUnprocessableEntity, fmt.Sprintf("undecodable image: %v", err)}
+	}
+
+	vec := imageFeature(m)
+	usermeta[FeatureKey] = vec
+	if data, err = json.Marshal(usermeta); err != nil {
+		return "", nil, err
+	}
+	return string(data), vec, nil
+}
+
+// oldFeature returns the feature vector stored for key, or nil.
+func (s *Server) oldFeature(key string) []float32 {
+	data, err := s.Db.Get([]byte(key), nil)
+	if err != nil {
+		return nil
+	}
+	meta := ItemMeta{}
+	if _, err := meta.UnmarshalMsg(data); err != nil {
+		return nil
+	}
+	return jsonArrayToFloat32(meta.MetaData[FeatureKey])
+}
+
+// indexFeature adds vec of itemId to the indexes created by FeatureKey
+// in the directories of key, replacing old if any.  It needs indexLock.
+func (s *Server) indexFeature(batch *leveldb.Batch, key string, itemId ItemId, old, vec []float32) {
+	for i := range key {
+		if key[i] != '/' || strings.Contains(key[:i], "://") {
+			continue
+		}
+		dir := key[:i+1]
+		by, err := s.Db.Get([]byte(dir+"_index"+_IndexBySuffix), nil)
+		if err != nil || string(by) != FeatureKey {
+			continue
+		}
+		data, err := s.Db.Get([]byte(dir+"_index"), nil)
+		if err != nil {
+			continue
+		}
+		index := new(lsh.Indexer)
+		index.Decode(gob.NewDecoder(bytes.NewReader(data)))
+		if index.VecSize() != len(vec) {
+			glog.Error("index of ", dir, " takes ", index.VecSize(), " elements, not ", len(vec))
+			continue
+		}
+		if len(old) == len(vec) {
+			index.Remove(uint64(itemId), old)
+		}
+		index.Add(uint64(itemId), vec)
+
+		var buf bytes.Buffer
+		index.Encode(gob.NewEncoder(&buf))
+		batch.Put([]byte(dir+"_index"), buf.Bytes())
+	}
+}
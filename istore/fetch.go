@@ -0,0 +1,95 @@
+package istore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Fetcher retrieves the object at the URL.  Each URL scheme is served by
+// a Fetcher registered to Server.
+type Fetcher interface {
+	Fetch(ctx context.Context, u *url.URL) (*http.Response, error)
+}
+
+// FetcherFunc is an adapter to use an ordinary function as Fetcher.
+type FetcherFunc func(ctx context.Context, u *url.URL) (*http.Response, error)
+
+// Fetch implements Fetcher.Fetch()
+func (f FetcherFunc) Fetch(ctx context.Context, u *url.URL) (*http.Response, error) {
+	return f(ctx, u)
+}
+
+// HeadFetcher is implemented by the fetchers that can retrieve the headers
+// without the body.  HEAD requests are served by Fetch for the others.
+type HeadFetcher interface {
+	Fetcher
+	Head(ctx context.Context, u *url.URL) (*http.Response, error)
+}
+
+// headFetcher adds Head to a Fetcher.
+type headFetcher struct {
+	Fetcher
+	head FetcherFunc
+}
+
+// Head implements HeadFetcher.Head()
+func (f headFetcher) Head(ctx context.Context, u *url.URL) (*http.Response, error) {
+	return f.head(ctx, u)
+}
+
+// UnknownSchemeError is returned when no Fetcher is registered for the scheme.
+type UnknownSchemeError struct {
+	Scheme string
+}
+
+func (e *UnknownSchemeError) Error() string {
+	return fmt.Sprintf("unknown scheme %s", e.Scheme)
+}
+
+// StatusCode implements statusCoder.StatusCode()
+func (e *UnknownSchemeError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// RegisterFetcher registers the fetcher for the URL scheme, replacing
+// the existing one if any.
+func (s *Server) RegisterFetcher(scheme string, fetcher Fetcher) {
+	s.fetchersLock.Lock()
+	defer s.fetchersLock.Unlock()
+
+	if s.fetchers == nil {
+		s.fetchers = map[string]Fetcher{}
+	}
+	s.fetchers[strings.ToLower(scheme)] = fetcher
+}
+
+// Fetcher returns the fetcher registered for the URL scheme, or nil.
+func (s *Server) Fetcher(scheme string) Fetcher {
+	s.fetchersLock.RLock()
+	defer s.fetchersLock.RUnlock()
+
+	return s.fetchers[strings.ToLower(scheme)]
+}
+
+func (s *Server) registerDefaultFetchers() {
+	s.RegisterFetcher("file", requestFetcher(s.localFileGet))
+	s.RegisterFetcher("http", headFetcher{requestFetcher(s.httpGet), s.httpHead})
+	s.RegisterFetcher("https", headFetcher{requestFetcher(s.httpGet), s.httpHead})
+	s.RegisterFetcher("self", headFetcher{FetcherFunc(s.selfGet), s.selfHead})
+	s.RegisterFetcher("data", FetcherFunc(dataGet))
+	s3 := s.opts.S3
+	if s3 == nil {
+		s3 = &S3Fetcher{}
+	}
+	if s3.UserAgent == "" {
+		s3.UserAgent = s.opts.UserAgent
+	}
+	if s3.Client == nil {
+		// e.g. an S3 compatible Endpoint by the private CA
+		s3.Client = &http.Client{Transport: s.transport}
+	}
+	s.RegisterFetcher("s3", s3)
+}
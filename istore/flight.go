@@ -0,0 +1,71 @@
+package istore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls with the same key into one
+// execution.  The result is shared by the callers, so it must not be
+// consumed by one of them, e.g. use []byte rather than io.Reader.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// Do executes fn for the key unless another call for the key is in flight,
+// in which case it waits for and returns the result of it.  If fn panics,
+// the waiters get an error.
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	returned := false
+	defer func() {
+		if !returned {
+			// fn panicked, which goes on in the caller
+			call.val, call.err = nil, fmt.Errorf("call for %q panicked", key)
+		}
+		call.wg.Done()
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+	}()
+	call.val, call.err = fn()
+	returned = true
+
+	return call.val, call.err
+}
+
+// DoContext is like Do, but executes again if the call in flight was
+// canceled by its caller while ctx is still alive.
+func (g *flightGroup) DoContext(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	for {
+		v, err := g.Do(key, fn)
+		if err == nil || ctx.Err() != nil {
+			return v, err
+		}
+		if cause := causeOf(err); cause != context.Canceled && cause != context.DeadlineExceeded {
+			return v, err
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package istore
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Histogram is the number of the pixels per bin of each channel, where
+// Luminance is by ITU-R BT.601.
+type Histogram struct {
+	Bins      int   `json:"bins"`
+	R         []int `json:"r"`
+	G         []int `json:"g"`
+	B         []int `json:"b"`
+	Luminance []int `json:"luminance"`
+}
+
+// histogramBins parses bins of histogram, 1 to 256 (default).
+func histogramBins(args Values) (int, error) {
+	if args.Get("bins") == "" {
+		return 256, nil
+	}
+	ns, err := args.ints("bins")
+	if err != nil {
+		return 0, err
+	}
+	if ns[0] < 1 || ns[0] > 256 {
+		return 0, fmt.Errorf("invalid bins %d, must be 1..256", ns[0])
+	}
+	return ns[0], nil
+}
+
+// imageHistogram counts the pixels of m into bins per channel, reading
+// them one by one.
+func imageHistogram(m image.Image, bins int) *Histogram {
+	h := &Histogram{
+		Bins:      bins,
+		R:         make([]int, bins),
+		G:         make([]int, bins),
+		B:         make([]int, bins),
+		Luminance: make([]int, bins),
+	}
+	// 16 bits per channel
+	bin := func(v uint32) int { return int(v * uint32(bins) >> 16) }
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := m.At(x, y).RGBA()
+			h.R[bin(r)]++
+			h.G[bin(g)]++
+			h.B[bin(b)]++
+			h.Luminance[bin((299*r+587*g+114*b+500)/1000)]++
+		}
+	}
+	return h
+}
+
+// normalize stretches the luminance so that the darkest pixels become
+// black and the lightest white, ignoring clip percent of the pixels at
+// each end.  The channels are remapped by the same table, keeping the hue.
+// m is returned as is if it is all in a single level.
+func normalize(clip float64) imageProc {
+	return func(m image.Image) image.Image {
+		lum := imageHistogram(m, 256).Luminance
+		total := 0
+		for _, n := range lum {
+			total += n
+		}
+		skip := int(float64(total) * clip / 100)
+		low, high := 0, 255
+		for n := 0; low < 255 && n+lum[low] <= skip; low++ {
+			n += lum[low]
+		}
+		for n := 0; high > 0 && n+lum[high] <= skip; high-- {
+			n += lum[high]
+		}
+		if high <= low {
+			return m
+		}
+
+		var table [256]uint8
+		for v := range table {
+			scaled := (v - low) * 255 / (high - low)
+			table[v] = uint8(math.Min(math.Max(float64(scaled), 0), 255))
+		}
+		return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+			return color.NRGBA{table[c.R], table[c.G], table[c.B], c.A}
+		})
+	}
+}
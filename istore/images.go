@@ -11,6 +11,8 @@ import "C"
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"image"
@@ -20,201 +22,1749 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
 	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/golang/glog"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/umitanuki/gmf"
+	"golang.org/x/image/bmp"
+	tiffcodec "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 var (
 	AVSEEK_SIZE = C.AVSEEK_SIZE
 )
 
-func selfURL(p string) string {
-	r := strings.NewReplacer("?", "%3F", "%", "%25")
-	return "self://" + r.Replace(p)
+// HLine draws a horizontal line
+func HLine(img draw.Image, x1, y, x2 int, col color.Color) {
+	for ; x1 <= x2; x1++ {
+		img.Set(x1, y, col)
+	}
+}
+
+// VLine draws a veritcal line
+func VLine(img draw.Image, x, y1, y2 int, col color.Color) {
+	for ; y1 <= y2; y1++ {
+		img.Set(x, y1, col)
+	}
+}
+
+// Rect draws a rectangle utilizing HLine() and VLine()
+func RectLine(img draw.Image, x1, y1, x2, y2 int, col color.Color) {
+	HLine(img, x1, y1, x2, col)
+	HLine(img, x1, y2, x2, col)
+	VLine(img, x1, y1, y2, col)
+	VLine(img, x2, y1, y2, col)
+}
+
+// imageTypes is the media types image.Decode understands, and HEIF decoded
+// by ffmpeg.
+var imageTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+	"image/tiff": true,
+	"image/heic": true,
+	"image/heif": true,
+}
+
+// genericTypes tell nothing about the content, which is sniffed instead.
+var genericTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// checkImageType fails with 415 unless resp is one of imageTypes by its
+// Content-Type, or by sniffing the first 512 bytes if it is generic.  The
+// sniffed bytes are put back to resp.Body.
+func checkImageType(resp *http.Response) error {
+	mediatype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if genericTypes[mediatype] {
+		head := make([]byte, 512)
+		n, err := io.ReadFull(resp.Body, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		head = head[:n]
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+		mediatype, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+		// not known to DetectContentType
+		if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+			mediatype = "image/tiff"
+		}
+		if isHEIF(head) {
+			mediatype = "image/heif"
+		}
+	}
+	if !imageTypes[mediatype] {
+		return &StatusError{http.StatusUnsupportedMediaType,
+			fmt.Sprintf("%s is not a supported image type", mediatype)}
+	}
+	return nil
+}
+
+// heifBrands is the major brands of ftyp of the HEIF images, not the
+// videos of the same ISO base media file format.
+var heifBrands = map[string]bool{
+	"heic": true,
+	"heix": true,
+	"heim": true,
+	"heis": true,
+	"hevc": true,
+	"hevx": true,
+	"mif1": true,
+	"msf1": true,
+}
+
+// isHEIF tells if head starts with ftyp of the HEIF image.
+func isHEIF(head []byte) bool {
+	return len(head) >= 12 && string(head[4:8]) == "ftyp" && heifBrands[string(head[8:12])]
+}
+
+// decodeOptions limits and scales decodeImage.
+type decodeOptions struct {
+	// MaxPixels fails the image of more pixels with 413 before decoding,
+	// against the decompression bombs.  Zero means no limit.
+	MaxPixels int64
+	// MinSize is the size the image may be decoded down to, if it is the
+	// baseline JPEG at least twice as large.  Zero decodes in full.
+	MinSize image.Point
+}
+
+// decodeImage decodes input by image.Decode, or by ffmpeg if it is HEIF,
+// such as the photos of iPhone.  The JPEG is decoded at 1/2, 1/4 or 1/8 if
+// it is still as large as opts.MinSize.
+func decodeImage(ctx context.Context, input io.Reader, opts decodeOptions) (image.Image, string, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(input); err != nil {
+		return nil, "", err
+	}
+	data := buf.Bytes()
+	if !isHEIF(data) {
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+		pixels := int64(config.Width) * int64(config.Height)
+		if opts.MaxPixels > 0 && pixels > opts.MaxPixels {
+			return nil, "", &StatusError{http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("image of %dx%d exceeds %d pixels", config.Width, config.Height, opts.MaxPixels)}
+		}
+		if format == "jpeg" {
+			if scale := jpegScale(image.Pt(config.Width, config.Height), opts.MinSize); scale > 1 {
+				if m, err := decodeJPEGScaled(data, scale); err == nil {
+					return m, format, nil
+				} else if err != errJPEGUnsupported {
+					glog.V(1).Info("scaled JPEG decoding failed: ", err)
+				}
+			}
+		}
+		return image.Decode(bytes.NewReader(data))
+	}
+	var m image.Image
+	err := decodeFrames(ctx, bytes.NewReader(data), frameArgs{}, func(i int, ts time.Duration, img func() *image.RGBA) bool {
+		m = img()
+		return false
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		return nil, "", &StatusError{http.StatusUnsupportedMediaType, fmt.Sprintf("cannot decode HEIF: %v", err)}
+	}
+	if m == nil {
+		return nil, "", &StatusError{http.StatusUnsupportedMediaType, "no image in HEIF"}
+	}
+	return m, "heic", nil
+}
+
+// checkPixels fails with 413 if the image of size is of more pixels than
+// maxPixels.  Zero means no limit.
+func checkPixels(size image.Point, maxPixels int64) error {
+	if maxPixels > 0 && float64(size.X)*float64(size.Y) > float64(maxPixels) {
+		return &StatusError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("output of %dx%d exceeds %d pixels", size.X, size.Y, maxPixels)}
+	}
+	return nil
+}
+
+// jpegScale returns the largest of 8, 4 and 2 to scale size down by, not
+// smaller than min, or 1 if none.
+func jpegScale(size, min image.Point) int {
+	if min.X <= 0 && min.Y <= 0 {
+		return 1
+	}
+	for _, scale := range []int{8, 4, 2} {
+		if (size.X+scale-1)/scale >= min.X && (size.Y+scale-1)/scale >= min.Y {
+			return scale
+		}
+	}
+	return 1
+}
+
+// bufferPool keeps the buffers of the inputs and the outputs of the
+// transforms for the next ones, so that a burst of them doesn't grow new
+// buffers each time.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// _MaxPooledBuffer is the capacity beyond which a buffer is left to GC, not
+// to keep the memory of a huge image in the pool.
+const _MaxPooledBuffer = 16 << 20
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool, which must not be used any more.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= _MaxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// limitedBody fails with 413 once more than limit bytes are read, so that
+// a huge input is not buffered for the transforms.
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.exceeded() {
+		return n, b.tooLarge()
+	}
+	return n, err
+}
+
+func (b *limitedBody) exceeded() bool {
+	return b.read > b.limit
+}
+
+func (b *limitedBody) tooLarge() error {
+	return inputTooLarge(b.limit)
+}
+
+// inputTooLarge is the error of the input larger than limit bytes.
+func inputTooLarge(limit int64) error {
+	return &StatusError{http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("input exceeds %d bytes", limit)}
+}
+
+type drawRectOptions struct {
+	X1, Y1, X2, Y2 int
+	R, G, B, A     uint8
+	// Thickness is the width of the outline growing inward, ignored if
+	// Fill.
+	Thickness int
+	Fill      bool
+	// Label is drawn at the top left of the rect in LabelSize pixels, if
+	// not empty.
+	Label     string
+	LabelSize int
+}
+
+// imageProc is an image function of apply.
+type imageProc func(image.Image) image.Image
+
+// encodeOptions tunes the output of encodeImage.
+type encodeOptions struct {
+	// Quality is the JPEG quality in 1..100.
+	Quality  int
+	PNGLevel png.CompressionLevel
+	// Metadata is "keep" or "strip" of the JPEG metadata, or "" for the
+	// default, which strips but leaves the unchanged input as is.
+	Metadata string
+	// Orient applies the EXIF orientation before the steps.
+	Orient bool
+	// Background is the opaque color under the transparent pixels of the
+	// JPEG output.
+	Background color.NRGBA
+	// Page is the page of the multi-page TIFF input from 0.
+	Page int
+	// FirstFrame takes only the first frame of the animated GIF input.
+	FirstFrame bool
+	// Progressive encodes JPEG in progressive, and Subsample in 4:2:0 or
+	// 4:4:4 by "420" or "444", both by encodeJPEG instead of image/jpeg.
+	Progressive bool
+	Subsample   string
+}
+
+const _DefaultJPEGQuality = 85
+
+var pngLevels = map[string]png.CompressionLevel{
+	"default":          png.DefaultCompression,
+	"best-speed":       png.BestSpeed,
+	"best-compression": png.BestCompression,
+}
+
+// parseEncodeOptions reads q, png_level, metadata, orient, jpeg_bg, page and
+// first_frame of the query, which fail with 400 if out of range.
+func parseEncodeOptions(query url.Values) (encodeOptions, error) {
+	opts := encodeOptions{
+		Quality:    _DefaultJPEGQuality,
+		PNGLevel:   png.DefaultCompression,
+		Background: color.NRGBA{0xff, 0xff, 0xff, 0xff},
+	}
+	if q := query.Get("q"); q != "" {
+		quality, err := strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 100 {
+			return opts, &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid q %s, must be 1..100", q)}
+		}
+		opts.Quality = quality
+	}
+	if name := query.Get("png_level"); name != "" {
+		level, ok := pngLevels[name]
+		if !ok {
+			return opts, &StatusError{http.StatusBadRequest, fmt.Sprintf("unknown png_level %s", name)}
+		}
+		opts.PNGLevel = level
+	}
+	if m := query.Get("metadata"); m != "" {
+		metadata, err := parseMetadata(m)
+		if err != nil {
+			return opts, err
+		}
+		opts.Metadata = metadata
+	}
+	if s := query.Get("orient"); s != "" {
+		orient, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid orient %q", s)}
+		}
+		opts.Orient = orient
+	}
+	if s := query.Get("jpeg_bg"); s != "" {
+		bg, err := parseHexColor(s)
+		if err != nil || bg.(color.NRGBA).A != 0xff {
+			return opts, &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid jpeg_bg %s, must be RRGGBB", s)}
+		}
+		opts.Background = bg.(color.NRGBA)
+	}
+	if s := query.Get("page"); s != "" {
+		page, err := strconv.Atoi(s)
+		if err != nil || page < 0 {
+			return opts, &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid page %s", s)}
+		}
+		opts.Page = page
+	}
+	if s := query.Get("first_frame"); s != "" {
+		first, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid first_frame %q", s)}
+		}
+		opts.FirstFrame = first
+	}
+	if s := query.Get("progressive"); s != "" {
+		progressive, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid progressive %q", s)}
+		}
+		opts.Progressive = progressive
+	}
+	if s := query.Get("subsample"); s != "" {
+		if s != subsample420 && s != subsample444 {
+			return opts, &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid subsample %s, must be 420 or 444", s)}
+		}
+		opts.Subsample = s
+	}
+	return opts, nil
+}
+
+// reencodes reports whether opts changes the JPEG encoding, so that the
+// input is not passed through as is.
+func (opts encodeOptions) reencodes() bool {
+	return opts.Progressive || opts.Subsample != ""
+}
+
+// key identifies opts in the cache key.
+func (opts encodeOptions) key() string {
+	bg := opts.Background
+	return fmt.Sprintf("q=%d&png_level=%d&metadata=%s&orient=%t&jpeg_bg=%02x%02x%02x&page=%d&first_frame=%t&progressive=%t&subsample=%s",
+		opts.Quality, opts.PNGLevel, opts.Metadata, opts.Orient, bg.R, bg.G, bg.B, opts.Page, opts.FirstFrame,
+		opts.Progressive, opts.Subsample)
+}
+
+// encodeImage encodes m in format, one of gif, jpeg, png, webp, bmp and tiff.
+func encodeImage(m image.Image, format string, opts encodeOptions) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	switch format {
+	case "gif":
+		gif.Encode(buf, m, nil)
+	case "jpeg":
+		if opts.reencodes() {
+			if err := encodeJPEG(buf, flatten(m, opts.Background), opts.Quality, opts.Subsample, opts.Progressive); err != nil {
+				return nil, err
+			}
+			break
+		}
+		jpeg.Encode(buf, flatten(m, opts.Background), &jpeg.Options{Quality: opts.Quality})
+	case "png":
+		enc := &png.Encoder{CompressionLevel: opts.PNGLevel}
+		enc.Encode(buf, m)
+	case "webp":
+		if err := encodeWebP(buf, m, opts.Quality); err != nil {
+			return nil, err
+		}
+	case "bmp":
+		if err := bmp.Encode(buf, m); err != nil {
+			return nil, err
+		}
+	case "tiff":
+		if err := tiffcodec.Encode(buf, m, &tiffcodec.Options{Compression: tiffcodec.Deflate}); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+
+	// the exact copy, as buf goes back to the pool
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// flatten composites m over bg, as JPEG would turn the transparent pixels
+// black.
+func flatten(m image.Image, bg color.Color) image.Image {
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok && o.Opaque() {
+		return m
+	}
+	dst := image.NewNRGBA(m.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.ZP, draw.Src)
+	draw.Draw(dst, dst.Bounds(), m, m.Bounds().Min, draw.Over)
+	return dst
+}
+
+func adjustBrightness(percentage float64) imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.AdjustBrightness(m, percentage)
+	}
+}
+
+func adjustContrast(percentage float64) imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.AdjustContrast(m, percentage)
+	}
+}
+
+func adjustGamma(gamma float64) imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.AdjustGamma(m, gamma)
+	}
+}
+
+func adjustSigmoid(midpoint, factor float64) imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.AdjustSigmoid(m, midpoint, factor)
+	}
+}
+
+// adjustHue rotates the hue by percentage of the full circle, from -100 to
+// 100.
+func adjustHue(percentage float64) imageProc {
+	shift := math.Min(math.Max(percentage, -100), 100) / 100
+	return func(m image.Image) image.Image {
+		return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+			h, s, l := rgbToHSL(c)
+			h = math.Mod(h+shift+1, 1)
+			return hslToRGB(h, s, l, c.A)
+		})
+	}
+}
+
+// adjustSaturation changes the saturation by percentage from -100 to 100,
+// where -100 makes the image gray.
+func adjustSaturation(percentage float64) imageProc {
+	factor := 1 + math.Min(math.Max(percentage, -100), 100)/100
+	return func(m image.Image) image.Image {
+		return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+			h, s, l := rgbToHSL(c)
+			return hslToRGB(h, math.Min(s*factor, 1), l, c.A)
+		})
+	}
+}
+
+// adjustHSL rotates the hue by degrees, changes the saturation by s as
+// adjustSaturation, and the lightness by l percent toward white if
+// positive or black if negative, all at once.
+func adjustHSL(hue, sat, light float64) imageProc {
+	shift := hue / 360
+	factor := 1 + sat/100
+	return func(m image.Image) image.Image {
+		return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+			h, s, l := rgbToHSL(c)
+			h = math.Mod(h+shift+1, 1)
+			s = math.Min(s*factor, 1)
+			if light > 0 {
+				l += (1 - l) * light / 100
+			} else {
+				l *= 1 + light/100
+			}
+			return hslToRGB(h, s, l, c.A)
+		})
+	}
+}
+
+// rgbToHSL converts c to the hue, saturation and lightness, each in [0, 1].
+func rgbToHSL(c color.NRGBA) (h, s, l float64) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	l = (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+
+	d := max - min
+	if l > 0.5 {
+		s = d / (2 - max - min)
+	} else {
+		s = d / (max + min)
+	}
+	switch max {
+	case r:
+		h = (g - b) / d
+		if g < b {
+			h += 6
+		}
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h / 6, s, l
+}
+
+// hslToRGB converts the hue, saturation and lightness back to the color
+// with alpha a.
+func hslToRGB(h, s, l float64, a uint8) color.NRGBA {
+	if s == 0 {
+		v := uint8(l*255 + 0.5)
+		return color.NRGBA{v, v, v, a}
+	}
+
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	hue := func(t float64) uint8 {
+		t = math.Mod(t+1, 1)
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 1.0/2:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(v*255 + 0.5)
+	}
+	return color.NRGBA{hue(h + 1.0/3), hue(h), hue(h - 1.0/3), a}
+}
+
+func blur(sigma float64) imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.Blur(m, sigma)
+	}
+}
+
+// blurRegion blurs the rects and keeps the rest sharp.  Each rect is blurred
+// with the margin of 3 sigma around it, so that the edges blend in.
+func blurRegion(sigma float64, rects []image.Rectangle) imageProc {
+	return func(m image.Image) image.Image {
+		dst := imaging.Clone(m)
+		margin := int(math.Ceil(3 * sigma))
+		for _, rect := range rects {
+			rect = rect.Intersect(dst.Bounds())
+			if rect.Empty() {
+				continue
+			}
+			outer := rect.Inset(-margin).Intersect(dst.Bounds())
+			blurred := imaging.Blur(imaging.Crop(dst, outer), sigma)
+			draw.Draw(dst, rect, blurred, rect.Min.Sub(outer.Min), draw.Src)
+		}
+		return dst
+	}
+}
+
+const _DefaultPixelateBlock = 16
+
+// pixelate fills each block x block of m with the mean color, only in
+// rects if any.  The blocks start at the top left of each rect, and the
+// block is at most the size of it.
+func pixelate(block int, rects []image.Rectangle) imageProc {
+	return func(m image.Image) image.Image {
+		dst := imaging.Clone(m)
+		regions := rects
+		if len(regions) == 0 {
+			regions = []image.Rectangle{dst.Bounds()}
+		}
+		for _, rect := range regions {
+			rect = rect.Intersect(dst.Bounds())
+			size := block
+			if max := int(math.Max(float64(rect.Dx()), float64(rect.Dy()))); size > max {
+				size = max
+			}
+			for y := rect.Min.Y; y < rect.Max.Y; y += size {
+				for x := rect.Min.X; x < rect.Max.X; x += size {
+					b := image.Rect(x, y, x+size, y+size).Intersect(rect)
+					fillMean(dst, b)
+				}
+			}
+		}
+		return dst
+	}
+}
+
+const _DefaultRedactSigma = 10
+
+// redactRegion is a rect of redact, pixelated by block or blurred by sigma.
+type redactRegion struct {
+	rect  image.Rectangle
+	blur  bool
+	block int
+	sigma float64
+}
+
+// parseRedact reads the rects of redact, each with its mode, pixelate
+// (default) or blur, and block or sigma, which default to the ones of args.
+func parseRedact(args Values) ([]*redactRegion, error) {
+	defaults := &redactRegion{block: _DefaultPixelateBlock, sigma: _DefaultRedactSigma}
+	if err := defaults.parse(args); err != nil {
+		return nil, err
+	}
+	var regions []*redactRegion
+	for i, val := range args.Values["rects"] {
+		subvalues, err := parseSubValues(val)
+		if err != nil {
+			return nil, err
+		}
+		r := *defaults
+		// not image.Rect, which would swap the inverted ones
+		r.rect = image.Rectangle{
+			image.Pt(subvalues.GetInt("x1", 0), subvalues.GetInt("y1", 0)),
+			image.Pt(subvalues.GetInt("x2", 0), subvalues.GetInt("y2", 0))}
+		if r.rect.Empty() {
+			return nil, fmt.Errorf("rect %d: empty rect %q", i+1, val)
+		}
+		if err := r.parse(subvalues); err != nil {
+			return nil, fmt.Errorf("rect %d: %v", i+1, err)
+		}
+		regions = append(regions, &r)
+	}
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("rects is missing")
+	}
+	return regions, nil
+}
+
+// parse reads mode, block and sigma of args over r.
+func (r *redactRegion) parse(args Values) error {
+	switch mode := args.Get("mode"); mode {
+	case "":
+	case "pixelate":
+		r.blur = false
+	case "blur":
+		r.blur = true
+	default:
+		return fmt.Errorf("unknown mode %s, must be pixelate or blur", mode)
+	}
+	if args.Get("block") != "" {
+		bs, err := args.ints("block")
+		if err != nil {
+			return err
+		}
+		if r.block = bs[0]; r.block < 2 {
+			return fmt.Errorf("invalid block %d, must be 2 or more", r.block)
+		}
+	}
+	if args.Get("sigma") != "" {
+		sigma, err := args.float("sigma")
+		if err != nil {
+			return err
+		}
+		if r.sigma = sigma; r.sigma <= 0 {
+			return fmt.Errorf("invalid sigma %v", r.sigma)
+		}
+	}
+	return nil
+}
+
+// redact pixelates or blurs each of regions, clipped to the image, and
+// keeps the rest as is.
+func redact(regions []*redactRegion) imageProc {
+	return func(m image.Image) image.Image {
+		for _, r := range regions {
+			if r.blur {
+				m = blurRegion(r.sigma, []image.Rectangle{r.rect})(m)
+			} else {
+				m = pixelate(r.block, []image.Rectangle{r.rect})(m)
+			}
+		}
+		return m
+	}
+}
+
+// fillMean fills r of m with the mean color of it, weighted by the alpha.
+func fillMean(m *image.NRGBA, r image.Rectangle) {
+	var sr, sg, sb, sa int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := m.NRGBAAt(x, y)
+			a := int(c.A)
+			sr, sg, sb, sa = sr+int(c.R)*a, sg+int(c.G)*a, sb+int(c.B)*a, sa+a
+		}
+	}
+	var mean color.NRGBA
+	if n := r.Dx() * r.Dy(); sa > 0 && n > 0 {
+		mean = color.NRGBA{uint8((sr + sa/2) / sa), uint8((sg + sa/2) / sa), uint8((sb + sa/2) / sa), uint8((sa + n/2) / n)}
+	}
+	draw.Draw(m, r, image.NewUniform(mean), image.ZP, draw.Src)
+}
+
+func crop(x1, y1, x2, y2 int) imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.Crop(m, image.Rect(x1, y1, x2, y2))
+	}
+}
+
+// cropRel crops by the coordinates relative to the bounds in 0..1, at least
+// 1 pixel.
+func cropRel(x1, y1, x2, y2 float64) imageProc {
+	return func(m image.Image) image.Image {
+		b := m.Bounds()
+		w, h := float64(b.Dx()), float64(b.Dy())
+		rect := image.Rect(
+			int(math.Floor(x1*w)), int(math.Floor(y1*h)),
+			int(math.Ceil(x2*w)), int(math.Ceil(y2*h)))
+		return imaging.Crop(m, rect.Add(b.Min))
+	}
+}
+
+// cropRegion crops the fraction w x h of the image at anchor, one of
+// fillAnchors.
+func cropRegion(anchor [2]int, w, h float64) imageProc {
+	return func(m image.Image) image.Image {
+		b := m.Bounds()
+		width := int(math.Max(1, math.Floor(w*float64(b.Dx())+0.5)))
+		height := int(math.Max(1, math.Floor(h*float64(b.Dy())+0.5)))
+		pt := image.Pt((b.Dx()-width)*anchor[0]/2, (b.Dy()-height)*anchor[1]/2).Add(b.Min)
+		return imaging.Crop(m, image.Rectangle{pt, pt.Add(image.Pt(width, height))})
+	}
+}
+
+const _DefaultAutocropTolerance = 10
+
+// autocrop trims the borders of the background, the color of at least two
+// corners within tolerance in each channel.  m is returned as is if there
+// is no such border, or nothing but the background.
+func autocrop(tolerance int) imageProc {
+	return func(m image.Image) image.Image {
+		src := imaging.Clone(m)
+		r := src.Bounds()
+		corners := []image.Point{r.Min, {r.Max.X - 1, r.Min.Y}, {r.Min.X, r.Max.Y - 1}, r.Max.Sub(image.Pt(1, 1))}
+		var bg color.NRGBA
+		best := 0
+		for _, p := range corners {
+			c := src.NRGBAAt(p.X, p.Y)
+			n := 0
+			for _, q := range corners {
+				if colorWithin(c, src.NRGBAAt(q.X, q.Y), tolerance) {
+					n++
+				}
+			}
+			if n > best {
+				bg, best = c, n
+			}
+		}
+		if best < 2 {
+			return m
+		}
+
+		isBackground := func(x0, y0, x1, y1 int) bool {
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					if !colorWithin(bg, src.NRGBAAt(x, y), tolerance) {
+						return false
+					}
+				}
+			}
+			return true
+		}
+		box := r
+		for box.Min.Y < box.Max.Y && isBackground(box.Min.X, box.Min.Y, box.Max.X, box.Min.Y+1) {
+			box.Min.Y++
+		}
+		for box.Max.Y > box.Min.Y && isBackground(box.Min.X, box.Max.Y-1, box.Max.X, box.Max.Y) {
+			box.Max.Y--
+		}
+		for box.Min.X < box.Max.X && isBackground(box.Min.X, box.Min.Y, box.Min.X+1, box.Max.Y) {
+			box.Min.X++
+		}
+		for box.Max.X > box.Min.X && isBackground(box.Max.X-1, box.Min.Y, box.Max.X, box.Max.Y) {
+			box.Max.X--
+		}
+		if box.Empty() || box == r {
+			return m
+		}
+		return imaging.Crop(src, box)
+	}
+}
+
+// colorWithin reports whether every channel of a and b differs within
+// tolerance.
+func colorWithin(a, b color.NRGBA, tolerance int) bool {
+	within := func(x, y uint8) bool {
+		d := int(x) - int(y)
+		return d <= tolerance && -d <= tolerance
+	}
+	return within(a.R, b.R) && within(a.G, b.G) && within(a.B, b.B) && within(a.A, b.A)
+}
+
+func cropCenter(width, height int) imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.CropCenter(m, width, height)
+	}
+}
+
+// drawRect draws the outlines or the fills of the rects, including x2 and
+// y2, composited over the image by the alpha.  The rects are clamped to the
+// image, so the outline outside is drawn at the edge.
+func drawRect(opts []*drawRectOptions) imageProc {
+	return func(m image.Image) image.Image {
+		bounds := m.Bounds()
+		m2 := image.NewRGBA(bounds)
+		draw.Draw(m2, bounds, m, bounds.Min, draw.Src)
+		for _, opt := range opts {
+			col := color.NRGBA{opt.R, opt.G, opt.B, opt.A}
+			x1, x2 := opt.X1, opt.X2
+			if x2 < x1 {
+				x1, x2 = x2, x1
+			}
+			y1, y2 := opt.Y1, opt.Y2
+			if y2 < y1 {
+				y1, y2 = y2, y1
+			}
+			r := image.Rect(x1, y1, x2+1, y2+1).Intersect(bounds)
+			if r.Empty() {
+				continue
+			}
+			src := image.NewUniform(col)
+			if opt.Fill {
+				draw.Draw(m2, r, src, image.ZP, draw.Over)
+			} else {
+				for _, band := range outlineBands(r, opt.Thickness) {
+					draw.Draw(m2, band, src, image.ZP, draw.Over)
+				}
+			}
+			if opt.Label != "" {
+				drawLabel(m2, opt, r, col)
+			}
+		}
+		return m2
+	}
+}
+
+// outlineBands returns the top, bottom, left and right bands of r of the
+// width, not overlapping each other so that a translucent outline blends
+// once.
+func outlineBands(r image.Rectangle, width int) []image.Rectangle {
+	if width < 1 {
+		width = 1
+	}
+	if 2*width >= r.Dx() || 2*width >= r.Dy() {
+		return []image.Rectangle{r}
+	}
+	return []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+width),
+		image.Rect(r.Min.X, r.Max.Y-width, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, r.Min.Y+width, r.Min.X+width, r.Max.Y-width),
+		image.Rect(r.Max.X-width, r.Min.Y+width, r.Max.X, r.Max.Y-width),
+	}
+}
+
+func fit(width, height int) imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.Fit(m, width, height, imaging.Lanczos)
+	}
+}
+
+// fillAnchors is the position of the crop by fill, in halves of the
+// overflow from the left and the top.
+var fillAnchors = map[string][2]int{
+	"center":      {1, 1},
+	"top":         {1, 0},
+	"bottom":      {1, 2},
+	"left":        {0, 1},
+	"right":       {2, 1},
+	"topleft":     {0, 0},
+	"topright":    {2, 0},
+	"bottomleft":  {0, 2},
+	"bottomright": {2, 2},
+}
+
+// compassAnchors is the names of fillAnchors by the compass.
+var compassAnchors = map[string]string{
+	"north":     "top",
+	"south":     "bottom",
+	"west":      "left",
+	"east":      "right",
+	"northwest": "topleft",
+	"northeast": "topright",
+	"southwest": "bottomleft",
+	"southeast": "bottomright",
+}
+
+// lookupAnchor returns the anchor of name in fillAnchors or compassAnchors,
+// ignoring the case and '-' such as bottom-right.  The empty name is
+// center.
+func lookupAnchor(name string) ([2]int, bool) {
+	name = strings.ToLower(strings.Replace(name, "-", "", -1))
+	if name == "" {
+		name = "center"
+	}
+	if alias, ok := compassAnchors[name]; ok {
+		name = alias
+	}
+	anchor, ok := fillAnchors[name]
+	return anchor, ok
+}
+
+// fill covers width x height by resizing preserving the aspect ratio, and
+// crops the overflow at anchor, one of fillAnchors.
+func fill(width, height int, anchor [2]int) imageProc {
+	return func(m image.Image) image.Image {
+		b := m.Bounds()
+		var tmp *image.NRGBA
+		if b.Dx()*height > b.Dy()*width {
+			tmp = imaging.Resize(m, 0, height, imaging.Lanczos)
+		} else {
+			tmp = imaging.Resize(m, width, 0, imaging.Lanczos)
+		}
+		x := (tmp.Bounds().Dx() - width) * anchor[0] / 2
+		y := (tmp.Bounds().Dy() - height) * anchor[1] / 2
+		return imaging.Crop(tmp, image.Rect(x, y, x+width, y+height))
+	}
+}
+
+func flipH() imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.FlipH(m)
+	}
+}
+
+func flipV() imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.FlipV(m)
+	}
+}
+
+func grayscale() imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.Grayscale(m)
+	}
+}
+
+func invert() imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.Invert(m)
+	}
+}
+
+// vignette darkens m toward the edges, by strength from 0 to 1 at the
+// corners in proportion to the square of the distance from the center
+// relative to the size, so the ellipse fits m.
+func vignette(strength float64) imageProc {
+	return func(m image.Image) image.Image {
+		bounds := m.Bounds()
+		m2 := imaging.Clone(m)
+		hw, hh := float64(bounds.Dx())/2, float64(bounds.Dy())/2
+		for y := 0; y < m2.Rect.Dy(); y++ {
+			dy := (float64(y) + 0.5 - hh) / hh
+			for x := 0; x < m2.Rect.Dx(); x++ {
+				dx := (float64(x) + 0.5 - hw) / hw
+				f := 1 - strength*(dx*dx+dy*dy)/2
+				i := m2.PixOffset(x, y)
+				for j := i; j < i+3; j++ {
+					m2.Pix[j] = uint8(float64(m2.Pix[j])*f + 0.5)
+				}
+			}
+		}
+		return m2
+	}
+}
+
+// sepia tones m brown by the common color matrix.
+func sepia() imageProc {
+	clamp := func(v float64) uint8 {
+		return uint8(math.Min(v+0.5, 255))
+	}
+	return func(m image.Image) image.Image {
+		return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+			r, g, b := float64(c.R), float64(c.G), float64(c.B)
+			return color.NRGBA{
+				clamp(0.393*r + 0.769*g + 0.189*b),
+				clamp(0.349*r + 0.686*g + 0.168*b),
+				clamp(0.272*r + 0.534*g + 0.131*b),
+				c.A,
+			}
+		})
+	}
+}
+
+// tint blends col by strength from 0 to 1 over the grayscale luminance of
+// m by ITU-R BT.601.  The alpha of col scales the strength.
+func tint(c color.Color, strength float64) imageProc {
+	col := color.NRGBAModel.Convert(c).(color.NRGBA)
+	s := strength * float64(col.A) / 255
+	blend := func(l float64, v uint8) uint8 {
+		return uint8(l*(1-s) + float64(v)*s + 0.5)
+	}
+	return func(m image.Image) image.Image {
+		return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+			l := 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+			return color.NRGBA{blend(l, col.R), blend(l, col.G), blend(l, col.B), c.A}
+		})
+	}
+}
+
+// padArgs is the arguments of pad.
+type padArgs struct {
+	width, height int
+	bg            color.Color
+	anchor        [2]int
+	upscale       bool
+}
+
+// parsePad reads w, h, bg (RRGGBB or RRGGBBAA, default ffffff), gravity
+// (one of fillAnchors, default center) and upscale (default false) of pad.
+func parsePad(args Values) (*padArgs, error) {
+	wh, err := args.ints("w", "h")
+	if err != nil {
+		return nil, err
+	}
+	if wh[0] <= 0 || wh[1] <= 0 {
+		return nil, fmt.Errorf("invalid pad size %dx%d", wh[0], wh[1])
+	}
+	p := &padArgs{width: wh[0], height: wh[1]}
+	hex := args.Get("bg")
+	if hex == "" {
+		hex = "ffffff"
+	}
+	if p.bg, err = parseHexColor(hex); err != nil {
+		return nil, err
+	}
+	anchor, ok := lookupAnchor(args.Get("gravity"))
+	if !ok {
+		return nil, fmt.Errorf("unknown gravity %s", args.Get("gravity"))
+	}
+	p.anchor = anchor
+	if s := args.Get("upscale"); s != "" {
+		if p.upscale, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("invalid upscale %q", s)
+		}
+	}
+	return p, nil
+}
+
+// placement returns where the image of size is placed on the canvas.
+func (p *padArgs) placement(size image.Point) image.Rectangle {
+	w, h := size.X, size.Y
+	if w > p.width || h > p.height || p.upscale {
+		// fit preserving the aspect ratio, as imaging.Fit
+		if w*p.height > h*p.width {
+			w, h = p.width, int(float64(h)*float64(p.width)/float64(w)+0.5)
+		} else {
+			w, h = int(float64(w)*float64(p.height)/float64(h)+0.5), p.height
+		}
+		if w < 1 {
+			w = 1
+		}
+		if h < 1 {
+			h = 1
+		}
+	}
+	pt := image.Pt((p.width-w)*p.anchor[0]/2, (p.height-h)*p.anchor[1]/2)
+	return image.Rectangle{pt, pt.Add(image.Pt(w, h))}
+}
+
+// pad fits the image inside width x height, enlarging it only if upscale,
+// and places it at anchor on the canvas of exactly the size filled with bg.
+func pad(p *padArgs) imageProc {
+	return func(m image.Image) image.Image {
+		rect := p.placement(m.Bounds().Size())
+		var fitted image.Image = m
+		if rect.Size() != m.Bounds().Size() {
+			fitted = imaging.Resize(m, rect.Dx(), rect.Dy(), imaging.Lanczos)
+		}
+		canvas := image.NewNRGBA(image.Rect(0, 0, p.width, p.height))
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(p.bg), image.ZP, draw.Src)
+		draw.Draw(canvas, rect, fitted, fitted.Bounds().Min, draw.Over)
+		return canvas
+	}
+}
+
+// border expands the canvas by width on each side filled with c, and draws
+// the image at the center.
+func border(width int, c color.Color) imageProc {
+	return func(m image.Image) image.Image {
+		b := m.Bounds()
+		canvas := image.NewNRGBA(image.Rect(0, 0, b.Dx()+width*2, b.Dy()+width*2))
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+		draw.Draw(canvas, image.Rect(width, width, width+b.Dx(), width+b.Dy()), m, b.Min, draw.Over)
+		return canvas
+	}
+}
+
+// round makes the corners outside the circles of radius transparent, with
+// the edges antialiased.  If circle, it crops the center square and masks it
+// by the inscribed circle.
+func round(radius float64, circle bool) imageProc {
+	return func(m image.Image) image.Image {
+		var dst *image.NRGBA
+		r := radius
+		if circle {
+			b := m.Bounds()
+			size := b.Dx()
+			if b.Dy() < size {
+				size = b.Dy()
+			}
+			dst = imaging.CropCenter(m, size, size)
+			r = float64(size) / 2
+		} else {
+			dst = imaging.Clone(m)
+		}
+		w, h := float64(dst.Bounds().Dx()), float64(dst.Bounds().Dy())
+		r = math.Min(r, math.Min(w, h)/2)
+		for y := 0; y < dst.Bounds().Dy(); y++ {
+			// the distance beyond the straight edges to the corner centers
+			dy := math.Max(math.Max(r-(float64(y)+0.5), float64(y)+0.5-(h-r)), 0)
+			for x := 0; x < dst.Bounds().Dx(); x++ {
+				dx := math.Max(math.Max(r-(float64(x)+0.5), float64(x)+0.5-(w-r)), 0)
+				if dx == 0 || dy == 0 {
+					continue
+				}
+				coverage := math.Max(0, math.Min(1, r-math.Hypot(dx, dy)+0.5))
+				i := dst.PixOffset(x, y) + 3
+				dst.Pix[i] = uint8(float64(dst.Pix[i])*coverage + 0.5)
+			}
+		}
+		return dst
+	}
+}
+
+// parseHexColor parses RRGGBB or RRGGBBAA, optionally prefixed by '#'.
+func parseHexColor(s string) (color.Color, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 && len(s) != 8 {
+		return nil, fmt.Errorf("invalid color %s", s)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color %s", s)
+	}
+	if len(s) == 6 {
+		v = v<<8 | 0xff
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+func sharpen(sigma float64) imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.Sharpen(m, sigma)
+	}
+}
+
+// rotate rotates the image by angle degrees counter-clockwise, as
+// imaging.Rotate90.  The right angles are exact, and the others sample
+// bilinearly on the canvas grown to fit, whose exposed corners are filled
+// with bg.
+func rotate(angle float64, bg color.Color) imageProc {
+	angle = math.Mod(angle, 360)
+	if angle < 0 {
+		angle += 360
+	}
+	return func(m image.Image) image.Image {
+		switch angle {
+		case 0:
+			return m
+		case 90:
+			return imaging.Rotate90(m)
+		case 180:
+			return imaging.Rotate180(m)
+		case 270:
+			return imaging.Rotate270(m)
+		}
+		return rotateBilinear(imaging.Clone(m), angle*math.Pi/180, bg)
+	}
 }
 
-// HLine draws a horizontal line
-func HLine(img draw.Image, x1, y, x2 int, col color.Color) {
-	for ; x1 <= x2; x1++ {
-		img.Set(x1, y, col)
+// rotateBilinear rotates src by rad counter-clockwise around the center,
+// mapping each pixel of the output back to src.  The pixels outside src are
+// bg, blended at the edges with the alpha premultiplied.
+func rotateBilinear(src *image.NRGBA, rad float64, bg color.Color) *image.NRGBA {
+	sin, cos := math.Sincos(rad)
+	w, h := float64(src.Bounds().Dx()), float64(src.Bounds().Dy())
+	// less the rounding errors not to add a column of bg
+	dw := int(math.Ceil(math.Abs(w*cos) + math.Abs(h*sin) - 1e-6))
+	dh := int(math.Ceil(math.Abs(w*sin) + math.Abs(h*cos) - 1e-6))
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	back := color.NRGBAModel.Convert(bg).(color.NRGBA)
+
+	at := func(x, y int) color.NRGBA {
+		if x < 0 || y < 0 || x >= src.Bounds().Dx() || y >= src.Bounds().Dy() {
+			return back
+		}
+		return src.NRGBAAt(src.Bounds().Min.X+x, src.Bounds().Min.Y+y)
+	}
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// the center of the pixel relative to the center of dst, rotated
+			// back into src
+			cx, cy := float64(x)+0.5-float64(dw)/2, float64(y)+0.5-float64(dh)/2
+			sx := cx*cos - cy*sin + w/2 - 0.5
+			sy := cx*sin + cy*cos + h/2 - 0.5
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			fx, fy := sx-float64(x0), sy-float64(y0)
+
+			var r, g, b, a float64
+			for _, p := range [4]struct {
+				x, y   int
+				weight float64
+			}{
+				{x0, y0, (1 - fx) * (1 - fy)},
+				{x0 + 1, y0, fx * (1 - fy)},
+				{x0, y0 + 1, (1 - fx) * fy},
+				{x0 + 1, y0 + 1, fx * fy},
+			} {
+				c := at(p.x, p.y)
+				wa := p.weight * float64(c.A)
+				r, g, b, a = r+wa*float64(c.R), g+wa*float64(c.G), b+wa*float64(c.B), a+wa
+			}
+			if a > 0 {
+				dst.SetNRGBA(x, y, color.NRGBA{uint8(r/a + 0.5), uint8(g/a + 0.5), uint8(b/a + 0.5), uint8(a + 0.5)})
+			}
+		}
 	}
+	return dst
 }
 
-// VLine draws a veritcal line
-func VLine(img draw.Image, x, y1, y2 int, col color.Color) {
-	for ; y1 <= y2; y1++ {
-		img.Set(x, y1, col)
+// exifOrient turns the pixels stored in the EXIF orientation o upright.
+func exifOrient(o int) imageProc {
+	return func(m image.Image) image.Image {
+		switch o {
+		case 2:
+			return imaging.FlipH(m)
+		case 3:
+			return imaging.Rotate180(m)
+		case 4:
+			return imaging.FlipV(m)
+		case 5:
+			return imaging.Transpose(m)
+		case 6:
+			return imaging.Rotate270(m)
+		case 7:
+			return imaging.Transverse(m)
+		case 8:
+			return imaging.Rotate90(m)
+		}
+		return m
 	}
 }
 
-// Rect draws a rectangle utilizing HLine() and VLine()
-func RectLine(img draw.Image, x1, y1, x2, y2 int, col color.Color) {
-	HLine(img, x1, y1, x2, col)
-	HLine(img, x1, y2, x2, col)
-	VLine(img, x1, y1, y2, col)
-	VLine(img, x2, y1, y2, col)
+func transpose() imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.Transpose(m)
+	}
 }
 
-type drawRectOptions struct {
-	X1, Y1, X2, Y2 int
-	R, G, B        uint8
+func transverse() imageProc {
+	return func(m image.Image) image.Image {
+		return imaging.Transverse(m)
+	}
 }
 
-func processImage(input io.Reader, mainProc func(image.Image) image.Image) ([]byte, error) {
-	m, format, err := image.Decode(input)
-	if err != nil {
-		return nil, err
+// resize resizes to w x h, either of which may be 0 to keep the aspect
+// ratio.  m is returned as is if it is already in the size.
+func resize(w, h int) imageProc {
+	return func(m image.Image) image.Image {
+		if size := m.Bounds().Size(); resizedSize(w, h, size) == size {
+			return m
+		}
+		return imaging.Resize(m, w, h, imaging.Lanczos)
 	}
+}
 
-	m = mainProc(m)
+// resizedSize returns the size of imaging.Resize to w x h from size.
+func resizedSize(w, h int, size image.Point) image.Point {
+	if size.X <= 0 || size.Y <= 0 {
+		return image.Point{}
+	}
+	if w == 0 {
+		w = int(math.Max(1, math.Floor(float64(h)*float64(size.X)/float64(size.Y)+0.5)))
+	}
+	if h == 0 {
+		h = int(math.Max(1, math.Floor(float64(w)*float64(size.Y)/float64(size.X)+0.5)))
+	}
+	return image.Pt(w, h)
+}
 
-	buf := new(bytes.Buffer)
-	switch format {
-	case "gif":
-		gif.Encode(buf, m, nil)
-	case "jpeg":
-		quality := 100
-		jpeg.Encode(buf, m, &jpeg.Options{Quality: quality})
-	case "png":
-		png.Encode(buf, m)
-	default:
-		return nil, fmt.Errorf("unknown format %s", format)
+// thumbnail fills w x h by resizing and cropping at anchor if both are
+// given, or at the most detailed if smart, otherwise resizes to the one
+// preserving the aspect ratio.  Unless upscale, the image smaller than
+// w x h is cropped as is.
+func thumbnail(w, h int, anchor [2]int, smart, upscale bool) imageProc {
+	return func(m image.Image) image.Image {
+		b := m.Bounds()
+		if w == 0 || h == 0 {
+			if !upscale && (w > b.Dx() || h > b.Dy()) {
+				return m
+			}
+			return imaging.Resize(m, w, h, imaging.Lanczos)
+		}
+		tmp := m
+		if upscale || (b.Dx() >= w && b.Dy() >= h) {
+			if b.Dx()*h > b.Dy()*w {
+				tmp = imaging.Resize(m, 0, h, imaging.Lanczos)
+			} else {
+				tmp = imaging.Resize(m, w, 0, imaging.Lanczos)
+			}
+		}
+		b = tmp.Bounds()
+		cw, ch := min(w, b.Dx()), min(h, b.Dy())
+		pt := image.Pt((b.Dx()-cw)*anchor[0]/2, (b.Dy()-ch)*anchor[1]/2)
+		if smart {
+			pt = smartCrop(tmp, cw, ch)
+		}
+		return imaging.Crop(tmp, image.Rect(pt.X, pt.Y, pt.X+cw, pt.Y+ch).Add(b.Min))
 	}
+}
 
-	return buf.Bytes(), nil
+// thumbnailSize returns the size of the image thumbnail resizes the image
+// of size to, before cropping, which is as is unless it is resized.
+func thumbnailSize(w, h int, upscale bool, size image.Point) image.Point {
+	if w == 0 || h == 0 {
+		if !upscale && (w > size.X || h > size.Y) {
+			return size
+		}
+		return resizedSize(w, h, size)
+	}
+	if !upscale && (size.X < w || size.Y < h) {
+		return size
+	}
+	if float64(size.X)*float64(h) > float64(size.Y)*float64(w) {
+		return resizedSize(0, h, size)
+	}
+	return resizedSize(w, 0, size)
 }
 
-func adjustBrightness(input io.Reader, percentage float64) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.AdjustBrightness(m, percentage)
-	})
+// smartCrop returns the offset of the w x h crop of m with the most edges,
+// by the sum of the gradients of the luma.
+func smartCrop(m image.Image, w, h int) image.Point {
+	gray := imaging.Grayscale(m)
+	dx, dy := gray.Bounds().Dx(), gray.Bounds().Dy()
+	cols, rows := make([]int, dx), make([]int, dy)
+	for y := 0; y < dy; y++ {
+		for x := 0; x < dx; x++ {
+			v := int(gray.Pix[y*gray.Stride+x*4])
+			e := 0
+			if x+1 < dx {
+				e += absInt(v - int(gray.Pix[y*gray.Stride+(x+1)*4]))
+			}
+			if y+1 < dy {
+				e += absInt(v - int(gray.Pix[(y+1)*gray.Stride+x*4]))
+			}
+			cols[x] += e
+			rows[y] += e
+		}
+	}
+	return image.Pt(bestWindow(cols, w), bestWindow(rows, h))
 }
 
-func adjustContrast(input io.Reader, percentage float64) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.AdjustContrast(m, percentage)
-	})
+// bestWindow returns the start of the n energies in a row of the largest
+// sum, the closest to the center of the ties.
+func bestWindow(energy []int, n int) int {
+	center := (len(energy) - n) / 2
+	best, bestSum := center, -1
+	sum := 0
+	for _, e := range energy[:n] {
+		sum += e
+	}
+	for start := 0; ; start++ {
+		if sum > bestSum || (sum == bestSum && absInt(start-center) < absInt(best-center)) {
+			best, bestSum = start, sum
+		}
+		if start+n >= len(energy) {
+			return best
+		}
+		sum += energy[start+n] - energy[start]
+	}
 }
 
-func adjustGamma(input io.Reader, gamma float64) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.AdjustGamma(m, gamma)
-	})
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
 }
 
-func adjustSigmoid(input io.Reader, midpoint, factor float64) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.AdjustSigmoid(m, midpoint, factor)
-	})
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
-func blur(input io.Reader, sigma float64) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Blur(m, sigma)
-	})
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
 }
 
-func crop(input io.Reader, x1, y1, x2, y2 int) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Crop(m, image.Rect(x1, y1, x2, y2))
-	})
+// imageFormat returns the format name to encode for the user given one,
+// which may be empty to keep the input format.
+func imageFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "":
+		return "", nil
+	case "jpeg", "jpg":
+		return "jpeg", nil
+	case "png":
+		return "png", nil
+	case "gif":
+		return "gif", nil
+	case "webp":
+		return "webp", nil
+	case "bmp":
+		return "bmp", nil
+	case "tiff", "tif":
+		return "tiff", nil
+	}
+	return "", &StatusError{http.StatusBadRequest, fmt.Sprintf("unknown format %s", format)}
 }
 
-func drawRect(input io.Reader, opts []*drawRectOptions) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		r := m.Bounds()
-		m2 := image.NewRGBA(r)
-		draw.Draw(m2, r, m, image.ZP, draw.Src)
-		for _, opt := range opts {
-			col := color.RGBA{opt.R, opt.G, opt.B, 255}
-			RectLine(m2, opt.X1, opt.Y1, opt.X2, opt.Y2, col)
+// outputFormat returns the format to encode the input of format in, if no
+// format is given: the same one if the browsers show it, otherwise JPEG for
+// the photos of HEIF, or PNG such as for TIFF.
+func outputFormat(input string) string {
+	switch input {
+	case "jpeg", "png", "gif", "webp", "bmp":
+		return input
+	case "heic":
+		return "jpeg"
+	}
+	return "png"
+}
+
+// tiffPage returns data of TIFF with the page-th IFD moved first, which the
+// decoder reads.  It fails with 400 if data is not TIFF or has no such page.
+func tiffPage(data []byte, page int) ([]byte, error) {
+	t := &tiff{data: data}
+	switch {
+	case bytes.HasPrefix(data, []byte("II*\x00")):
+		t.order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte("MM\x00*")):
+		t.order = binary.BigEndian
+	}
+	if t.order == nil || len(data) < 8 {
+		return nil, &StatusError{http.StatusBadRequest, "page is only for TIFF"}
+	}
+	offset := t.order.Uint32(data[4:])
+	for i := 0; i < page; i++ {
+		next, err := t.next(offset)
+		if err != nil {
+			return nil, err
 		}
-		return m2
-	})
+		if next == 0 {
+			return nil, &StatusError{http.StatusBadRequest, fmt.Sprintf("no page %d of %d pages", page, i+1)}
+		}
+		offset = next
+	}
+	out := append([]byte(nil), data...)
+	t.order.PutUint32(out[4:], offset)
+	return out, nil
 }
 
-func fit(input io.Reader, width, height int) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Fit(m, width, height, imaging.Lanczos)
-	})
+type ExpandArgs struct {
+	Video string `json:"video"`
+	// IntervalSec is the seconds between the frames, 1 by default.
+	IntervalSec *float64 `json:"interval_sec"`
+	// StartSec and EndSec limit the frames, to the end of the video by
+	// default.
+	StartSec float64  `json:"start_sec"`
+	EndSec   *float64 `json:"end_sec"`
 }
 
-func flipH(input io.Reader) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.FlipH(m)
-	})
+// expandRange returns the start, the end if any and the interval of args in
+// milliseconds, the precision of frame.
+func (args *ExpandArgs) expandRange() (start, end, interval int, err error) {
+	interval = 1000
+	if args.IntervalSec != nil {
+		if interval = secToMillis(*args.IntervalSec); interval <= 0 {
+			return 0, 0, 0, fmt.Errorf("invalid interval_sec %v, must be 0.001 or more", *args.IntervalSec)
+		}
+	}
+	if args.StartSec < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid start_sec %v", args.StartSec)
+	}
+	start, end = secToMillis(args.StartSec), -1
+	if args.EndSec != nil {
+		if end = secToMillis(*args.EndSec); end < start {
+			return 0, 0, 0, fmt.Errorf("end_sec %v is before start_sec %v", *args.EndSec, args.StartSec)
+		}
+	}
+	return start, end, interval, nil
 }
 
-func flipV(input io.Reader) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.FlipV(m)
-	})
+func secToMillis(sec float64) int {
+	return int(math.Floor(sec*1000 + 0.5))
 }
 
-func grayscale(input io.Reader) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Grayscale(m)
-	})
+// parseFrameSec reads sec of frame, in seconds up to milliseconds, 0 by
+// default.
+func parseFrameSec(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(sec >= 0 && sec < math.MaxInt32) {
+		return 0, fmt.Errorf("invalid sec %q", s)
+	}
+	return time.Duration(secToMillis(sec)) * time.Millisecond, nil
 }
 
-func invert(input io.Reader) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Invert(m)
-	})
+// frameSecs returns sec of frame from start to end by interval, all in
+// milliseconds.  They are padded to the digits of end so the keys sort in
+// the order, and have 3 decimals like 0012.500 unless all are whole
+// seconds.
+func frameSecs(start, end, interval int) []string {
+	digits := strconv.Itoa(len(strconv.Itoa(end / 1000)))
+	fractional := start%1000 != 0 || interval%1000 != 0
+	var secs []string
+	for ms := start; ms <= end; ms += interval {
+		if fractional {
+			secs = append(secs, fmt.Sprintf("%0"+digits+"d.%03d", ms/1000, ms%1000))
+		} else {
+			secs = append(secs, fmt.Sprintf("%0"+digits+"d", ms/1000))
+		}
+	}
+	return secs
 }
 
-func sharpen(input io.Reader, sigma float64) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Sharpen(m, sigma)
-	})
+// frameArgs is the arguments of frame, which takes the frame either at the
+// time or by the index.
+type frameArgs struct {
+	at time.Duration
+	// n is the index of the frame from 0 in the presentation order, if
+	// byIndex
+	n       int
+	byIndex bool
+	// size is the frame scaled by the decoder, whose zero side follows the
+	// aspect ratio of the video.  Zero is the size of the video.
+	size image.Point
+	// frames of size are taken up to maxPixels in total, checked once the
+	// size of the video is known.  Zero means no limit.
+	frames    int
+	maxPixels int64
 }
 
-func transpose(input io.Reader) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Transpose(m)
-	})
+// parseFrameArgs reads the time by sec or ms as parseFrameAt, or the index
+// by n, and the size by w and h of frame, failing with 413 if it is of
+// more pixels than maxPixels.
+func parseFrameArgs(args Values, maxPixels int64) (*frameArgs, error) {
+	p := &frameArgs{frames: 1, maxPixels: maxPixels}
+	if n := args.Get("n"); n == "" {
+		at, err := parseFrameAt(args)
+		if err != nil {
+			return nil, err
+		}
+		p.at = at
+	} else {
+		if args.Get("sec") != "" || args.Get("ms") != "" {
+			return nil, fmt.Errorf("n is exclusive with sec and ms")
+		}
+		i, err := strconv.Atoi(n)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid n %q", n)
+		}
+		p.n, p.byIndex = i, true
+	}
+	wh, err := args.ints("w", "h")
+	if err != nil {
+		return nil, err
+	}
+	if wh[0] < 0 || wh[1] < 0 {
+		return nil, fmt.Errorf("invalid size %dx%d", wh[0], wh[1])
+	}
+	p.size = image.Pt(wh[0], wh[1])
+	if p.size != (image.Point{}) {
+		// the side given alone is at least a pixel on the other
+		if err := checkFramePixels(image.Pt(maxInt(wh[0], 1), maxInt(wh[1], 1)), p.frames, maxPixels); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
 }
 
-func transverse(input io.Reader) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Transverse(m)
-	})
+// checkFramePixels fails with 413 if the frames of size are of more pixels
+// than maxPixels in total.  Zero means no limit.
+func checkFramePixels(size image.Point, frames int, maxPixels int64) error {
+	if maxPixels > 0 && float64(size.X)*float64(size.Y)*float64(frames) > float64(maxPixels) {
+		return &StatusError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("%d frames of %dx%d exceed %d pixels", frames, size.X, size.Y, maxPixels)}
+	}
+	return nil
 }
 
-func resize(input io.Reader, w, h int) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Resize(m, w, h, imaging.Lanczos)
-	})
+// frameSize returns size with the zero side by the aspect ratio of src, or
+// src if both are zero.
+func frameSize(src, size image.Point) image.Point {
+	switch {
+	case src.X <= 0 || src.Y <= 0 || size == image.Point{}:
+		return src
+	case size.X == 0:
+		size.X = (src.X*size.Y + src.Y/2) / src.Y
+	case size.Y == 0:
+		size.Y = (src.Y*size.X + src.X/2) / src.X
+	}
+	if size.X < 1 {
+		size.X = 1
+	}
+	if size.Y < 1 {
+		size.Y = 1
+	}
+	return size
 }
 
-type ExpandArgs struct {
-	Video string `json:"video"`
+// match tells whether the i-th frame decoded, presented at ts, is the one.
+func (p *frameArgs) match(i int, ts time.Duration) bool {
+	if p.byIndex {
+		return i == p.n
+	}
+	return ts >= p.at
+}
+
+// seekTime returns the time to seek the video of the average frame rate
+// to before decoding, which is at, or the time of the n-th frame by the
+// rate if byIndex.  It is 0 to decode from the start, by the index if the
+// rate is unknown, which counts the frames exactly.
+func (p *frameArgs) seekTime(rate float64) time.Duration {
+	if !p.byIndex {
+		return p.at
+	}
+	if rate <= 0 {
+		return 0
+	}
+	sec := math.Min(float64(p.n)/rate, math.MaxInt32)
+	return time.Duration(sec * float64(time.Second))
+}
+
+// frameIndex returns the index of the first frame decoded, at ts after
+// the seek to at: 0 from the start, or estimated by the average frame rate
+// if seeked, which is off as much as the rate varies up to ts.
+func frameIndex(ts, at time.Duration, rate float64) int {
+	if at <= 0 || rate <= 0 || ts <= 0 {
+		return 0
+	}
+	return int(math.Floor(ts.Seconds()*rate + 0.5))
+}
+
+// parseFrameAt reads the time of frame by either sec or ms, in whole
+// milliseconds, 0 by default.
+func parseFrameAt(args Values) (time.Duration, error) {
+	ms := args.Get("ms")
+	if ms == "" {
+		return parseFrameSec(args.Get("sec"))
+	}
+	if args.Get("sec") != "" {
+		return 0, fmt.Errorf("sec and ms are exclusive")
+	}
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || n < 0 || n >= math.MaxInt32*1000 {
+		return 0, fmt.Errorf("invalid ms %q", ms)
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// ptsDuration converts pts in the time base of num/den seconds to the
+// duration.
+func ptsDuration(pts, num, den int) time.Duration {
+	if den == 0 {
+		return 0
+	}
+	n := int64(pts) * int64(num)
+	return time.Duration(n/int64(den))*time.Second + time.Duration(n%int64(den))*time.Second/time.Duration(den)
+}
+
+// durationPts converts d to the pts in the time base of num/den seconds,
+// rounded down.
+func durationPts(d time.Duration, num, den int) int {
+	if num == 0 {
+		return 0
+	}
+	// whole seconds and the rest apart, not to overflow
+	sec, rest := int64(d/time.Second), int64(d%time.Second)
+	whole := sec * int64(den)
+	frac := (whole%int64(num))*int64(time.Second) + rest*int64(den)
+	return int(whole/int64(num) + frac/(int64(num)*int64(time.Second)))
 }
 
 func (s *Server) Expand(w http.ResponseWriter, r *http.Request) {
 	dir := r.URL.Path
 	dir = dir[0 : len(dir)-len("_expand")]
 	if !strings.HasSuffix(dir, "/") {
-		http.Error(w, "expand should finish with '/'", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "expand should finish with '/'")
 		return
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	args := ExpandArgs{}
 	if err := decoder.Decode(&args); err != nil {
-		http.Error(w, "unrecognized args", http.StatusBadRequest)
+		bodyError(w, err, "unrecognized args")
 		return
 	}
 	if args.Video == "" {
-		http.Error(w, "\"video\" field is mandatory", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "\"video\" field is mandatory")
+		return
+	}
+	start, end, interval, err := args.expandRange()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -222,37 +1772,94 @@ func (s *Server) Expand(w http.ResponseWriter, r *http.Request) {
 	vUrl := extractTargetURL(videopath)
 	if vUrl == "" {
 		msg := fmt.Sprintf("target not found in path %s", videopath)
-		http.Error(w, msg, http.StatusNotFound)
+		writeError(w, http.StatusNotFound, msg)
 		return
 	}
 
-	resp, err := s.Client.Get(vUrl)
+	// the job outlives the request, keeping the forwarded headers etc.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	req, err := newTargetRequest(ctx, vUrl)
 	if err != nil {
-		glog.Error(err)
-		http.Error(w, "Error", http.StatusInternalServerError)
+		cancel()
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job, err := s.jobs.submit(ctx, cancel, videopath, func(ctx context.Context, progress func(processed, duration time.Duration)) error {
+		resp, err := s.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("remote URL %q returned status: %v", vUrl, resp.Status)
+		}
+		return expand(ctx, s, resp.Body, dir, videopath, start, end, interval, progress)
+	})
+	if err != nil {
+		cancel()
+		code, ok := errorStatus(err)
+		if !ok {
+			code = http.StatusInternalServerError
+		}
+		writeError(w, code, err.Error())
 		return
 	}
-	defer resp.Body.Close()
 
-	if err := expand(s, resp.Body, dir, videopath); err != nil {
+	w.Header().Set("Location", "/_jobs/"+job.Id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
 		glog.Error(err)
-		http.Error(w, "Error", http.StatusInternalServerError)
-		return
 	}
 }
 
-func makeInputHandlers(input io.Reader) *gmf.AVIOHandlers {
-	reader, ok := input.(io.ReadSeeker)
-	if !ok {
-		// TODO: spill to disk if necessary
-		glog.Info("Reader not seekable")
-		buf := new(bytes.Buffer)
-		io.Copy(buf, input)
-		reader = bytes.NewReader(buf.Bytes())
+// spillBytes is the size of non-seekable input held in memory, beyond
+// which it is spilled to a temporary file.  It is replaced in test.
+var spillBytes int64 = 32 << 20
+
+// seekableInput makes input seekable, in memory up to spillBytes or in a
+// temporary file beyond.  The returned func removes the file.
+func seekableInput(input io.Reader) (io.ReadSeeker, func(), error) {
+	if reader, ok := input.(io.ReadSeeker); ok {
+		return reader, func() {}, nil
 	}
 
+	glog.Info("Reader not seekable")
+	buf := new(bytes.Buffer)
+	if _, err := io.CopyN(buf, input, spillBytes+1); err == io.EOF {
+		return bytes.NewReader(buf.Bytes()), func() {}, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := ioutil.TempFile("", "istore-input")
+	if err != nil {
+		return nil, nil, err
+	}
+	remove := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	glog.Info("spilling input to ", f.Name())
+	if _, err := io.Copy(f, io.MultiReader(buf, input)); err != nil {
+		remove()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		remove()
+		return nil, nil, err
+	}
+	return f, remove, nil
+}
+
+// makeInputHandlers reads input for gmf.  It stops reading once ctx is done,
+// so the decoder sees the end of stream.
+func makeInputHandlers(ctx context.Context, reader io.ReadSeeker) *gmf.AVIOHandlers {
 	return &gmf.AVIOHandlers{
 		ReadPacket: func() ([]byte, int) {
+			if ctx.Err() != nil {
+				return nil, 0
+			}
 			b := make([]byte, 512)
 			n, err := reader.Read(b)
 			if err != nil {
@@ -273,26 +1880,42 @@ func makeInputHandlers(input io.Reader) *gmf.AVIOHandlers {
 	}
 }
 
-func expand(s *Server, input io.Reader, dir, objkey string) error {
-	handlers := makeInputHandlers(input)
-
-	ctx := gmf.NewCtx()
-	ioctx, err := gmf.NewAVIOContext(ctx, handlers)
-	ctx.SetPb(ioctx)
-	defer ctx.CloseInputAndRelease()
-	defer gmf.Release(ioctx)
-
-	if err = ctx.OpenInput("dummy"); err != nil {
-		glog.Error(err)
+// expand registers the frames of the video from start to end by interval
+// in milliseconds, up to the end of the video if end is negative.  The keys
+// are written by _ExpandBatchSize, each time telling progress the time done
+// out of the duration.
+func expand(ctx context.Context, s *Server, input io.Reader, dir, objkey string, start, end, interval int,
+	progress func(processed, duration time.Duration)) error {
+	inctx, format, closeVideo, err := openVideo(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer closeVideo()
+	info, err := probeVideo(inctx)
+	if err != nil {
 		return err
 	}
+	info.Format = format
 
 	batch := new(leveldb.Batch)
-	duration := float64(ctx.Duration())
-	// format with padding so path key order agrees with our intension.
-	npads := int(math.Log10(duration/1000000)) + 1
-	snpads := strconv.Itoa(npads)
-	for i := 0; i < int(duration/1000000)+1; i++ {
+	info.Video = objkey
+	value, _ := json.Marshal(info)
+	if _, _, err := s.PutObject([]byte(dir+_VideoInfoKey), string(value), batch, true); err != nil {
+		return err
+	}
+	// in microseconds
+	duration := int(inctx.Duration()) / 1000
+	if end < 0 || end > duration {
+		end = duration
+	}
+	total := time.Duration(duration) * time.Millisecond
+	progress(0, total)
+	secs := frameSecs(start, end, interval)
+	var done time.Duration
+	for i, sec := range secs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		// TODO: create relpath.  filepath.Rel() removes duplicate slashes, bad for us.
 		//selfpath, err := filepath.Rel(dir, objkey)
 		//if err != nil {
@@ -303,68 +1926,154 @@ func expand(s *Server, input io.Reader, dir, objkey string) error {
 		// Escape only the path part to distinguish it from query string.
 		selfpath := selfURL(objkey)
 		// query string can be raw.
-		selfpath += fmt.Sprintf("?apply=frame&sec=%0"+snpads+"d", i)
+		selfpath += "?apply=frame&sec=" + sec
 
 		key := dir + selfpath
 		meta := map[string]interface{}{}
-		d := time.Duration(i) * time.Second
+		d, _ := parseFrameSec(sec)
 		meta["timestamp"] = fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+		if ms := int(d/time.Millisecond) % 1000; ms != 0 {
+			meta["timestamp"] = fmt.Sprintf("%s.%03d", meta["timestamp"], ms)
+		}
 		meta["video"] = objkey
+		meta["width"], meta["height"] = info.Width, info.Height
 		value, _ := json.Marshal(&meta)
 		_, _, err := s.PutObject([]byte(key), string(value), batch, true)
 		if err != nil {
 			return err
 		}
+		done = d
+		if (i+1)%_ExpandBatchSize == 0 {
+			if err := s.Db.Write(batch, nil); err != nil {
+				glog.Error(err)
+				return err
+			}
+			batch.Reset()
+			progress(done, total)
+		}
 	}
-
-	if err := s.Db.Write(batch, nil); err != nil {
-		glog.Error(err)
-		return err
+	// the rest, or _video alone if no frame is in the range
+	if batch.Len() > 0 {
+		if err := s.Db.Write(batch, nil); err != nil {
+			glog.Error(err)
+			return err
+		}
+		progress(done, total)
 	}
 
 	return nil
 }
 
-func frame(input io.Reader, sec int) ([]byte, error) {
-	handlers := makeInputHandlers(input)
+// rgb24ToRGBA converts the w x h RGB24 pixels of src, each row of which
+// starts at the multiple of linesize, to the opaque RGBA.
+func rgb24ToRGBA(src []byte, linesize, w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		// the rows sliced for the bounds checks once per row
+		in := src[y*linesize : y*linesize+w*3]
+		out := img.Pix[y*img.Stride : y*img.Stride+w*4]
+		for i, j := 0, 0; i < len(in); i, j = i+3, j+4 {
+			out[j], out[j+1], out[j+2], out[j+3] = in[i], in[i+1], in[i+2], 0xff
+		}
+	}
+	return img
+}
 
-	ctx := gmf.NewCtx()
-	defer ctx.CloseInputAndRelease()
-	ioctx, err := gmf.NewAVIOContext(ctx, handlers)
+// frame extracts the frame of p as JPEG, and returns the time of it.  It
+// fails with 416 if the video ends before the n-th frame.  It aborts with
+// ctx.Err() once ctx is done.
+func frame(ctx context.Context, input io.Reader, p frameArgs) ([]byte, time.Duration, error) {
+	var data []byte
+	var pts time.Duration
+	// the number of the frames up to the last decoded
+	frames := 0
+	err := decodeFrames(ctx, input, p, func(i int, ts time.Duration, img func() *image.RGBA) bool {
+		if glog.V(5) {
+			glog.Info(fmt.Sprintf("desired = %v, actual = %v", p.at, ts))
+		}
+		frames = i + 1
+		if !p.match(i, ts) {
+			return true
+		}
+		// Encode RGBA to JPEG.
+		buf := new(bytes.Buffer)
+		jpeg.Encode(buf, img(), &jpeg.Options{Quality: 100})
+		data, pts = buf.Bytes(), ts
+		return false
+	})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	ctx.SetPb(ioctx)
-	defer gmf.Release(ioctx)
+	// Did we not find frame?
+	if data == nil {
+		if p.byIndex {
+			return nil, 0, &StatusError{http.StatusRequestedRangeNotSatisfiable,
+				fmt.Sprintf("frame %d is out of range of %d frames", p.n, frames)}
+		}
+		return nil, 0, fmt.Errorf("unexpected end of stream")
+	}
+	return data, pts, nil
+}
 
-	if err = ctx.OpenInput("dummy"); err != nil {
-		glog.Error(err)
-		return nil, err
+// decodeFrames decodes the video of input from the keyframe at or before
+// the time of p by seekTime, or from the start if it is 0, and passes each
+// frame to each, with its index from the start, the timestamp converted
+// through the time base of the stream and the func converting it to RGBA
+// scaled to p.size, until it returns false.  The index after the seek is
+// estimated by the average frame rate.  It aborts with ctx.Err() once ctx
+// is done.
+func decodeFrames(ctx context.Context, input io.Reader, p frameArgs,
+	each func(i int, ts time.Duration, img func() *image.RGBA) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	inctx, _, closeVideo, err := openVideo(ctx, input)
+	if err != nil {
+		return err
 	}
+	defer closeVideo()
 
-	srcVideoStream, err := ctx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
+	srcVideoStream, err := inctx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
 	if err != nil {
 		glog.Error(err)
-		return nil, err
+		return err
 	}
 
-	if err = ctx.SeekFrameAt(sec, srcVideoStream.Index()); err != nil {
-		glog.Error(err)
-		return nil, err
+	// to the keyframe at or before at, decoding up to at
+	tb := srcVideoStream.TimeBase().AVR()
+	rate := averageFrameRate(srcVideoStream)
+	at := p.seekTime(rate)
+	if at > 0 {
+		ts := durationPts(at, tb.Num, tb.Den)
+		if err = inctx.SeekFile(srcVideoStream, ts, ts, 0); err == nil {
+			srcVideoStream.CodecCtx().FlushBuffers()
+		} else if p.byIndex {
+			// counted from the start instead
+			glog.V(1).Info("seek by the frame rate failed: ", err)
+			at = 0
+		} else {
+			glog.Error(err)
+			return err
+		}
 	}
 
 	codec, err := gmf.FindEncoder(gmf.AV_CODEC_ID_JPEG2000)
 	if err != nil {
 		glog.Error(err)
-		return nil, err
+		return err
 	}
 
 	cc := gmf.NewCodecCtx(codec)
 	defer gmf.Release(cc)
 
+	src := image.Pt(srcVideoStream.CodecCtx().Width(), srcVideoStream.CodecCtx().Height())
+	dst := frameSize(src, p.size)
+	if err := checkFramePixels(dst, p.frames, p.maxPixels); err != nil {
+		return err
+	}
 	cc.SetPixFmt(gmf.AV_PIX_FMT_RGB24).
-		SetWidth(srcVideoStream.CodecCtx().Width()).
-		SetHeight(srcVideoStream.CodecCtx().Height())
+		SetWidth(dst.X).
+		SetHeight(dst.Y)
 
 	if codec.IsExperimental() {
 		cc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
@@ -372,7 +2081,7 @@ func frame(input io.Reader, sec int) ([]byte, error) {
 
 	if err = cc.Open(nil); err != nil {
 		glog.Error(err)
-		return nil, err
+		return err
 	}
 	defer cc.Close()
 
@@ -382,96 +2091,87 @@ func frame(input io.Reader, sec int) ([]byte, error) {
 	// This is necessary to avoid leaking thread used by codec.
 	defer srcVideoStream.CodecCtx().Close()
 
-	swsCtx := gmf.NewSwsCtx(srcVideoStream.CodecCtx(), cc, gmf.SWS_POINT)
+	// the points are exact at the same size, the area averages the pixels
+	// shrunk, and bicubic interpolates the others
+	method := gmf.SWS_POINT
+	if dst.X < src.X && dst.Y < src.Y {
+		method = gmf.SWS_AREA
+	} else if dst != src {
+		method = gmf.SWS_BICUBIC
+	}
+	swsCtx := gmf.NewSwsCtx(srcVideoStream.CodecCtx(), cc, method)
 	defer gmf.Release(swsCtx)
 
 	dstFrame := gmf.NewFrame().
-		SetWidth(srcVideoStream.CodecCtx().Width()).
-		SetHeight(srcVideoStream.CodecCtx().Height()).
+		SetWidth(dst.X).
+		SetHeight(dst.Y).
 		SetFormat(gmf.AV_PIX_FMT_RGB24)
 	defer gmf.Release(dstFrame)
 
 	if err := dstFrame.ImgAlloc(); err != nil {
 		glog.Error(err)
-		return nil, err
+		return err
 	}
 
+	// the index of the next frame, unknown until the first after the seek
+	next := -1
 	for {
-		packet := ctx.GetNextPacket()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		packet := inctx.GetNextPacket()
 		if packet == nil {
 			break
 		}
 
 		// Wrap by anonymous func so we can use defer for each iteration.
-		data, err := func(packet *gmf.Packet) ([]byte, error) {
+		more, err := func(packet *gmf.Packet) (bool, error) {
 			defer gmf.Release(packet)
 
 			if packet.StreamIndex() != srcVideoStream.Index() {
-				return nil, nil
+				return true, nil
 			}
-			ist, err := ctx.GetStream(packet.StreamIndex())
+			ist, err := inctx.GetStream(packet.StreamIndex())
 			if err != nil {
-				return nil, err
+				return false, err
 			}
 
-			ready := false
-			var buf *bytes.Buffer
-			for !ready {
+			for {
 				frame, err := packet.GetNextFrame(ist.CodecCtx())
 				if frame == nil || err != nil {
-					return nil, err
+					return true, err
 				}
+				ts := ptsDuration(frame.TimeStamp(), tb.Num, tb.Den)
 
-				if glog.V(5) {
-					glog.Info(fmt.Sprintf("desired = %v, actual = %v", sec, frame.TimeStamp()))
-				}
-				swsCtx.Scale(frame, dstFrame)
-
-				ready = sec*1000 <= frame.TimeStamp()
-
-				if ready {
-					// Encode RGB24 to RGBA to JPEG.
-					// TODO: we could avoid even copy with the loop
-					// by introducing RGB type implementing image.Image
+				// converted only if taken, valid while in each
+				img := func() *image.RGBA {
+					swsCtx.Scale(frame, dstFrame)
 					streamIndex := 0 // not sure how to determine this??
-					src := dstFrame.Data(streamIndex)
-					img := image.NewRGBA(image.Rect(0, 0, dstFrame.Width(), dstFrame.Height()))
-					stride := img.Stride
-					linesize := dstFrame.LineSize(streamIndex)
-					for y := 0; y < dstFrame.Height(); y++ {
-						for x := 0; x < dstFrame.Width(); x++ {
-							img.Pix[y*stride+x*4+0] = src[y*linesize+x*3+0]
-							img.Pix[y*stride+x*4+1] = src[y*linesize+x*3+1]
-							img.Pix[y*stride+x*4+2] = src[y*linesize+x*3+2]
-							img.Pix[y*stride+x*4+3] = 0
-						}
-					}
-					buf = new(bytes.Buffer)
-					jpeg.Encode(buf, img, &jpeg.Options{Quality: 100})
+					return rgb24ToRGBA(dstFrame.Data(streamIndex), dstFrame.LineSize(streamIndex),
+						dstFrame.Width(), dstFrame.Height())
 				}
-
+				if next < 0 {
+					next = frameIndex(ts, at, rate)
+				}
+				more := each(next, ts, img)
+				next++
 				gmf.Release(frame)
-
-				if ready {
-					return buf.Bytes(), nil
+				if !more {
+					return false, nil
 				}
 			}
-
-			return nil, nil
 		}(packet)
 
 		// Error?
 		if err != nil {
-			return nil, err
+			return err
 		}
 		// Done?
-		if data != nil {
-			return data, nil
+		if !more {
+			return nil
 		}
 	}
-
-	// Did we not find frame?
-	return nil, fmt.Errorf("unexpected end of stream")
+	return ctx.Err()
 }
 
 // --- snippet
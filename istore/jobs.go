@@ -0,0 +1,250 @@
+package istore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	_DefaultExpandWorkers = 2
+	_DefaultJobRetention  = time.Hour
+	// _JobQueue is the jobs waiting for the workers, beyond which _expand
+	// fails with 503.
+	_JobQueue = 64
+	// _ExpandBatchSize is the keys written at once by _expand, so that the
+	// progress shows in the listings.
+	_ExpandBatchSize = 100
+)
+
+// the states of Job
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is the status of _expand running in the background.
+type Job struct {
+	Id    string `json:"id"`
+	State string `json:"state"`
+	Video string `json:"video"`
+	// ProcessedSec is the seconds of the video registered so far, out of
+	// DurationSec known once the video is open.
+	ProcessedSec float64    `json:"processed_sec"`
+	DurationSec  float64    `json:"duration_sec"`
+	Error        string     `json:"error,omitempty"`
+	Created      time.Time  `json:"created"`
+	Finished     *time.Time `json:"finished,omitempty"`
+}
+
+type job struct {
+	// Job is guarded by jobRunner.mu.
+	Job
+	ctx    context.Context
+	cancel context.CancelFunc
+	run    func(ctx context.Context, progress func(processed, duration time.Duration)) error
+}
+
+// jobRunner runs the jobs by the workers, and keeps them for retention
+// after they finish.
+type jobRunner struct {
+	retention time.Duration
+	queue     chan *job
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	jobs      map[string]*job
+	// stopped closes the queue to the new jobs.
+	stopped bool
+}
+
+func newJobRunner(workers int, retention time.Duration) *jobRunner {
+	r := &jobRunner{
+		retention: retention,
+		queue:     make(chan *job, _JobQueue),
+		jobs:      map[string]*job{},
+	}
+	for i := 0; i < workers; i++ {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			for j := range r.queue {
+				r.runJob(j)
+			}
+		}()
+	}
+	return r
+}
+
+// submit queues run of video, canceled by cancel of ctx.  It fails with 503
+// if the queue is full.
+func (r *jobRunner) submit(ctx context.Context, cancel context.CancelFunc, video string,
+	run func(ctx context.Context, progress func(processed, duration time.Duration)) error) (Job, error) {
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Job{}, err
+	}
+	j := &job{
+		Job:    Job{Id: hex.EncodeToString(id), State: JobQueued, Video: video, Created: time.Now()},
+		ctx:    ctx,
+		cancel: cancel,
+		run:    run,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return Job{}, &StatusError{http.StatusServiceUnavailable, "shutting down"}
+	}
+	r.prune()
+	select {
+	case r.queue <- j:
+	default:
+		return Job{}, &StatusError{http.StatusServiceUnavailable, "too many jobs queued"}
+	}
+	r.jobs[j.Id] = j
+	return j.Job, nil
+}
+
+func (r *jobRunner) runJob(j *job) {
+	r.mu.Lock()
+	j.State = JobRunning
+	r.mu.Unlock()
+
+	err := j.ctx.Err()
+	if err == nil {
+		err = j.run(j.ctx, func(processed, duration time.Duration) {
+			r.mu.Lock()
+			j.ProcessedSec, j.DurationSec = processed.Seconds(), duration.Seconds()
+			r.mu.Unlock()
+		})
+	}
+	j.cancel()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	j.Finished = &now
+	if err != nil {
+		glog.Error("job ", j.Id, " of ", j.Video, " failed: ", err)
+		j.State, j.Error = JobFailed, err.Error()
+	} else {
+		j.State = JobDone
+	}
+}
+
+// prune removes the jobs finished before the retention, under mu.
+func (r *jobRunner) prune() {
+	for id, j := range r.jobs {
+		if j.Finished != nil && time.Since(*j.Finished) > r.retention {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// get returns the job of id.
+func (r *jobRunner) get(id string) (Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune()
+	j, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.Job, true
+}
+
+// list returns the jobs, the latest first.
+func (r *jobRunner) list() []Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune()
+	jobs := []Job{}
+	for _, j := range r.jobs {
+		jobs = append(jobs, j.Job)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Created.After(jobs[k].Created) })
+	return jobs
+}
+
+// cancel cancels the job of id, which fails once the worker sees it.
+func (r *jobRunner) cancel(id string) (Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	j.cancel()
+	return j.Job, true
+}
+
+// stop cancels all the jobs, and waits for the workers to finish up to ctx.
+// The jobs submitted after fail with 503.
+func (r *jobRunner) stop(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.stopped {
+		r.stopped = true
+		for _, j := range r.jobs {
+			j.cancel()
+		}
+		close(r.queue)
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ServeJob responds the job of id, or all the jobs kept if id is empty.
+func (s *Server) ServeJob(w http.ResponseWriter, r *http.Request, id string) {
+	var v interface{}
+	if id == "" {
+		v = s.jobs.list()
+	} else {
+		job, ok := s.jobs.get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such job "+id)
+			return
+		}
+		v = job
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Error(err)
+	}
+}
+
+// CancelJob cancels the job of the path /_jobs/<id>/cancel, and responds
+// its status.  The job turns failed once its worker stops.
+func (s *Server) CancelJob(w http.ResponseWriter, r *http.Request, path string) {
+	id := strings.TrimSuffix(strings.TrimPrefix(path, "/_jobs/"), "/cancel")
+	job, ok := s.jobs.cancel(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such job "+id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		glog.Error(err)
+	}
+}
@@ -0,0 +1,438 @@
+package istore
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+// The JPEG input to be resized down is decoded here at 1/2, 1/4 or 1/8 by
+// the IDCT of only the low frequencies of each block, so that the full
+// bitmap is never made for a small output.  Only the baseline Huffman
+// coded JPEG of gray or YCbCr is taken in a single scan, and the rest is
+// left to image/jpeg.
+
+var errJPEGUnsupported = errors.New("not a baseline JPEG to decode scaled")
+
+// jpegHuffmanLookupBits is the length of the codes looked up at once.
+const jpegHuffmanLookupBits = 9
+
+// jpegHuffmanDecoder decodes the symbols by the codes of a table.
+type jpegHuffmanDecoder struct {
+	// lookup is the symbol and the length in the high byte of the codes
+	// up to jpegHuffmanLookupBits by their bits, or 0 if longer.
+	lookup [1 << jpegHuffmanLookupBits]uint16
+	// maxCode and valPtr are by the length as in F.2.2.3 of ITU-T T.81.
+	maxCode [17]int32
+	valPtr  [17]int32
+	minCode [17]int32
+	symbols []byte
+}
+
+// newJPEGHuffmanDecoder builds the decoder of the table in DHT of counts
+// of each length from 1 to 16 and symbols.
+func newJPEGHuffmanDecoder(counts []byte, symbols []byte) (*jpegHuffmanDecoder, error) {
+	d := &jpegHuffmanDecoder{symbols: symbols}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		d.valPtr[l] = k
+		d.minCode[l] = code
+		d.maxCode[l] = -1
+		if code+n > 1<<uint(l) {
+			return nil, errors.New("bad Huffman table")
+		}
+		if n > 0 {
+			d.maxCode[l] = code + n - 1
+		}
+		for i := int32(0); i < n; i++ {
+			if l <= jpegHuffmanLookupBits {
+				shift := uint(jpegHuffmanLookupBits - l)
+				for j := int32(0); j < 1<<shift; j++ {
+					d.lookup[(code+i)<<shift|j] = uint16(l)<<8 | uint16(symbols[k+i])
+				}
+			}
+		}
+		code = (code + n) << 1
+		k += n
+	}
+	return d, nil
+}
+
+// jpegBitReader reads the bits of an entropy coded segment, taking the
+// stuffed 0 after 0xff out, and 0s once a marker is reached.
+type jpegBitReader struct {
+	data   []byte
+	pos    int
+	bits   uint64
+	nbits  uint
+	marker bool
+}
+
+func (b *jpegBitReader) fill() {
+	for b.nbits <= 56 {
+		var c byte
+		if !b.marker && b.pos < len(b.data) {
+			c = b.data[b.pos]
+			if c == 0xff {
+				if b.pos+1 < len(b.data) && b.data[b.pos+1] == 0 {
+					b.pos += 2
+				} else {
+					b.marker = true
+					c = 0
+				}
+			} else {
+				b.pos++
+			}
+		}
+		b.bits |= uint64(c) << (56 - b.nbits)
+		b.nbits += 8
+	}
+}
+
+// receive reads n bits, at most 16.
+func (b *jpegBitReader) receive(n uint) int32 {
+	if n == 0 {
+		return 0
+	}
+	if b.nbits < n {
+		b.fill()
+	}
+	v := int32(b.bits >> (64 - n))
+	b.bits <<= n
+	b.nbits -= n
+	return v
+}
+
+// extend reads the value of size bits in the two's complement as in
+// F.2.2.1 of ITU-T T.81.
+func (b *jpegBitReader) extend(size uint) int32 {
+	v := b.receive(size)
+	if size > 0 && v < 1<<(size-1) {
+		v += -1<<size + 1
+	}
+	return v
+}
+
+func (b *jpegBitReader) decode(d *jpegHuffmanDecoder) (byte, error) {
+	if b.nbits < 16 {
+		b.fill()
+	}
+	if e := d.lookup[b.bits>>(64-jpegHuffmanLookupBits)]; e != 0 {
+		n := uint(e >> 8)
+		b.bits <<= n
+		b.nbits -= n
+		return byte(e), nil
+	}
+	for l := jpegHuffmanLookupBits + 1; l <= 16; l++ {
+		code := int32(b.bits >> uint(64-l))
+		if code <= d.maxCode[l] {
+			b.bits <<= uint(l)
+			b.nbits -= uint(l)
+			return d.symbols[d.valPtr[l]+code-d.minCode[l]], nil
+		}
+	}
+	return 0, errors.New("bad Huffman code")
+}
+
+// restart skips the bits to the RST marker of index and the marker.
+func (b *jpegBitReader) restart(index int) error {
+	for b.pos+2 < len(b.data) && b.data[b.pos] == 0xff && b.data[b.pos+1] == 0xff {
+		b.pos++
+	}
+	if b.pos+1 >= len(b.data) || b.data[b.pos] != 0xff || b.data[b.pos+1] != byte(0xd0+index%8) {
+		return errors.New("missing restart marker")
+	}
+	b.pos += 2
+	b.bits, b.nbits, b.marker = 0, 0, false
+	return nil
+}
+
+// jpegScaledComponent is a component of the JPEG input with the plane of
+// its pixels scaled.
+type jpegScaledComponent struct {
+	id     byte
+	h, v   int
+	quant  int
+	dc, ac *jpegHuffmanDecoder
+	pred   int32
+	pix    []byte
+	stride int
+}
+
+// jpegIDCTCos is C(u)/2·cos((2x+1)uπ/2n) by n of 1, 2 and 4, and u and x
+// up to n, the IDCT of n points taking the first n coefficients of 8 for
+// the block scaled to n/8.
+var jpegIDCTCos = func() (c [5][4][4]float64) {
+	for _, n := range []int{1, 2, 4} {
+		for u := 0; u < n; u++ {
+			for x := 0; x < n; x++ {
+				c[n][u][x] = math.Cos(float64(2*x+1)*float64(u)*math.Pi/float64(2*n)) / 2
+				if u == 0 {
+					c[n][u][x] /= math.Sqrt2
+				}
+			}
+		}
+	}
+	return
+}()
+
+// decodeJPEGScaled decodes the JPEG in data at 1/scale, where scale is 2, 4
+// or 8, in image.YCbCr or image.Gray of the size rounded up.  It fails
+// with errJPEGUnsupported for the JPEG other than the baseline one in a
+// single scan, such as the progressive one, and CMYK.
+func decodeJPEGScaled(data []byte, scale int) (image.Image, error) {
+	n := 8 / scale
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("missing SOI marker")
+	}
+	var quant [4][64]float64
+	var dcs, acs [4]*jpegHuffmanDecoder
+	var comps []*jpegScaledComponent
+	var width, height, interval int
+	adobeRGB := false
+	pos := 2
+	for {
+		for pos < len(data) && data[pos] == 0xff && pos+1 < len(data) && data[pos+1] == 0xff {
+			pos++
+		}
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, errors.New("missing marker")
+		}
+		marker := data[pos+1]
+		length := int(data[pos+2])<<8 | int(data[pos+3])
+		if length < 2 || pos+2+length > len(data) {
+			return nil, errors.New("short segment")
+		}
+		seg := data[pos+4 : pos+2+length]
+		pos += 2 + length
+
+		switch {
+		case marker == 0xc0 || marker == 0xc1:
+			if len(seg) < 6 || seg[0] != 8 {
+				return nil, errJPEGUnsupported
+			}
+			height = int(seg[1])<<8 | int(seg[2])
+			width = int(seg[3])<<8 | int(seg[4])
+			nc := int(seg[5])
+			if width == 0 || height == 0 || (nc != 1 && nc != 3) || len(seg) < 6+3*nc {
+				return nil, errJPEGUnsupported
+			}
+			for i := 0; i < nc; i++ {
+				c := seg[6+3*i:]
+				comp := &jpegScaledComponent{id: c[0], h: int(c[1] >> 4), v: int(c[1] & 0xf), quant: int(c[2] & 3)}
+				if comp.h < 1 || comp.h > 4 || comp.v < 1 || comp.v > 4 {
+					return nil, errors.New("bad sampling factor")
+				}
+				comps = append(comps, comp)
+			}
+		case marker >= 0xc2 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// progressive, lossless, or arithmetic coded
+			return nil, errJPEGUnsupported
+		case marker == 0xc4:
+			for len(seg) > 0 {
+				if len(seg) < 17 {
+					return nil, errors.New("short DHT")
+				}
+				class, id := seg[0]>>4, seg[0]&3
+				total := 0
+				for _, c := range seg[1:17] {
+					total += int(c)
+				}
+				if class > 1 || total > 256 || len(seg) < 17+total {
+					return nil, errors.New("bad DHT")
+				}
+				d, err := newJPEGHuffmanDecoder(seg[1:17], seg[17:17+total])
+				if err != nil {
+					return nil, err
+				}
+				if class == 0 {
+					dcs[id] = d
+				} else {
+					acs[id] = d
+				}
+				seg = seg[17+total:]
+			}
+		case marker == 0xdb:
+			for len(seg) > 0 {
+				precision, id := seg[0]>>4, seg[0]&3
+				size := 64 << precision
+				if precision > 1 || len(seg) < 1+size {
+					return nil, errors.New("bad DQT")
+				}
+				for k := 0; k < 64; k++ {
+					q := int(seg[1+k])
+					if precision == 1 {
+						q = int(seg[1+2*k])<<8 | int(seg[2+2*k])
+					}
+					quant[id][jpegZigzag[k]] = float64(q)
+				}
+				seg = seg[1+size:]
+			}
+		case marker == 0xdd:
+			if len(seg) < 2 {
+				return nil, errors.New("short DRI")
+			}
+			interval = int(seg[0])<<8 | int(seg[1])
+		case marker == 0xee:
+			if len(seg) >= 12 && string(seg[:5]) == "Adobe" && seg[11] == 0 {
+				adobeRGB = true
+			}
+		case marker == 0xda:
+			if comps == nil || len(seg) < 1 || int(seg[0]) != len(comps) || len(seg) < 4+2*len(comps) {
+				// the components in more than one scan
+				return nil, errJPEGUnsupported
+			}
+			for i, comp := range comps {
+				s := seg[1+2*i:]
+				if s[0] != comp.id {
+					return nil, errJPEGUnsupported
+				}
+				comp.dc, comp.ac = dcs[s[1]>>4&3], acs[s[1]&3]
+				if comp.dc == nil || comp.ac == nil {
+					return nil, errors.New("missing Huffman table")
+				}
+			}
+			if ss, se, a := seg[1+2*len(comps)], seg[2+2*len(comps)], seg[3+2*len(comps)]; ss != 0 || se != 63 || a != 0 {
+				return nil, errJPEGUnsupported
+			}
+			if len(comps) == 3 && (adobeRGB || string([]byte{comps[0].id, comps[1].id, comps[2].id}) == "RGB") {
+				return nil, errJPEGUnsupported
+			}
+			return decodeJPEGScan(data[pos:], comps, &quant, width, height, interval, scale, n)
+		case marker == 0xd9:
+			return nil, errors.New("missing SOS marker")
+		}
+	}
+}
+
+// decodeJPEGScan decodes the scan in data of all comps into the image at
+// 1/scale, n pixels a side of each block.
+func decodeJPEGScan(data []byte, comps []*jpegScaledComponent, quant *[4][64]float64, width, height, interval, scale, n int) (image.Image, error) {
+	hmax, vmax := 1, 1
+	for _, comp := range comps {
+		hmax, vmax = maxInt(hmax, comp.h), maxInt(vmax, comp.v)
+	}
+	var m image.Image
+	if len(comps) == 1 {
+		// the single component is not interleaved, by a block a MCU
+		comps[0].h, comps[0].v = 1, 1
+		hmax, vmax = 1, 1
+	}
+	mcusX := (width + 8*hmax - 1) / (8 * hmax)
+	mcusY := (height + 8*vmax - 1) / (8 * vmax)
+	bounds := image.Rect(0, 0, (width+scale-1)/scale, (height+scale-1)/scale)
+	if len(comps) == 1 {
+		gray := image.NewGray(image.Rect(0, 0, mcusX*n, mcusY*n))
+		comps[0].pix, comps[0].stride = gray.Pix, gray.Stride
+		m = gray.SubImage(bounds)
+	} else {
+		if comps[1].h != 1 || comps[1].v != 1 || comps[2].h != 1 || comps[2].v != 1 {
+			return nil, errJPEGUnsupported
+		}
+		var ratio image.YCbCrSubsampleRatio
+		switch comps[0].h<<4 | comps[0].v {
+		case 0x11:
+			ratio = image.YCbCrSubsampleRatio444
+		case 0x21:
+			ratio = image.YCbCrSubsampleRatio422
+		case 0x22:
+			ratio = image.YCbCrSubsampleRatio420
+		case 0x12:
+			ratio = image.YCbCrSubsampleRatio440
+		case 0x41:
+			ratio = image.YCbCrSubsampleRatio411
+		case 0x42:
+			ratio = image.YCbCrSubsampleRatio410
+		default:
+			return nil, errJPEGUnsupported
+		}
+		ycbcr := image.NewYCbCr(image.Rect(0, 0, mcusX*hmax*n, mcusY*vmax*n), ratio)
+		comps[0].pix, comps[0].stride = ycbcr.Y, ycbcr.YStride
+		comps[1].pix, comps[1].stride = ycbcr.Cb, ycbcr.CStride
+		comps[2].pix, comps[2].stride = ycbcr.Cr, ycbcr.CStride
+		m = ycbcr.SubImage(bounds)
+	}
+
+	cos := &jpegIDCTCos[n]
+	var coef [64]float64
+	var rows [4][4]float64
+	b := &jpegBitReader{data: data}
+	for mcu := 0; mcu < mcusX*mcusY; mcu++ {
+		if interval > 0 && mcu > 0 && mcu%interval == 0 {
+			if err := b.restart(mcu/interval - 1); err != nil {
+				return nil, err
+			}
+			for _, comp := range comps {
+				comp.pred = 0
+			}
+		}
+		mx, my := mcu%mcusX, mcu/mcusX
+		for _, comp := range comps {
+			q := &quant[comp.quant]
+			for by := 0; by < comp.v; by++ {
+				for bx := 0; bx < comp.h; bx++ {
+					// the coefficients up to n in both directions
+					for i := range coef {
+						coef[i] = 0
+					}
+					size, err := b.decode(comp.dc)
+					if err != nil {
+						return nil, err
+					}
+					if size > 16 {
+						return nil, errors.New("bad DC size")
+					}
+					comp.pred += b.extend(uint(size))
+					coef[0] = float64(comp.pred) * q[0]
+					for k := 1; k < 64; k++ {
+						rs, err := b.decode(comp.ac)
+						if err != nil {
+							return nil, err
+						}
+						run, size := int(rs>>4), uint(rs&0xf)
+						if size == 0 {
+							if run != 15 {
+								break
+							}
+							k += 15
+							continue
+						}
+						k += run
+						if k > 63 {
+							return nil, errors.New("bad AC run")
+						}
+						v := b.extend(size)
+						if z := jpegZigzag[k]; z%8 < n && z/8 < n {
+							coef[z] = float64(v) * q[z]
+						}
+					}
+
+					// the IDCT of n points of the rows, then the columns
+					for v := 0; v < n; v++ {
+						for x := 0; x < n; x++ {
+							s := 0.0
+							for u := 0; u < n; u++ {
+								s += coef[v*8+u] * cos[u][x]
+							}
+							rows[v][x] = s
+						}
+					}
+					x0 := (mx*comp.h + bx) * n
+					y0 := (my*comp.v + by) * n
+					for y := 0; y < n; y++ {
+						p := comp.pix[(y0+y)*comp.stride+x0:]
+						for x := 0; x < n; x++ {
+							s := 0.0
+							for v := 0; v < n; v++ {
+								s += rows[v][x] * cos[v][y]
+							}
+							p[x] = clampUint8(s + 128)
+						}
+					}
+				}
+			}
+		}
+	}
+	return m, nil
+}
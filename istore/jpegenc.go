@@ -0,0 +1,463 @@
+package istore
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// The JPEG output of progressive or subsample is encoded here, since
+// image/jpeg only encodes the baseline in 4:2:0.  The progressive one is by
+// the spectral selection without the successive approximation: the DC of
+// all the components first, then the low and the high frequencies of Y,
+// and the AC of Cb and Cr.  The tables are the typical ones of Annex K of
+// ITU-T T.81.
+
+// the subsamplings of the chroma
+const (
+	subsample420 = "420"
+	subsample444 = "444"
+)
+
+// jpegZigzag is the natural order of the coefficients in the zigzag order.
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// the quantization tables of the luminance and the chrominance at the
+// quality 50 in the natural order
+var jpegQuant = [2][64]int{
+	{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	},
+	{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegHuffmanSpec is the number of the codes of each length from 1 to 16,
+// and the symbols in the order of the codes.
+type jpegHuffmanSpec struct {
+	counts [16]byte
+	values []byte
+}
+
+// the DC and the AC tables of the luminance, then of the chrominance
+var jpegHuffmanSpecs = [4]jpegHuffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegHuffmanCode is the code of a symbol in the low bits of code.
+type jpegHuffmanCode struct {
+	code uint32
+	size uint
+}
+
+// jpegHuffmanTable returns the codes of spec by the symbols.
+func jpegHuffmanTable(spec jpegHuffmanSpec) [256]jpegHuffmanCode {
+	var table [256]jpegHuffmanCode
+	code, k := uint32(0), 0
+	for i, n := range spec.counts {
+		for j := 0; j < int(n); j++ {
+			table[spec.values[k]] = jpegHuffmanCode{code, uint(i + 1)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return table
+}
+
+var jpegHuffmanTables = [4][256]jpegHuffmanCode{
+	jpegHuffmanTable(jpegHuffmanSpecs[0]),
+	jpegHuffmanTable(jpegHuffmanSpecs[1]),
+	jpegHuffmanTable(jpegHuffmanSpecs[2]),
+	jpegHuffmanTable(jpegHuffmanSpecs[3]),
+}
+
+// jpegDCTCos is cos((2x+1)uπ/16) by u and x, with C(0) = 1/√2.
+var jpegDCTCos = func() (c [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		for x := 0; x < 8; x++ {
+			c[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 16)
+			if u == 0 {
+				c[u][x] /= math.Sqrt2
+			}
+		}
+	}
+	return
+}()
+
+// jpegComponent is a component of the JPEG output, with the quantized
+// coefficients of the blocks over the whole MCUs in the natural order.
+type jpegComponent struct {
+	id     byte
+	h, v   int
+	table  int
+	blocks [][64]int32
+	// bw is the number of the blocks in a row of blocks, and cw and ch
+	// are the ones within the image.
+	bw, cw, ch int
+}
+
+// encodeJPEG encodes m, which must be opaque, in JPEG of quality, in 4:2:0
+// or 4:4:4 by subsample, progressive or baseline.
+func encodeJPEG(w io.Writer, m image.Image, quality int, subsample string, progressive bool) error {
+	src := imaging.Clone(m)
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	hmax := 1
+	if subsample != subsample444 {
+		hmax = 2
+	}
+	mcusX, mcusY := (width+8*hmax-1)/(8*hmax), (height+8*hmax-1)/(8*hmax)
+
+	// the planes of Y, Cb and Cr over the whole MCUs, repeating the edges
+	pw, ph := mcusX*8*hmax, mcusY*8*hmax
+	var planes [3][]float64
+	for i := range planes {
+		planes[i] = make([]float64, pw*ph)
+	}
+	for y := 0; y < ph; y++ {
+		row := src.Pix[minInt(y, height-1)*src.Stride:]
+		for x := 0; x < pw; x++ {
+			p := row[minInt(x, width-1)*4:]
+			yy, cb, cr := color.RGBToYCbCr(p[0], p[1], p[2])
+			planes[0][y*pw+x] = float64(yy)
+			planes[1][y*pw+x] = float64(cb)
+			planes[2][y*pw+x] = float64(cr)
+		}
+	}
+
+	var quant [2][64]int
+	scale := 5000 / quality
+	if quality >= 50 {
+		scale = 200 - 2*quality
+	}
+	for t := range quant {
+		for i, q := range jpegQuant[t] {
+			quant[t][i] = minInt(maxInt((q*scale+50)/100, 1), 255)
+		}
+	}
+
+	comps := []*jpegComponent{
+		{id: 1, h: hmax, v: hmax, table: 0},
+		{id: 2, h: 1, v: 1, table: 1},
+		{id: 3, h: 1, v: 1, table: 1},
+	}
+	for i, comp := range comps {
+		// the chroma averages hmax x hmax pixels
+		f := hmax / comp.h
+		comp.bw = mcusX * comp.h
+		comp.cw = ((width*comp.h+hmax-1)/hmax + 7) / 8
+		comp.ch = ((height*comp.v+hmax-1)/hmax + 7) / 8
+		comp.blocks = make([][64]int32, comp.bw*mcusY*comp.v)
+		var block [64]float64
+		for by := 0; by < mcusY*comp.v; by++ {
+			for bx := 0; bx < comp.bw; bx++ {
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						sum := 0.0
+						for dy := 0; dy < f; dy++ {
+							for dx := 0; dx < f; dx++ {
+								sum += planes[i][((by*8+y)*f+dy)*pw+(bx*8+x)*f+dx]
+							}
+						}
+						block[y*8+x] = sum/float64(f*f) - 128
+					}
+				}
+				fdct(&block)
+				b := &comp.blocks[by*comp.bw+bx]
+				for k := range block {
+					// within 11 bits of the DC and 10 bits of the AC
+					limit := 1023.0
+					if k == 0 {
+						limit = 2047
+					}
+					b[k] = int32(math.Max(math.Min(math.Round(block[k]/float64(quant[comp.table][k])), limit), -limit))
+				}
+			}
+		}
+	}
+
+	e := &jpegWriter{w: bufio.NewWriter(w)}
+	e.marker(0xd8, nil)
+	for t := range quant {
+		dqt := []byte{byte(t)}
+		for _, k := range jpegZigzag {
+			dqt = append(dqt, byte(quant[t][k]))
+		}
+		e.marker(0xdb, dqt)
+	}
+	sof := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(comps))}
+	for _, comp := range comps {
+		sof = append(sof, comp.id, byte(comp.h<<4|comp.v), byte(comp.table))
+	}
+	if progressive {
+		e.marker(0xc2, sof)
+	} else {
+		e.marker(0xc0, sof)
+	}
+	for i, spec := range jpegHuffmanSpecs {
+		// the class of DC or AC and the table of the luminance or the
+		// chrominance
+		dht := append([]byte{byte(i%2<<4 | i/2)}, spec.counts[:]...)
+		e.marker(0xc4, append(dht, spec.values...))
+	}
+
+	if !progressive {
+		e.scan(comps, 0, 63, mcusX, mcusY)
+	} else {
+		e.scan(comps, 0, 0, mcusX, mcusY)
+		e.scan(comps[:1], 1, 5, mcusX, mcusY)
+		e.scan(comps[:1], 6, 63, mcusX, mcusY)
+		e.scan(comps[1:2], 1, 63, mcusX, mcusY)
+		e.scan(comps[2:], 1, 63, mcusX, mcusY)
+	}
+	e.marker(0xd9, nil)
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// fdct transforms the 8x8 block in place by the separable DCT-II.
+func fdct(block *[64]float64) {
+	var tmp [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += block[y*8+x] * jpegDCTCos[u][x]
+			}
+			tmp[y*8+u] = sum / 2
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			sum := 0.0
+			for y := 0; y < 8; y++ {
+				sum += tmp[y*8+u] * jpegDCTCos[v][y]
+			}
+			block[v*8+u] = sum / 2
+		}
+	}
+}
+
+// jpegWriter writes the markers and the entropy coded segments, keeping
+// the first error.
+type jpegWriter struct {
+	w    *bufio.Writer
+	err  error
+	bits uint32
+	n    uint
+}
+
+func (e *jpegWriter) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+// marker writes the marker with the payload, or without the length if
+// payload is nil.
+func (e *jpegWriter) marker(marker byte, payload []byte) {
+	if payload == nil {
+		e.write([]byte{0xff, marker})
+		return
+	}
+	n := len(payload) + 2
+	e.write([]byte{0xff, marker, byte(n >> 8), byte(n)})
+	e.write(payload)
+}
+
+// emit writes the low size bits of bits, stuffing 0 after 0xff.
+func (e *jpegWriter) emit(bits uint32, size uint) {
+	e.bits = e.bits<<size | bits&(1<<size-1)
+	e.n += size
+	for e.n >= 8 {
+		b := byte(e.bits >> (e.n - 8))
+		e.write([]byte{b})
+		if b == 0xff {
+			e.write([]byte{0})
+		}
+		e.n -= 8
+	}
+}
+
+// flush pads the last byte with 1s.
+func (e *jpegWriter) flush() {
+	if e.n > 0 {
+		e.emit(1<<(8-e.n)-1, 8-e.n)
+	}
+	e.bits = 0
+}
+
+// emitValue writes the symbol of the run and the size of v by table, and
+// the bits of v.
+func (e *jpegWriter) emitValue(table *[256]jpegHuffmanCode, run int, v int32) {
+	a, b := v, v
+	if v < 0 {
+		a, b = -v, v-1
+	}
+	size := uint(0)
+	for a > 0 {
+		size++
+		a >>= 1
+	}
+	code := table[run<<4|int(size)]
+	e.emit(code.code, code.size)
+	if size > 0 {
+		e.emit(uint32(b), size)
+	}
+}
+
+// scan writes the scan of comps from the coefficient ss to se in the
+// zigzag order.  The scan of more than one component interleaves them by
+// the MCUs, and the one of a component only covers its blocks within the
+// image.
+func (e *jpegWriter) scan(comps []*jpegComponent, ss, se int, mcusX, mcusY int) {
+	sos := []byte{byte(len(comps))}
+	for _, comp := range comps {
+		sos = append(sos, comp.id, byte(comp.table<<4|comp.table))
+	}
+	e.marker(0xda, append(sos, byte(ss), byte(se), 0))
+
+	preds := make([]int32, len(comps))
+	block := func(i int, b *[64]int32) {
+		comp := comps[i]
+		k := ss
+		if ss == 0 {
+			dc := &jpegHuffmanTables[comp.table*2]
+			e.emitValue(dc, 0, b[0]-preds[i])
+			preds[i] = b[0]
+			k = 1
+		}
+		if se == 0 {
+			return
+		}
+		ac := &jpegHuffmanTables[comp.table*2+1]
+		run := 0
+		for ; k <= se; k++ {
+			v := b[jpegZigzag[k]]
+			if v == 0 {
+				run++
+				continue
+			}
+			for ; run > 15; run -= 16 {
+				e.emitValue(ac, 15, 0)
+			}
+			e.emitValue(ac, run, v)
+			run = 0
+		}
+		if run > 0 {
+			// EOB, or the run of an EOB in the progressive scan
+			e.emitValue(ac, 0, 0)
+		}
+	}
+
+	if len(comps) == 1 {
+		comp := comps[0]
+		for by := 0; by < comp.ch; by++ {
+			for bx := 0; bx < comp.cw; bx++ {
+				block(0, &comp.blocks[by*comp.bw+bx])
+			}
+		}
+	} else {
+		for my := 0; my < mcusY; my++ {
+			for mx := 0; mx < mcusX; mx++ {
+				for i, comp := range comps {
+					for y := 0; y < comp.v; y++ {
+						for x := 0; x < comp.h; x++ {
+							block(i, &comp.blocks[(my*comp.v+y)*comp.bw+mx*comp.h+x])
+						}
+					}
+				}
+			}
+		}
+	}
+	e.flush()
+}
@@ -0,0 +1,256 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"net/http"
+)
+
+// the metadata option of the output
+const (
+	metadataKeep  = "keep"
+	metadataStrip = "strip"
+)
+
+// jpegSegment is a marker segment of JPEG before the image data, at
+// data[start:end] including the marker.
+type jpegSegment struct {
+	marker     byte
+	start, end int
+}
+
+// payload returns the segment without the marker and the length.
+func (seg jpegSegment) payload(data []byte) []byte {
+	return data[seg.start+4 : seg.end]
+}
+
+// jpegSegments splits the JPEG data up to the start of scan, which is at
+// sos.
+func jpegSegments(data []byte) (segments []jpegSegment, sos int, err error) {
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return nil, 0, errNotJPEG
+	}
+	i := 2
+	for {
+		if i+4 > len(data) || data[i] != 0xff {
+			return nil, 0, fmt.Errorf("invalid JPEG segment at %d", i)
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			return segments, i, nil
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end < i+4 || end > len(data) {
+			return nil, 0, fmt.Errorf("invalid JPEG segment length at %d", i)
+		}
+		segments = append(segments, jpegSegment{marker, i, end})
+		i = end
+	}
+}
+
+// isAncillary reports whether seg is the metadata stripped from the output,
+// the APPn and COM segments but JFIF in APP0 and Adobe in APP14, which
+// tells the color transform.
+func isAncillary(seg jpegSegment) bool {
+	return (seg.marker >= 0xe1 && seg.marker <= 0xef && seg.marker != 0xee) || seg.marker == 0xfe
+}
+
+// stripJPEGMetadata returns data without the ancillary segments.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	segments, _, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	last := 2
+	for _, seg := range segments {
+		if isAncillary(seg) {
+			out = append(out, data[last:seg.start]...)
+			last = seg.end
+		}
+	}
+	return append(out, data[last:]...), nil
+}
+
+// keptJPEGMetadata returns the segments of src kept by metadata=keep, the
+// EXIF in APP1 and the ICC profile in APP2, in the order.  The GPS is
+// cleared from EXIF, and its pixel dimensions are updated to size.  The
+// orientation is reset to 1 if the pixels are oriented by it.
+func keptJPEGMetadata(src []byte, size image.Point, oriented bool) ([][]byte, error) {
+	segments, _, err := jpegSegments(src)
+	if err != nil {
+		return nil, err
+	}
+	var kept [][]byte
+	for _, seg := range segments {
+		payload := seg.payload(src)
+		switch {
+		case seg.marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			data := append([]byte(nil), src[seg.start:seg.end]...)
+			if err := scrubExif(data[4+6:], size, oriented); err != nil {
+				// better lost than leaking the location
+				continue
+			}
+			kept = append(kept, data)
+		case seg.marker == 0xe2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			kept = append(kept, src[seg.start:seg.end])
+		}
+	}
+	return kept, nil
+}
+
+// insertJPEGSegments inserts segments after SOI and JFIF of data, where
+// EXIF must be.
+func insertJPEGSegments(data []byte, segments [][]byte) ([]byte, error) {
+	if len(segments) == 0 {
+		return data, nil
+	}
+	existing, _, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+	at := 2
+	if len(existing) > 0 && existing[0].marker == 0xe0 {
+		at = existing[0].end
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:at]...)
+	for _, seg := range segments {
+		out = append(out, seg...)
+	}
+	return append(out, data[at:]...), nil
+}
+
+// scrubExif removes the GPS IFD from the TIFF data of EXIF in place, zeroing
+// its entries and values, and sets the pixel dimensions to size, and the
+// orientation to 1 if oriented.  The offsets of the rest are kept.
+func scrubExif(data []byte, size image.Point, oriented bool) error {
+	if len(data) < 8 {
+		return errTIFF
+	}
+	t := &tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return errTIFF
+	}
+
+	ifd0 := t.order.Uint32(data[4:])
+	entries, err := t.ifd(ifd0)
+	if err != nil {
+		return err
+	}
+	if p, ok := t.uint(entries[exifGPSPointer]); ok {
+		if err := t.zeroIFD(p); err != nil {
+			return err
+		}
+		t.removeEntry(ifd0, exifGPSPointer)
+	}
+	if oriented {
+		t.setUint(ifd0, exifOrientation, 1)
+	}
+
+	if p, ok := t.uint(entries[exifIFDPointer]); ok {
+		if _, err := t.ifd(p); err != nil {
+			return err
+		}
+		t.setUint(p, exifPixelXDimension, uint32(size.X))
+		t.setUint(p, exifPixelYDimension, uint32(size.Y))
+	}
+	return nil
+}
+
+// entryAt returns the offset of the entry of tag in the IFD at offset,
+// which is checked by ifd().
+func (t *tiff) entryAt(offset uint32, tag uint16) (uint32, bool) {
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	for i := uint32(0); i < n; i++ {
+		e := offset + 2 + i*12
+		if t.order.Uint16(t.data[e:]) == tag {
+			return e, true
+		}
+	}
+	return 0, false
+}
+
+// removeEntry removes the entry of tag from the IFD at offset, moving the
+// rest and the next IFD offset up and zeroing the last 12 bytes.
+func (t *tiff) removeEntry(offset uint32, tag uint16) {
+	e, ok := t.entryAt(offset, tag)
+	if !ok {
+		return
+	}
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	end := offset + 2 + n*12
+	// the next IFD offset may be cut in a broken EXIF
+	if next := uint64(end) + 4; next <= uint64(len(t.data)) {
+		end += 4
+	}
+	copy(t.data[e:end-12], t.data[e+12:end])
+	for i := end - 12; i < end; i++ {
+		t.data[i] = 0
+	}
+	t.order.PutUint16(t.data[offset:], uint16(n-1))
+}
+
+// zeroIFD zeroes the IFD at offset and the values of its entries.
+func (t *tiff) zeroIFD(offset uint32) error {
+	if _, err := t.ifd(offset); err != nil {
+		return err
+	}
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	for i := uint32(0); i < n; i++ {
+		e := t.data[offset+2+i*12:]
+		size, ok := typeSizes[t.order.Uint16(e[2:])]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(t.order.Uint32(e[4:]))
+		if p := uint64(t.order.Uint32(e[8:])); total > 4 && p+total <= uint64(len(t.data)) {
+			for j := p; j < p+total; j++ {
+				t.data[j] = 0
+			}
+		}
+	}
+	for i := uint64(offset); i < uint64(offset)+2+uint64(n)*12; i++ {
+		t.data[i] = 0
+	}
+	return nil
+}
+
+// setUint sets the SHORT or LONG entry of tag in the IFD at offset, if any
+// and the value fits.
+func (t *tiff) setUint(offset uint32, tag uint16, v uint32) {
+	e, ok := t.entryAt(offset, tag)
+	if !ok || t.order.Uint32(t.data[e+4:]) != 1 {
+		return
+	}
+	switch t.order.Uint16(t.data[e+2:]) {
+	case 3:
+		if v <= 0xffff {
+			t.order.PutUint16(t.data[e+8:], uint16(v))
+		}
+	case 4:
+		t.order.PutUint32(t.data[e+8:], v)
+	}
+}
+
+// parseMetadata reads the metadata option.
+func parseMetadata(s string) (string, error) {
+	switch s {
+	case metadataKeep, metadataStrip:
+		return s, nil
+	}
+	return "", &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid metadata %s, must be keep or strip", s)}
+}
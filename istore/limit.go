@@ -0,0 +1,248 @@
+package istore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	_DefaultUserAgent       = "istore"
+	_DefaultHostConcurrency = 4
+	_DefaultHostRate        = 10
+	_DefaultHostWait        = 10 * time.Second
+)
+
+// hostLimiter limits the upstream fetches per host by the number in flight
+// and by the rate of a token bucket, whose burst is the rate per second.
+// Zero or negative concurrency or rate means no limit.
+type hostLimiter struct {
+	concurrency int
+	rate        float64
+	wait        time.Duration
+	mu          sync.Mutex
+	hosts       map[string]*hostLimit
+}
+
+type hostLimit struct {
+	// sem is nil if the concurrency is not limited
+	sem      chan struct{}
+	inflight int
+	tokens   float64
+	last     time.Time
+}
+
+func newHostLimiter(concurrency int, rate float64, wait time.Duration) *hostLimiter {
+	return &hostLimiter{
+		concurrency: concurrency,
+		rate:        rate,
+		wait:        wait,
+		hosts:       map[string]*hostLimit{},
+	}
+}
+
+func (l *hostLimiter) host(host string) *hostLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimit{tokens: l.burst(), last: time.Now()}
+		if l.concurrency > 0 {
+			h.sem = make(chan struct{}, l.concurrency)
+		}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+func (l *hostLimiter) burst() float64 {
+	return math.Max(1, l.rate)
+}
+
+// take takes a token of h, or returns how long to wait for one.
+func (l *hostLimiter) take(h *hostLimit) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	h.tokens = math.Min(l.burst(), h.tokens+now.Sub(h.last).Seconds()*l.rate)
+	h.last = now
+	if h.tokens >= 1 {
+		h.tokens--
+		return 0
+	}
+	return time.Duration((1 - h.tokens) / l.rate * float64(time.Second))
+}
+
+// acquire waits for a slot of host up to the wait, after which it fails
+// with 429.  The returned func releases the slot.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	h := l.host(host)
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	tooMany := &StatusError{http.StatusTooManyRequests,
+		fmt.Sprintf("too many requests to %s, waited %v", host, l.wait)}
+
+	if h.sem != nil {
+		select {
+		case h.sem <- struct{}{}:
+		case <-timer.C:
+			return nil, tooMany
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if h.sem != nil {
+			<-h.sem
+		}
+	}
+
+	if l.rate > 0 {
+		for {
+			d := l.take(h)
+			if d == 0 {
+				break
+			}
+			select {
+			case <-time.After(d):
+			case <-timer.C:
+				release()
+				return nil, tooMany
+			case <-ctx.Done():
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	l.mu.Lock()
+	h.inflight++
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		h.inflight--
+		l.mu.Unlock()
+		release()
+	}, nil
+}
+
+// inflight returns the number of fetches in flight per host, omitting the
+// idle hosts.
+func (l *hostLimiter) inflight() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	counts := map[string]int{}
+	for host, h := range l.hosts {
+		if h.inflight > 0 {
+			counts[host] = h.inflight
+		}
+	}
+	return counts
+}
+
+const (
+	_DefaultTransformQueue = 64
+	// _RetryAfter is told to the requests refused by a full queue.
+	_RetryAfter = time.Second
+)
+
+// defaultMaxTransforms is the transforms in parallel, one per CPU.
+func defaultMaxTransforms() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// defaultMaxFrames is smaller, as a video context costs much more.
+func defaultMaxFrames() int {
+	return (runtime.GOMAXPROCS(0) + 3) / 4
+}
+
+// WorkStats is the usage of a workLimiter.
+type WorkStats struct {
+	InFlight int `json:"inflight"`
+	Queued   int `json:"queued"`
+	Limit    int `json:"limit"`
+	MaxQueue int `json:"max_queue"`
+}
+
+// workLimiter limits the CPU heavy work in flight to limit, queueing the
+// rest up to maxQueue, beyond which they fail with 503.  Negative limit or
+// maxQueue means no limit.
+type workLimiter struct {
+	name     string
+	limit    int
+	maxQueue int
+	// sem is nil if the work is not limited
+	sem      chan struct{}
+	mu       sync.Mutex
+	inflight int
+	queued   int
+}
+
+func newWorkLimiter(name string, limit, maxQueue int) *workLimiter {
+	l := &workLimiter{name: name, limit: limit, maxQueue: maxQueue}
+	if limit > 0 {
+		l.sem = make(chan struct{}, limit)
+	}
+	return l
+}
+
+// acquire takes a slot, waiting in the queue if there is room.  The
+// returned func releases the slot.
+func (l *workLimiter) acquire(ctx context.Context) (func(), error) {
+	l.mu.Lock()
+	if l.sem == nil {
+		l.inflight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		l.inflight++
+		l.mu.Unlock()
+		return l.release, nil
+	default:
+	}
+	if l.maxQueue >= 0 && l.queued >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, &StatusError{http.StatusServiceUnavailable,
+			fmt.Sprintf("too many %s, %d in flight and %d queued", l.name, l.limit, l.queued)}
+	}
+	l.queued++
+	l.mu.Unlock()
+
+	select {
+	case l.sem <- struct{}{}:
+		l.mu.Lock()
+		l.queued--
+		l.inflight++
+		l.mu.Unlock()
+		return l.release, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (l *workLimiter) release() {
+	l.mu.Lock()
+	l.inflight--
+	l.mu.Unlock()
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+func (l *workLimiter) stats() WorkStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return WorkStats{InFlight: l.inflight, Queued: l.queued, Limit: l.limit, MaxQueue: l.maxQueue}
+}
@@ -0,0 +1,204 @@
+package istore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+)
+
+// overlayArgs is the arguments of overlay.
+type overlayArgs struct {
+	src     string
+	anchor  [2]int
+	offset  image.Point
+	opacity float64
+	scale   float64
+	// width is the width of the overlay in the fraction of the image, or 0
+	// to scale by scale.
+	width float64
+}
+
+// parseOverlay reads src, pos or gravity (one of fillAnchors, optionally
+// with '-' such as bottom-right, or the compass such as southeast, default
+// center), x and y (the pixels away from the edges at pos, default 0),
+// opacity (0 to 1, default 1), and scale (default 1) or width (the
+// fraction of the image width) of overlay.
+func parseOverlay(args Values) (*overlayArgs, error) {
+	o := &overlayArgs{src: args.Get("src"), opacity: 1, scale: 1}
+	if o.src == "" {
+		return nil, fmt.Errorf("src is missing")
+	}
+	pos := args.Get("pos")
+	if pos == "" {
+		pos = args.Get("gravity")
+	}
+	anchor, ok := lookupAnchor(pos)
+	if !ok {
+		return nil, fmt.Errorf("unknown pos %s", pos)
+	}
+	o.anchor = anchor
+	xy, err := args.ints("x", "y")
+	if err != nil {
+		return nil, err
+	}
+	o.offset = image.Pt(xy[0], xy[1])
+	if args.Get("opacity") != "" {
+		opacity, err := args.float("opacity")
+		if err != nil {
+			return nil, err
+		}
+		if opacity < 0 || opacity > 1 {
+			return nil, fmt.Errorf("invalid opacity %v, must be 0..1", opacity)
+		}
+		o.opacity = opacity
+	}
+	if args.Get("scale") != "" {
+		scale, err := args.float("scale")
+		if err != nil {
+			return nil, err
+		}
+		if scale <= 0 {
+			return nil, fmt.Errorf("invalid scale %v", scale)
+		}
+		o.scale = scale
+	}
+	if args.Get("width") != "" {
+		if args.Get("scale") != "" {
+			return nil, fmt.Errorf("scale and width are exclusive")
+		}
+		width, err := args.float("width")
+		if err != nil {
+			return nil, err
+		}
+		if !(width > 0 && width <= 1) {
+			return nil, fmt.Errorf("invalid width %v, must be in (0, 1]", width)
+		}
+		o.width = width
+	}
+	return o, nil
+}
+
+// overlay draws src scaled by o on m at the anchor and the offset of o,
+// with the opacity.
+func overlay(src image.Image, o *overlayArgs) imageProc {
+	if o.scale != 1 {
+		src = scaleOverlay(src, o.scale)
+	}
+	mask := image.NewUniform(color.Alpha{uint8(o.opacity*255 + 0.5)})
+
+	return func(m image.Image) image.Image {
+		b := m.Bounds()
+		dst := image.NewNRGBA(b)
+		draw.Draw(dst, b, m, b.Min, draw.Src)
+		src := src
+		if o.width > 0 {
+			src = scaleOverlay(src, o.width*float64(b.Dx())/float64(src.Bounds().Dx()))
+		}
+		sb := src.Bounds()
+		x := b.Min.X + (b.Dx()-sb.Dx())*o.anchor[0]/2
+		y := b.Min.Y + (b.Dy()-sb.Dy())*o.anchor[1]/2
+		// away from the edges at the anchor, or to the right and the
+		// bottom at the center
+		if o.anchor[0] == 2 {
+			x -= o.offset.X
+		} else {
+			x += o.offset.X
+		}
+		if o.anchor[1] == 2 {
+			y -= o.offset.Y
+		} else {
+			y += o.offset.Y
+		}
+		r := image.Rect(x, y, x+sb.Dx(), y+sb.Dy())
+		draw.DrawMask(dst, r, src, sb.Min, mask, image.ZP, draw.Over)
+		return dst
+	}
+}
+
+// scaleOverlay resizes src by scale, to at least a pixel.
+func scaleOverlay(src image.Image, scale float64) image.Image {
+	size := scaledSize(src.Bounds().Size(), scale)
+	return imaging.Resize(src, size.X, size.Y, imaging.Lanczos)
+}
+
+// scaledSize returns size scaled by scale, at least a pixel and at most
+// math.MaxInt32 on each side.
+func scaledSize(size image.Point, scale float64) image.Point {
+	w := math.Max(1, math.Min(math.Floor(float64(size.X)*scale+0.5), math.MaxInt32))
+	h := math.Max(1, math.Min(math.Floor(float64(size.Y)*scale+0.5), math.MaxInt32))
+	return image.Pt(int(w), int(h))
+}
+
+// loadOverlays fetches the src of the overlay steps, making their proc.
+// The version of the step is the hash of the src, so that the output is
+// not cached across its changes.
+func (s *Server) loadOverlays(ctx context.Context, steps []applyStep) error {
+	for i := range steps {
+		step := &steps[i]
+		if step.name != "overlay" {
+			continue
+		}
+		o, err := parseOverlay(step.args)
+		if err != nil {
+			return stepError(i, step.name, err)
+		}
+		resp, err := s.fetchTarget(ctx, o.src)
+		if err != nil {
+			if _, ok := errorStatus(err); !ok && ctx.Err() == nil {
+				// not to serve the image without the overlay
+				return &StatusError{http.StatusBadGateway, fmt.Sprintf("failed to fetch overlay %s: %v", o.src, err)}
+			}
+			return err
+		}
+		data, err := s.readImage(resp)
+		if err != nil {
+			return err
+		}
+		src, _, err := decodeImage(ctx, bytes.NewReader(data), decodeOptions{MaxPixels: s.opts.MaxInputPixels})
+		if err != nil {
+			if _, ok := errorStatus(err); ok {
+				return stepError(i, step.name, err)
+			}
+			return &StatusError{http.StatusUnprocessableEntity, fmt.Sprintf("undecodable overlay %s: %v", o.src, err)}
+		}
+		// scaled here, while by the width on the image as it comes
+		if err := checkPixels(scaledSize(src.Bounds().Size(), o.scale), s.opts.MaxInputPixels); err != nil {
+			return stepError(i, step.name, err)
+		}
+		sum := sha1.Sum(data)
+		step.version = hex.EncodeToString(sum[:])
+		step.input = src.Bounds().Size()
+		step.proc = overlay(src, o)
+	}
+	return nil
+}
+
+// readImage reads the image of resp up to MaxInputBytes, and closes it.
+func (s *Server) readImage(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	if err := checkImageType(resp); err != nil {
+		return nil, err
+	}
+	body := &limitedBody{ReadCloser: resp.Body, limit: s.opts.MaxInputBytes}
+	if s.opts.MaxInputBytes > 0 {
+		if resp.ContentLength > s.opts.MaxInputBytes {
+			return nil, body.tooLarge()
+		}
+		resp.Body = body
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil && body.exceeded() {
+		return nil, body.tooLarge()
+	}
+	return data, err
+}
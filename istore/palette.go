@@ -0,0 +1,238 @@
+package istore
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	_DefaultPaletteColors = 5
+	_MaxPaletteColors     = 32
+	// paletteSide and quantizeSide are the longer side of the image the
+	// palette is taken from, downscaled for the speed.
+	paletteSide  = 64
+	quantizeSide = 256
+)
+
+// PaletteKey is the metadata key of the palette saved by palette.
+const PaletteKey = "palette"
+
+// PaletteColor is a color of the palette with the fraction of the pixels
+// it covers, and the same in percent.
+type PaletteColor struct {
+	Hex      string  `json:"hex"`
+	Coverage float64 `json:"coverage"`
+	Percent  float64 `json:"percent"`
+}
+
+// Palette is the output of palette.  Average is the average color of the
+// opaque pixels, or empty if none.
+type Palette struct {
+	Average string         `json:"average,omitempty"`
+	Colors  []PaletteColor `json:"colors"`
+}
+
+// paletteColors parses n, or count as its alias, of palette, 1 to
+// _MaxPaletteColors.
+func paletteColors(args Values) (int, error) {
+	key := "n"
+	if args.Get(key) == "" && args.Get("count") != "" {
+		key = "count"
+	}
+	if args.Get(key) == "" {
+		return _DefaultPaletteColors, nil
+	}
+	ns, err := args.ints(key)
+	if err != nil {
+		return 0, err
+	}
+	if n := ns[0]; n < 1 || n > _MaxPaletteColors {
+		return 0, fmt.Errorf("invalid %s %d, must be 1..%d", key, n, _MaxPaletteColors)
+	}
+	return ns[0], nil
+}
+
+// colorBox is a box of the RGB space by median cut.
+type colorBox []color.NRGBA
+
+// channel returns the channel of c by i in R, G and B.
+func channel(c color.NRGBA, i int) uint8 {
+	switch i {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	}
+	return c.B
+}
+
+// widest returns the channel of the widest range and the range.
+func (b colorBox) widest() (int, int) {
+	best, width := 0, -1
+	for i := 0; i < 3; i++ {
+		lo, hi := 255, 0
+		for _, c := range b {
+			v := int(channel(c, i))
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > width {
+			best, width = i, hi-lo
+		}
+	}
+	return best, width
+}
+
+func (b colorBox) average() color.NRGBA {
+	var r, g, bl int
+	for _, c := range b {
+		r += int(c.R)
+		g += int(c.G)
+		bl += int(c.B)
+	}
+	n := len(b)
+	return color.NRGBA{uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((bl + n/2) / n), 255}
+}
+
+// imagePalette returns up to n colors of m by median cut, in the order of
+// the coverage, and their average.  The transparent pixels are ignored.
+func imagePalette(m image.Image, n int) *Palette {
+	pixels := samplePixels(m, paletteSide)
+	palette := &Palette{Colors: []PaletteColor{}}
+	if len(pixels) > 0 {
+		palette.Average = hexColor(pixels.average())
+	}
+	for _, box := range medianCut(pixels, n) {
+		coverage := float64(len(box)) / float64(len(pixels))
+		palette.Colors = append(palette.Colors, PaletteColor{
+			Hex:      hexColor(box.average()),
+			Coverage: coverage,
+			Percent:  math.Round(coverage*10000) / 100,
+		})
+	}
+	return palette
+}
+
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// samplePixels returns the opaque pixels of m downscaled to side, without
+// blending the colors.
+func samplePixels(m image.Image, side int) colorBox {
+	bounds := m.Bounds()
+	if bounds.Dx() > side || bounds.Dy() > side {
+		m = imaging.Fit(m, side, side, imaging.NearestNeighbor)
+		bounds = m.Bounds()
+	}
+
+	pixels := colorBox{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			if c.A > 0 {
+				pixels = append(pixels, c)
+			}
+		}
+	}
+	return pixels
+}
+
+// medianCut splits pixels into up to n boxes, in the order of the size.
+// pixels are reordered.
+func medianCut(pixels colorBox, n int) []colorBox {
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	// split the box of the widest range at the median, moved to the
+	// nearest change of the channel not to split a color
+	boxes := []colorBox{pixels}
+	for len(boxes) < n {
+		split, ch, width := -1, 0, 0
+		for i, box := range boxes {
+			if c, w := box.widest(); len(box) > 1 && w > width {
+				split, ch, width = i, c, w
+			}
+		}
+		if split < 0 {
+			break
+		}
+		box := boxes[split]
+		sort.Slice(box, func(i, j int) bool { return channel(box[i], ch) < channel(box[j], ch) })
+		half := len(box) / 2
+		for d := 0; ; d++ {
+			if i := half - d; i > 0 && channel(box[i-1], ch) != channel(box[i], ch) {
+				half = i
+				break
+			}
+			if i := half + d; i < len(box) && channel(box[i-1], ch) != channel(box[i], ch) {
+				half = i
+				break
+			}
+		}
+		boxes[split] = box[:half]
+		boxes = append(boxes, box[half:])
+	}
+
+	sort.SliceStable(boxes, func(i, j int) bool { return len(boxes[i]) > len(boxes[j]) })
+	return boxes
+}
+
+// quantize reduces the colors of m to up to n by the palette of median
+// cut, with Floyd-Steinberg dithering if dither.  The palette has
+// transparent if m has any transparent pixel.
+func quantize(n int, dither bool) imageProc {
+	return func(m image.Image) image.Image {
+		pixels := samplePixels(m, quantizeSide)
+		bounds := m.Bounds()
+		transparent := hasTransparent(m)
+		colors := n
+		if transparent {
+			colors--
+		}
+		pal := color.Palette{}
+		for _, box := range medianCut(pixels, colors) {
+			pal = append(pal, box.average())
+		}
+		if transparent || len(pal) == 0 {
+			pal = append(pal, color.Transparent)
+		}
+
+		dst := image.NewPaletted(bounds, pal)
+		if dither {
+			draw.FloydSteinberg.Draw(dst, bounds, m, bounds.Min)
+		} else {
+			draw.Draw(dst, bounds, m, bounds.Min, draw.Src)
+		}
+		return dst
+	}
+}
+
+// hasTransparent tells if m has any fully transparent pixel.
+func hasTransparent(m image.Image) bool {
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok && o.Opaque() {
+		return false
+	}
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := m.At(x, y).RGBA(); a == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
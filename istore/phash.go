@@ -0,0 +1,230 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/AlpacaDB/istore/bitvector"
+	"github.com/disintegration/imaging"
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	levelutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// PhashKey is the metadata key of the perceptual hash saved by phash.
+const PhashKey = "phash"
+
+const _DefaultDedupeThreshold = 6
+
+// Phash is the output of phash, the 64 bits in hex.
+type Phash struct {
+	Phash string `json:"phash"`
+}
+
+// parseSave parses save of phash, stats and palette, false by default.
+func parseSave(args Values) (bool, error) {
+	s := args.Get("save")
+	if s == "" {
+		return false, nil
+	}
+	save, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid save %q", s)
+	}
+	return save, nil
+}
+
+// imagePhash computes the DCT based perceptual hash of m.  m is reduced to
+// 32x32 in grayscale, and each bit from the top is whether the coefficient
+// of the lowest 8x8 frequencies in the row-major order is above their
+// median, without the DC term.
+func imagePhash(m image.Image) uint64 {
+	const size, low = 32, 8
+	small := imaging.Grayscale(imaging.Resize(m, size, size, imaging.Lanczos))
+	var pixels [size][size]float64
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			pixels[y][x] = float64(small.Pix[small.PixOffset(x, y)])
+		}
+	}
+
+	// the separable DCT-II of the low frequencies
+	var cos [low][size]float64
+	for u := 0; u < low; u++ {
+		for x := 0; x < size; x++ {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * size))
+		}
+	}
+	var rows [size][low]float64
+	for y := 0; y < size; y++ {
+		for u := 0; u < low; u++ {
+			for x := 0; x < size; x++ {
+				rows[y][u] += pixels[y][x] * cos[u][x]
+			}
+		}
+	}
+	coeffs := make([]float64, 0, low*low)
+	for v := 0; v < low; v++ {
+		for u := 0; u < low; u++ {
+			sum := 0.0
+			for y := 0; y < size; y++ {
+				sum += rows[y][u] * cos[v][y]
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(63-i)
+		}
+	}
+	return hash
+}
+
+// savePhash merges the phash in the output resp into the metadata of key,
+// and puts the output back to resp.
+func (s *Server) savePhash(key string, resp *http.Response) error {
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	var phash Phash
+	if err := json.Unmarshal(data, &phash); err != nil {
+		return err
+	}
+	return s.mergeMetadata(key, map[string]interface{}{PhashKey: phash.Phash})
+}
+
+// saveOutput merges the JSON output resp of an analyzer into the metadata
+// of key under field, and puts the output back to resp.
+func (s *Server) saveOutput(key, field string, resp *http.Response) error {
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	var output map[string]interface{}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return err
+	}
+	return s.mergeMetadata(key, map[string]interface{}{field: output})
+}
+
+// mergeMetadata merges values into the metadata of key by PutObject.
+func (s *Server) mergeMetadata(key string, values map[string]interface{}) error {
+	value, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	if _, _, err := s.PutObject([]byte(key), string(value), batch, true); err != nil {
+		return err
+	}
+	return s.Db.Write(batch, nil)
+}
+
+// DedupeItem is an object in a group of Dedupe.
+type DedupeItem struct {
+	ItemId   ItemId `json:"_id"`
+	FilePath string `json:"_filepath"`
+	Phash    string `json:"phash"`
+}
+
+// Dedupe groups the objects under dir by the phash saved in the metadata,
+// where each object is within threshold in the Hamming distance from
+// another in the group.  Only the groups of 2 or more are returned.
+func (s *Server) Dedupe(w http.ResponseWriter, r *http.Request, dir string) {
+	threshold := _DefaultDedupeThreshold
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 64 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid threshold %q, must be 0..64", v))
+			return
+		}
+		threshold = n
+	}
+
+	var items []DedupeItem
+	var hashes []*bitvector.BitVector
+	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(dir)), nil)
+	for iter.Next() {
+		meta := ItemMeta{}
+		if _, err := meta.UnmarshalMsg(iter.Value()); err != nil {
+			continue
+		}
+		hex, _ := meta.MetaData[PhashKey].(string)
+		hash, err := strconv.ParseUint(hex, 16, 64)
+		if err != nil {
+			continue
+		}
+		items = append(items, DedupeItem{meta.ItemId, string(iter.Key()), hex})
+		hashes = append(hashes, bitvector.FromUint64(hash, 64))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		glog.Error(err)
+		writeError(w, http.StatusInternalServerError, "failed to read "+dir)
+		return
+	}
+
+	// union-find of the pairs within threshold
+	parent := make([]int, len(items))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if bitvector.Hamming(hashes[i], hashes[j]) <= threshold {
+				if ri, rj := root(i), root(j); ri != rj {
+					parent[rj] = ri
+				}
+			}
+		}
+	}
+
+	groups := [][]DedupeItem{}
+	index := map[int]int{}
+	for i, item := range items {
+		ri := root(i)
+		g, ok := index[ri]
+		if !ok {
+			g = len(groups)
+			index[ri] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], item)
+	}
+	dups := [][]DedupeItem{}
+	for _, group := range groups {
+		if len(group) > 1 {
+			dups = append(dups, group)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dups); err != nil {
+		glog.Error(err)
+	}
+}
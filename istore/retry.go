@@ -0,0 +1,169 @@
+package istore
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	_DefaultFetchTimeout = 60 * time.Second
+	_DefaultFetchRetries = 2
+	_DefaultRetryBackoff = 100 * time.Millisecond
+)
+
+// fetchRetry fetches u, retrying transient failures up to FetchRetries times
+// with the backoff doubled for each.  read, if not nil, takes the body of
+// each response, and its failure is retried too.  Otherwise the body is
+// streamed to the caller, which can't be tried again.
+func (s *Server) fetchRetry(ctx context.Context, fetcher Fetcher, u *url.URL, read func(*http.Response) error) (*http.Response, error) {
+	backoff := s.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := s.fetchOnce(ctx, fetcher, u)
+		if err == nil && read != nil {
+			if err = read(resp); err != nil {
+				resp.Body.Close()
+				resp = nil
+			}
+		}
+		if attempt >= s.opts.FetchRetries || ctx.Err() != nil || !retryable(resp, err) {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		glog.Warningf("retrying %s in %v: %v", u, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// fetchOnce fetches u under FetchTimeout, which limits up to the headers.
+// The body is read as long as the caller waits.  The timeout is reported
+// as 504 rather than context.DeadlineExceeded, which means the caller has
+// gone.  The fetch to a host waits for the limits of it, which the local
+// schemes without host are free from, and holds them until the body is
+// closed.
+func (s *Server) fetchOnce(ctx context.Context, fetcher Fetcher, u *url.URL) (*http.Response, error) {
+	release := func() {}
+	if u.Host != "" {
+		var err error
+		if release, err = s.limiter.acquire(ctx, u.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	fctx, cancel := context.WithCancel(ctx)
+	body := &fetchBody{done: func() {
+		cancel()
+		release()
+	}}
+	timedOut := func() bool { return false }
+	if s.opts.FetchTimeout > 0 {
+		timer := time.AfterFunc(s.opts.FetchTimeout, cancel)
+		timedOut = func() bool { return !timer.Stop() && ctx.Err() == nil }
+	}
+
+	resp, err := fetcher.Fetch(fctx, u)
+	if timedOut() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = &StatusError{http.StatusGatewayTimeout,
+			fmt.Sprintf("fetching %s timed out after %v", u, s.opts.FetchTimeout)}
+	}
+	if err != nil {
+		body.close()
+		return nil, err
+	}
+	body.ReadCloser = resp.Body
+	resp.Body = body
+	return resp, nil
+}
+
+// fetchBody is the body of fetchOnce, which releases the limit of the host
+// when closed.
+type fetchBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *fetchBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.close()
+	return err
+}
+
+func (b *fetchBody) close() {
+	b.once.Do(b.done)
+}
+
+// retryable reports whether the failure may succeed if tried again.
+func retryable(resp *http.Response, err error) bool {
+	if err == nil {
+		code := resp.StatusCode
+		// the upstream of another istore tells if it is worth it
+		if upstream, err := strconv.Atoi(resp.Header.Get(UpstreamStatusHeader)); err == nil {
+			code = upstream
+		}
+		switch code {
+		case http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if code, ok := errorStatus(err); ok {
+		return code == http.StatusBadGateway ||
+			code == http.StatusServiceUnavailable ||
+			code == http.StatusGatewayTimeout
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+// failureStatus returns the status of err that does not carry one, 504 if
+// the upstream timed out, 502 if it failed to connect or respond, such as
+// the connection refused or the certificate rejected, and 500 otherwise.
+func failureStatus(err error) int {
+	cause := causeOf(err)
+	var nerr net.Error
+	if errors.Is(cause, context.DeadlineExceeded) || (errors.As(cause, &nerr) && nerr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	var cerr *tls.CertificateVerificationError
+	if errors.As(cause, &nerr) || errors.As(cause, &cerr) ||
+		errors.Is(cause, syscall.ECONNRESET) ||
+		errors.Is(cause, syscall.ECONNREFUSED) ||
+		errors.Is(cause, io.ErrUnexpectedEOF) ||
+		errors.Is(cause, io.EOF) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,217 @@
+package istore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sha256 of the empty payload
+const _EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Fetcher retrieves objects from Amazon S3 by s3://bucket/key URL.  The
+// requests are signed by AWS Signature Version 4.  Empty fields are taken
+// from the environment, AWS_REGION (or AWS_DEFAULT_REGION),
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type S3Fetcher struct {
+	Client          *http.Client
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Endpoint defaults to https://s3.<region>.amazonaws.com
+	Endpoint string
+	// UserAgent is sent if not empty.
+	UserAgent string
+	// now is replaced in test
+	now func() time.Time
+}
+
+func (f *S3Fetcher) config() (region, keyId, secret, token string) {
+	region, keyId, secret, token = f.Region, f.AccessKeyID, f.SecretAccessKey, f.SessionToken
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	if keyId == "" && secret == "" {
+		keyId = os.Getenv("AWS_ACCESS_KEY_ID")
+		secret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	return
+}
+
+// Fetch implements Fetcher.Fetch()
+func (f *S3Fetcher) Fetch(ctx context.Context, u *url.URL) (*http.Response, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, &StatusError{http.StatusBadRequest, fmt.Sprintf("invalid s3 URL %s", u)}
+	}
+
+	region, keyId, secret, token := f.config()
+	endpoint := f.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+
+	// path-style so bucket names with dots work over https
+	path := "/" + bucket + "/" + s3Escape(key)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	// keep our escaping as is
+	req.URL.RawPath = path
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+
+	if keyId != "" {
+		now := time.Now
+		if f.now != nil {
+			now = f.now
+		}
+		signS3Request(req, now().UTC(), region, keyId, secret, token)
+	}
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s3resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if s3resp.StatusCode != http.StatusOK {
+		s3resp.Body.Close()
+		return nil, &StatusError{s3resp.StatusCode, fmt.Sprintf("%s returned %s", u, s3resp.Status)}
+	}
+
+	resp := &http.Response{
+		Status:        s3resp.Status,
+		StatusCode:    s3resp.StatusCode,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        http.Header{},
+		Body:          s3resp.Body,
+		ContentLength: s3resp.ContentLength,
+	}
+	for _, h := range []string{"Content-Type", "Content-Length", "Last-Modified", "Etag"} {
+		if value := s3resp.Header.Get(h); value != "" {
+			resp.Header.Set(h, value)
+		}
+	}
+
+	return resp, nil
+}
+
+// signS3Request adds Authorization header by AWS Signature Version 4.
+func signS3Request(req *http.Request, t time.Time, region, keyId, secret, token string) {
+	req.Header.Set("X-Amz-Content-Sha256", _EmptyPayloadHash)
+	signV4(req, t, "s3", region, keyId, secret, token)
+}
+
+// _UnsignedHeaders may be changed on the way, so not signed.
+var _UnsignedHeaders = map[string]bool{
+	"Authorization":   true,
+	"User-Agent":      true,
+	"X-Amzn-Trace-Id": true,
+}
+
+// signV4 adds Authorization header to req for service by AWS Signature
+// Version 4.  Host and the headers set on req are signed, except
+// _UnsignedHeaders, and the payload is taken as empty.
+func signV4(req *http.Request, t time.Time, service, region, keyId, secret, token string) {
+	amzdate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzdate)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	for k, v := range req.Header {
+		if _UnsignedHeaders[k] {
+			continue
+		}
+		// trimmed and the sequential spaces collapsed
+		trimmed := make([]string, len(v))
+		for i := range v {
+			trimmed[i] = strings.Join(strings.Fields(v[i]), " ")
+		}
+		values[strings.ToLower(k)] = strings.Join(trimmed, ",")
+	}
+	headers := make([]string, 0, len(values))
+	for h := range values {
+		headers = append(headers, h)
+	}
+	sort.Strings(headers)
+
+	canonicalHeaders := ""
+	for _, h := range headers {
+		canonicalHeaders += h + ":" + values[h] + "\n"
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		_EmptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		keyId, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes the object key as S3 expects, leaving '/' as is.
+func s3Escape(key string) string {
+	buf := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf = append(buf, c)
+		} else {
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/AlpacaDB/istore/lsh"
 	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
 	levelutil "github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -161,7 +162,7 @@ func (s *Server) PerformSearch(w http.ResponseWriter, r *http.Request) {
 	key = key[0 : len(key)-len("_search")]
 
 	if !strings.HasPrefix(key, "/") {
-		http.Error(w, "search key should finish with '/'", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "search key should finish with '/'")
 		return
 	}
 
@@ -170,18 +171,18 @@ func (s *Server) PerformSearch(w http.ResponseWriter, r *http.Request) {
 		key: key,
 	}
 	if err := decoder.Decode(&query); err != nil {
-		http.Error(w, "unrecognizable query", http.StatusBadRequest)
+		bodyError(w, err, "unrecognizable query")
 		return
 	}
 
 	to_data, err := s.Db.Get([]byte(query.Similar.To), nil)
 	if err != nil {
 		glog.Error(err)
-		http.Error(w, "similar.to must be present", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "similar.to must be present")
 		return
 	}
 	if !convertJsonForQuery(to_data, query.Similar.By, &query.Similar.to) {
-		http.Error(w, "similar.to item is not usable for query", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "similar.to item is not usable for query")
 		return
 	}
 
@@ -226,17 +227,20 @@ func (s *Server) CreateIndex(w http.ResponseWriter, r *http.Request) {
 	key = key[0 : len(key)-len("_create_index")]
 
 	if !strings.HasSuffix(key, "/") {
-		http.Error(w, "create index key should finish with '/'", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "create index key should finish with '/'")
 		return
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	query := Query{}
 	if err := decoder.Decode(&query); err != nil {
-		http.Error(w, "unrecognized query", http.StatusBadRequest)
+		bodyError(w, err, "unrecognized query")
 		return
 	}
 
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
 	var index *lsh.Indexer
 	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(key)), nil)
 	defer iter.Release()
@@ -255,16 +259,20 @@ func (s *Server) CreateIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if index == nil {
-		http.NotFound(w, r)
+		writeError(w, http.StatusNotFound, "no feature to index under "+key)
 		return
 	}
 
 	var buf bytes.Buffer
 	encoder := gob.NewEncoder(&buf)
 	index.Encode(encoder)
-	if err := s.Db.Put([]byte(key+"_index"), buf.Bytes(), nil); err != nil {
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(key+"_index"), buf.Bytes())
+	// for the features added on ingest
+	batch.Put([]byte(key+"_index"+_IndexBySuffix), []byte(query.Similar.By))
+	if err := s.Db.Write(batch, nil); err != nil {
 		glog.Error(err)
-		http.Error(w, "Error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "failed to write the index of "+key)
 		return
 	}
 
@@ -3,9 +3,13 @@ package istore
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -22,17 +26,190 @@ import (
 	"github.com/tinylib/msgp/msgp"
 )
 
+// _PathReserved is the prefix of the keys of istore itself, including the
+// ItemId keys under _PathSeqNS, which the object paths never start with.
+const _PathReserved = "sys."
+
 const _PathIdSeq = "sys.seq"
 const _PathSeqNS = "sys.ns.seq"
+const _PathDerived = "sys.derived."
+
+// _DefaultMaxBodyBytes limits the request body if not configured.
+const _DefaultMaxBodyBytes = 1 << 20
+
+// _DefaultMaxInputBytes limits the input of image transforms if not
+// configured.
+const _DefaultMaxInputBytes = 64 << 20
+
+// _DefaultMaxInputPixels limits the pixels of the input of image
+// transforms if not configured.
+const _DefaultMaxInputPixels = 100 * 1000 * 1000
+
+// _MaxFormMemory is the memory to parse multipart form, beyond which the
+// files are stored on disk.
+const _MaxFormMemory = 32 << 20
 
 type Server struct {
-	Client    *http.Client
-	Cache     httpcache.Cache
-	Db        *leveldb.DB
-	idseq     ItemId
-	idseqLock sync.RWMutex
+	Client       *http.Client
+	Cache        httpcache.Cache
+	Db           *leveldb.DB
+	idseq        ItemId
+	idseqLock    sync.RWMutex
+	fetchers     map[string]Fetcher
+	fetchersLock sync.RWMutex
+	opts         Options
+	// derived caches the transformed outputs.
+	derived *lru.Cache
+	// derivedDB keeps them in the Db behind derived if DerivedDB.
+	derivedDB *derivedDB
+	flights   flightGroup
+	// indexLock serializes the updates of the indexes.
+	indexLock sync.Mutex
+	limiter   *hostLimiter
+	// transforms and frames limit the image transforms and the video
+	// frame extractions in flight.
+	transforms *workLimiter
+	frames     *workLimiter
+	// jobs runs _expand in the background.
+	jobs *jobRunner
+	// headClient sends HEAD bypassing the cache, which would store the
+	// empty body for the URL.
+	headClient *http.Client
+	// transport sends http(s) fetches by the TLS options.
+	transport *http.Transport
+	// closing rejects the new requests once set by Shutdown, and inflight
+	// counts the ones being served.
+	closing   bool
+	closeLock sync.Mutex
+	inflight  sync.WaitGroup
+}
+
+// Options configures Server at creation.
+type Options struct {
+	// CacheType is either "memory" (default), "disk", "leveldb" or "none".
+	// "leveldb" keeps the cache in the leveldb of the server, so it
+	// survives restarts as "disk".
+	CacheType string
+	// CacheDir is the directory for "disk" cache.
+	CacheDir string
+	// CacheMaxBytes limits the cache size.  Defaults to 5GB.
+	CacheMaxBytes int
+	// Cache replaces the cache by CacheType if not nil.  It may implement
+	// Len() and Bytes() for the stats, and Purge() for _cache/purge.
+	Cache httpcache.Cache
+	// DerivedMaxBytes limits the in-memory cache of transformed outputs.
+	// Defaults to 1GB, and negative disables it.
+	DerivedMaxBytes int
+	// DerivedDB also keeps the transformed outputs in the leveldb, so they
+	// survive restarts.
+	DerivedDB bool
+	// DerivedDBMaxBytes limits the outputs of DerivedDB, evicting the least
+	// recently used.  Defaults to 5GB, and negative means no limit.
+	DerivedDBMaxBytes int
+	// S3 serves s3:// scheme.  The credentials are taken from the
+	// environment if nil.
+	S3 *S3Fetcher
+	// MaxSelfDepth limits the nesting of self URLs.  Defaults to 8.
+	MaxSelfDepth int
+	// MaxRedirects limits the redirects followed per fetch.  Defaults to 5.
+	MaxRedirects int
+	// ForwardHeaders is the names of the request headers sent along to
+	// http(s) fetches, such as Authorization.  They are not sent to the
+	// other schemes including self.
+	ForwardHeaders []string
+	// HostHeaders is the static headers of http(s) fetches per host, which
+	// is host[:port] as in the URL.
+	HostHeaders map[string]http.Header
+	// UserAgent is sent to http(s) and s3.  Defaults to "istore".
+	UserAgent string
+	// HostConcurrency limits the fetches in flight per upstream host.
+	// Defaults to 4, and negative means no limit.
+	HostConcurrency int
+	// HostRate limits the fetches per second per upstream host.  Defaults
+	// to 10, and negative means no limit.
+	HostRate float64
+	// HostWait is how long a fetch over the limits waits before it fails
+	// with 429.  Defaults to 10 seconds.
+	HostWait time.Duration
+	// MaxTransforms limits the image transforms in flight, each of which
+	// decodes and encodes the whole image.  Defaults to GOMAXPROCS, and
+	// negative means no limit.
+	MaxTransforms int
+	// MaxFrames limits the video frame extractions in flight.  Defaults to
+	// a quarter of GOMAXPROCS, and negative means no limit.
+	MaxFrames int
+	// TransformQueue is how many transforms, and frame extractions apart,
+	// wait for the limits, beyond which they fail with 503.  Defaults to
+	// 64, and negative means no limit.
+	TransformQueue int
+	// CAFiles is the PEM files of the CAs trusted by http(s) fetches in
+	// addition to the system ones.
+	CAFiles []string
+	// ClientCert and ClientKey are the PEM files of the client certificate
+	// sent to http(s) for mutual TLS.
+	ClientCert string
+	ClientKey  string
+	// InsecureSkipVerify disables the verification of the certificates of
+	// http(s).  Only for development.
+	InsecureSkipVerify bool
+	// ExpandWorkers is the _expand jobs run at once in the background.
+	// Defaults to 2.
+	ExpandWorkers int
+	// JobRetention is how long the finished jobs are kept for _jobs.
+	// Defaults to an hour.
+	JobRetention time.Duration
+	// FileRoots is the list of directories that file:// can read from.
+	// file:// is disabled if empty.
+	FileRoots []string
+	// Tokens authenticates the requests by "Authorization: Bearer <token>"
+	// or "ApiKey <token>", failing the others with 401.  Every request is
+	// served if empty.
+	Tokens []string
+	// PublicPaths is the path prefixes served without Tokens.
+	PublicPaths []string
+	// FetchTimeout limits each attempt of upstream fetch up to the headers,
+	// while the body is read as long as the client waits.  Defaults to a
+	// minute, and negative means no limit.
+	FetchTimeout time.Duration
+	// FetchRetries is the number of retries on transient failures, such as
+	// connection reset and 5xx.  Defaults to 2, and negative means none.
+	FetchRetries int
+	// RetryBackoff is the wait before the first retry, doubled for each.
+	// Defaults to 100 milliseconds.
+	RetryBackoff time.Duration
+	// MaxBodyBytes limits the body of POST and PUT, including _bulk, _expand
+	// and _search, and the JSON pipeline of GET.  Defaults to 1MB, and
+	// negative means no limit.
+	MaxBodyBytes int64
+	// MaxInputBytes limits the upstream object the image transforms take,
+	// beyond which they fail with 413.  Defaults to 64MB, and negative
+	// means no limit.
+	MaxInputBytes int64
+	// MaxInputPixels limits the pixels of the image the transforms decode,
+	// beyond which they fail with 413 before decoding.  Defaults to 100
+	// million, and negative means no limit.
+	MaxInputPixels int64
 }
 
+// ResolvedURLHeader is the response header of the URL that actually served
+// the content, after redirects and self URLs.
+const ResolvedURLHeader = "X-Istore-Resolved-URL"
+
+// UpstreamStatusHeader is the response header of the error status of the
+// upstream, for which istore responds 502.
+const UpstreamStatusHeader = "X-Istore-Upstream-Status"
+
+// PadLeftHeader and PadTopHeader are the response headers of the offset of
+// the image placed on the canvas by the last pad in the chain.
+const (
+	PadLeftHeader = "X-Istore-Pad-Left"
+	PadTopHeader  = "X-Istore-Pad-Top"
+)
+
+// FramePtsHeader is the response header of the time in seconds of the frame
+// taken by frame, the first at or after the requested one.
+const FramePtsHeader = "X-Istore-Frame-Pts"
+
 func copyHeader(w http.ResponseWriter, r *http.Response, header string) {
 	key := http.CanonicalHeaderKey(header)
 	if value, ok := r.Header[key]; ok {
@@ -40,15 +217,63 @@ func copyHeader(w http.ResponseWriter, r *http.Response, header string) {
 	}
 }
 
+// statusCoder is implemented by errors that know the HTTP status to respond.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// StatusError is an error with the HTTP status code.
+type StatusError struct {
+	Code int
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	return e.Msg
+}
+
+// StatusCode implements statusCoder.StatusCode()
+func (e *StatusError) StatusCode() int {
+	return e.Code
+}
+
+// causeOf returns the error wrapped by http.Client, or err itself.  It may
+// be wrapped more than once through self:// and the cache transport.
+func causeOf(err error) error {
+	for {
+		uerr, ok := err.(*url.Error)
+		if !ok {
+			return err
+		}
+		err = uerr.Err
+	}
+}
+
+// errorStatus returns the status code if the cause of err carries it.
+func errorStatus(err error) (int, bool) {
+	if serr, ok := causeOf(err).(statusCoder); ok {
+		return serr.StatusCode(), true
+	}
+	return 0, false
+}
+
+// targetURLPattern splits a path into the directory and the target URL,
+// which starts at the first segment of a scheme as in RFC 3986, in any
+// case, followed by "://", or of the data URI.
+var targetURLPattern = regexp.MustCompile(`^(.*?/)((?i:[a-z][a-z0-9+.-]*://.+|data:.*,.*))$`)
+
+// extractTargetURL returns the target URL in path with the scheme in lower
+// case, and the relative self URL resolved by the directory, or "" if none.
 func extractTargetURL(path string) string {
-	r := regexp.MustCompile("^(.*?/)([0-9a-z]+\\://.+)$")
-	strs := r.FindStringSubmatch(path)
+	strs := targetURLPattern.FindStringSubmatch(path)
 
 	if len(strs) <= 2 {
 		return ""
 	}
 
 	dir, Url := strs[1], strs[2]
+	i := strings.Index(Url, ":")
+	Url = strings.ToLower(Url[:i]) + Url[i:]
 
 	// resolve relative path
 	if strings.HasPrefix(Url, "self://") {
@@ -78,28 +303,99 @@ func (v Values) GetInt(key string, defval int) int {
 	return val
 }
 
-func parseSubValues(s string) Values {
+// float returns the number of key, or 0 if missing.
+func (v Values) float(key string) (float64, error) {
+	s := v.Get(key)
+	if s == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", key, s)
+	}
+	return f, nil
+}
+
+// ints returns the integers of keys, each 0 if missing.
+func (v Values) ints(keys ...string) ([]int, error) {
+	ns := make([]int, len(keys))
+	for i, key := range keys {
+		s := v.Get(key)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", key, s)
+		}
+		ns[i] = n
+	}
+	return ns, nil
+}
+
+// rects parses the rects like x1/100,y1/100,x2/200,y2/200, failing if any
+// is empty.
+func (v Values) rects() ([]image.Rectangle, error) {
+	var rects []image.Rectangle
+	for _, val := range v.Values["rects"] {
+		subvalues, err := parseSubValues(val)
+		if err != nil {
+			return nil, err
+		}
+		// not image.Rect, which would swap the inverted ones
+		rect := image.Rectangle{
+			image.Pt(subvalues.GetInt("x1", 0), subvalues.GetInt("y1", 0)),
+			image.Pt(subvalues.GetInt("x2", 0), subvalues.GetInt("y2", 0))}
+		if rect.Empty() {
+			return nil, fmt.Errorf("empty rect %q", val)
+		}
+		rects = append(rects, rect)
+	}
+	return rects, nil
+}
+
+// floats returns the numbers of keys, each 0 if missing.
+func (v Values) floats(keys ...string) ([]float64, error) {
+	fs := make([]float64, len(keys))
+	for i, key := range keys {
+		f, err := v.float(key)
+		if err != nil {
+			return nil, err
+		}
+		fs[i] = f
+	}
+	return fs, nil
+}
+
+// parseSubValues parses the comma separated key/value like x1/100,y1/100.
+// The values are unescaped, so that %2C is a comma in the text.
+func parseSubValues(s string) (Values, error) {
 	values := Values{Values: url.Values{}}
 	for _, kv := range strings.Split(s, ",") {
 		pair := strings.SplitN(kv, "/", 2)
-		values.Add(pair[0], pair[1])
+		if len(pair) != 2 {
+			return values, fmt.Errorf("invalid rect %q", kv)
+		}
+		value, err := url.PathUnescape(pair[1])
+		if err != nil {
+			return values, fmt.Errorf("invalid rect %q", kv)
+		}
+		values.Add(pair[0], value)
 	}
 
-	return values
+	return values, nil
 }
 
 func NewServer(dbfile string) *Server {
-	//cache := diskcache.NewWithDiskv(
-	//	diskv.New(diskv.Options{
-	//		BasePath:     "/tmp/istorecache",
-	//		CacheSizeMax: 10 * (1 << 30), // 10 GB
-	//	}))
-	cache := lru.New(5 * (1 << 30)) // 5 GB
-	cacheTransport := httpcache.NewTransport(cache)
+	return NewServerOptions(dbfile, Options{})
+}
+
+func NewServerOptions(dbfile string, opts Options) *Server {
 	db, err := leveldb.OpenFile(dbfile, nil)
 	if err != nil {
 		glog.Error(err)
 	}
+	cache := newCache(&opts, db)
 
 	// the latest id sequence
 	idseq, err := db.Get([]byte(_PathIdSeq), nil)
@@ -110,18 +406,105 @@ func NewServer(dbfile string) *Server {
 	go watcher()
 
 	s := &Server{
-		Client: cacheTransport.Client(),
-		Cache:  cache,
-		Db:     db,
-		idseq:  ToItemId(idseq),
+		Db:    db,
+		idseq: ToItemId(idseq),
+		opts:  opts,
+	}
+	if cache != nil {
+		cacheTransport := httpcache.NewTransport(cache)
+		cacheTransport.Transport = s
+		s.Client = cacheTransport.Client()
+		s.Cache = cache
+	} else {
+		s.Client = &http.Client{Transport: s}
+	}
+	s.Client.CheckRedirect = s.checkRedirect
+	s.headClient = &http.Client{Transport: s, CheckRedirect: s.checkRedirect}
+	s.transport = newTransport(&s.opts)
+	if opts.MaxSelfDepth <= 0 {
+		s.opts.MaxSelfDepth = _DefaultMaxSelfDepth
+	}
+	if opts.MaxRedirects <= 0 {
+		s.opts.MaxRedirects = _DefaultMaxRedirects
+	}
+	if opts.DerivedMaxBytes == 0 {
+		s.opts.DerivedMaxBytes = _DefaultDerivedMaxBytes
+	}
+	if s.opts.DerivedMaxBytes > 0 {
+		s.derived = lru.New(s.opts.DerivedMaxBytes)
+	}
+	if opts.DerivedDBMaxBytes == 0 {
+		s.opts.DerivedDBMaxBytes = _DefaultDerivedDBMaxBytes
+	}
+	if opts.DerivedDB {
+		s.derivedDB = newDerivedDB(db, s.opts.DerivedDBMaxBytes)
+	}
+	if opts.UserAgent == "" {
+		s.opts.UserAgent = _DefaultUserAgent
+	}
+	if opts.HostConcurrency == 0 {
+		s.opts.HostConcurrency = _DefaultHostConcurrency
+	}
+	if opts.HostRate == 0 {
+		s.opts.HostRate = _DefaultHostRate
+	}
+	if opts.HostWait <= 0 {
+		s.opts.HostWait = _DefaultHostWait
 	}
-	cacheTransport.Transport = s
+	s.limiter = newHostLimiter(s.opts.HostConcurrency, s.opts.HostRate, s.opts.HostWait)
+	if opts.MaxTransforms == 0 {
+		s.opts.MaxTransforms = defaultMaxTransforms()
+	}
+	if opts.MaxFrames == 0 {
+		s.opts.MaxFrames = defaultMaxFrames()
+	}
+	if opts.TransformQueue == 0 {
+		s.opts.TransformQueue = _DefaultTransformQueue
+	}
+	s.transforms = newWorkLimiter("transforms", s.opts.MaxTransforms, s.opts.TransformQueue)
+	s.frames = newWorkLimiter("frame extractions", s.opts.MaxFrames, s.opts.TransformQueue)
+	if opts.ExpandWorkers <= 0 {
+		s.opts.ExpandWorkers = _DefaultExpandWorkers
+	}
+	if opts.JobRetention <= 0 {
+		s.opts.JobRetention = _DefaultJobRetention
+	}
+	s.jobs = newJobRunner(s.opts.ExpandWorkers, s.opts.JobRetention)
+	if opts.FetchTimeout == 0 {
+		s.opts.FetchTimeout = _DefaultFetchTimeout
+	}
+	if opts.FetchRetries == 0 {
+		s.opts.FetchRetries = _DefaultFetchRetries
+	}
+	if opts.RetryBackoff <= 0 {
+		s.opts.RetryBackoff = _DefaultRetryBackoff
+	}
+	if opts.MaxBodyBytes == 0 {
+		s.opts.MaxBodyBytes = _DefaultMaxBodyBytes
+	}
+	if opts.MaxInputBytes == 0 {
+		s.opts.MaxInputBytes = _DefaultMaxInputBytes
+	}
+	if opts.MaxInputPixels == 0 {
+		s.opts.MaxInputPixels = _DefaultMaxInputPixels
+	}
+	s.registerDefaultFetchers()
 
 	return s
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("%s %s %s", r.Method, r.URL, r.Proto)
+	if !s.enter() {
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	defer s.inflight.Done()
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="istore"`)
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
 	switch r.Method {
 	case "POST", "PUT":
 		s.ServePost(w, r)
@@ -132,8 +515,62 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	default:
 		msg := fmt.Sprintf("Not implemented method %s", r.Method)
 		glog.Error(msg)
-		http.Error(w, msg, http.StatusNotImplemented)
+		writeError(w, http.StatusNotImplemented, msg)
+	}
+}
+
+// enter counts a request in flight, unless the server is shutting down.
+func (s *Server) enter() bool {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	if s.closing {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+// Shutdown rejects the new requests with 503, waits for the ones in flight,
+// cancels the _expand jobs waiting for them to stop, and closes the Db.  If
+// ctx is done first, it closes the Db anyway and returns ctx.Err(), failing
+// the requests and the jobs left.  It does nothing if the server is already
+// shut down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeLock.Lock()
+	closing := s.closing
+	s.closing = true
+	s.closeLock.Unlock()
+	if closing {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		glog.Error("closing the db with requests in flight: ", err)
+	}
+	if jerr := s.jobs.stop(ctx); jerr != nil && err == nil {
+		err = jerr
+		glog.Error("closing the db with jobs running: ", err)
+	}
+	if s.Db != nil {
+		if cerr := s.Db.Close(); err == nil {
+			err = cerr
+		}
 	}
+	return err
+}
+
+// Close shuts down the server waiting for all the requests in flight.
+func (s *Server) Close() error {
+	return s.Shutdown(context.Background())
 }
 
 func (s *Server) NextItemId() ItemId {
@@ -221,6 +658,10 @@ func (s *Server) PutObject(key []byte, value string, batch *leveldb.Batch, overw
 }
 
 func (s *Server) ServePost(w http.ResponseWriter, r *http.Request) {
+	if s.opts.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxBodyBytes)
+	}
+
 	key := r.URL.Path
 	if strings.HasSuffix(key, "/_search") {
 		s.PerformSearch(w, r)
@@ -231,24 +672,90 @@ func (s *Server) ServePost(w http.ResponseWriter, r *http.Request) {
 	} else if strings.HasSuffix(key, "/_expand") {
 		s.Expand(w, r)
 		return
+	} else if key == "/_cache/purge" {
+		s.CachePurge(w, r)
+		return
+	} else if key == "/_bulk" {
+		s.Bulk(w, r)
+		return
+	} else if strings.HasPrefix(key, "/_jobs/") && strings.HasSuffix(key, "/cancel") {
+		s.CancelJob(w, r, key)
+		return
+	} else if key == "/_copy" || key == "/_move" {
+		s.CopyObject(w, r, key == "/_move")
+		return
+	}
+
+	key = postKey(r)
+	if err := checkObjectKey(key); err != nil {
+		glog.Error(err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	// read user input metadata
+	// ParseMultipartForm hides the error of urlencoded body behind
+	// ErrNotMultipart, so parse it first.
+	if err := r.ParseForm(); err != nil {
+		bodyError(w, err, "unrecognized form")
+		return
+	}
+	if err := r.ParseMultipartForm(_MaxFormMemory); err != nil && err != http.ErrNotMultipart {
+		bodyError(w, err, "unrecognized form")
+		return
+	}
 	value := r.FormValue("metadata")
+	var feature []float32
+	var err error
+	if extract := r.FormValue("extract"); extract != "" {
+		value, err = s.extractMeta(r.Context(), key, extract, value)
+	}
+	if compute := r.FormValue("compute"); compute != "" && err == nil {
+		value, feature, err = s.computeMeta(r.Context(), key, compute, value)
+	}
 	batch := new(leveldb.Batch)
+	if err == nil {
+		var store bool
+		if store, err = parseStore(r); store {
+			err = s.storeContent(r.Context(), key, batch)
+		}
+	}
+	if err != nil {
+		code, ok := errorStatus(err)
+		if !ok {
+			code = http.StatusBadGateway
+		}
+		glog.Error(err, code)
+		writeError(w, code, causeOf(err).Error())
+		return
+	}
+
+	var oldFeature []float32
+	if feature != nil {
+		// the index is read and written back with the object
+		s.indexLock.Lock()
+		defer s.indexLock.Unlock()
+		oldFeature = s.oldFeature(key)
+	}
 	overwrite := r.Method == "POST"
 	glog.Info("about PutObject key = ", key)
 	metabytes, isnew, err := s.PutObject([]byte(key), value, batch, overwrite)
 	if err != nil {
 		glog.Error(err)
-		http.Error(w, "Error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "failed to put "+key)
 		return
 	}
+	if feature != nil {
+		meta := ItemMeta{}
+		if _, err := meta.UnmarshalMsg(metabytes); err == nil {
+			s.indexFeature(batch, key, meta.ItemId, oldFeature, feature)
+		}
+	}
 
 	if err := s.Db.Write(batch, nil); err != nil {
 		msg := fmt.Sprintf("put failed for %s: %v", key, err)
 		glog.Error(msg)
-		http.Error(w, "Error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "failed to write "+key)
 		return
 	}
 
@@ -261,8 +768,148 @@ func (s *Server) ServePost(w http.ResponseWriter, r *http.Request) {
 	msgp.UnmarshalAsJSON(w, metabytes)
 }
 
+// ErrorResult is the body of an error response.
+type ErrorResult struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// writeError responds status with msg in ErrorResult.  The details of
+// internal errors are for the log, not msg.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(&ErrorResult{msg, status}); err != nil {
+		glog.Error(err)
+	}
+}
+
+// bodyError responds 413 if err is by MaxBodyBytes, otherwise 400 with msg.
+func bodyError(w http.ResponseWriter, err error, msg string) {
+	var mberr *http.MaxBytesError
+	if errors.As(err, &mberr) {
+		glog.Error(err)
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", mberr.Limit))
+		return
+	}
+	writeError(w, http.StatusBadRequest, msg)
+}
+
+// checkObjectKey checks key is not a reserved one under _PathReserved,
+// nor anything else but a path, which starts with '/'.
+func checkObjectKey(key string) error {
+	if strings.HasPrefix(key, _PathReserved) {
+		return fmt.Errorf("reserved key %q", key)
+	}
+	if !strings.HasPrefix(key, "/") {
+		return fmt.Errorf("path must start with '/'")
+	}
+	return nil
+}
+
+// checkObjectPath checks path is an object path, not a directory.
+func checkObjectPath(path string) error {
+	if err := checkObjectKey(path); err != nil {
+		return err
+	}
+	if strings.HasSuffix(path, "/") {
+		return fmt.Errorf("path must not be a directory")
+	}
+	return nil
+}
+
+// sentSelfPath returns the path of r as written in the request line if the
+// target is a self URL, e.g. /dir/self://http://host/a.jpg%3Fx=1 of the
+// 2nd level in the comment of selfGet, whose escaping is one level per
+// nesting and is not to be taken off by HTTP.  ok is false for the other
+// targets, and for the requests made in process, whose path is as is.
+func sentSelfPath(r *http.Request) (path string, ok bool) {
+	sent := r.RequestURI
+	if i := strings.Index(sent, "?"); i >= 0 {
+		sent = sent[:i]
+	}
+	if !strings.HasPrefix(sent, "/") {
+		return "", false
+	}
+	strs := targetURLPattern.FindStringSubmatch(sent)
+	if len(strs) <= 2 || !strings.HasPrefix(strings.ToLower(strs[2]), "self://") {
+		return "", false
+	}
+	dir, err := url.PathUnescape(strs[1])
+	if err != nil {
+		return "", false
+	}
+	Url, err := unescapeSentSelf(strs[2])
+	if err != nil {
+		return "", false
+	}
+	return dir + Url, true
+}
+
+// lookupKey returns the existing key of r and the raw query left for r.
+// The self URL target written in the URL as is takes the leading
+// parameters of the query that make an existing key, the longest first,
+// e.g. /dir/self:///video?apply=frame&sec=1 stored by _expand is found by
+// /dir/self:///video?apply=frame&sec=1&apply=phash.  The error is of the
+// Db, leveldb.ErrNotFound if none is found.
+func (s *Server) lookupKey(r *http.Request) (key, query string, err error) {
+	key, query = r.URL.Path, r.URL.RawQuery
+	if _, err = s.Db.Get([]byte(key), nil); err != leveldb.ErrNotFound {
+		return key, query, err
+	}
+	path, ok := sentSelfPath(r)
+	if !ok {
+		return key, query, err
+	}
+	var params []string
+	if query != "" {
+		params = strings.Split(query, "&")
+	}
+	for n := len(params); n >= 0; n-- {
+		k := path
+		if n > 0 {
+			k += "?" + strings.Join(params[:n], "&")
+		}
+		if _, err := s.Db.Get([]byte(k), nil); err != leveldb.ErrNotFound {
+			return k, strings.Join(params[n:], "&"), err
+		}
+	}
+	return key, query, leveldb.ErrNotFound
+}
+
+// postParams are the query parameters of POST itself.
+var postParams = map[string]bool{"metadata": true, "extract": true, "compute": true, "store": true}
+
+// postKey returns the key of POST r.  The self URL target written in the
+// URL as is takes the query but postParams, e.g.
+// /dir/self:///video?apply=frame&sec=1 by
+// /dir/self:///video?apply=frame&sec=1&store=true.
+func postKey(r *http.Request) string {
+	path, ok := sentSelfPath(r)
+	if !ok {
+		return r.URL.Path
+	}
+	var params []string
+	for _, kv := range strings.Split(r.URL.RawQuery, "&") {
+		name, err := url.QueryUnescape(strings.SplitN(kv, "=", 2)[0])
+		if kv != "" && err == nil && !postParams[name] {
+			params = append(params, kv)
+		}
+	}
+	if len(params) > 0 {
+		path += "?" + strings.Join(params, "&")
+	}
+	return path
+}
+
 func (s *Server) ServeDelete(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
+	if err := checkObjectKey(path); err != nil {
+		glog.Error(err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if strings.HasSuffix(path, "/") {
 		iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(path)), nil)
@@ -271,12 +918,18 @@ func (s *Server) ServeDelete(w http.ResponseWriter, r *http.Request) {
 				glog.Error(err)
 				// keep going...
 			}
+			// the content is left for the other objects sharing it
+			s.Db.Delete(append([]byte(_PathStored), iter.Key()...), nil)
 		}
 	} else {
+		if key, _, err := s.lookupKey(r); err == nil {
+			path = key
+		}
 		err := s.Db.Delete([]byte(path), nil)
+		s.Db.Delete([]byte(_PathStored+path), nil)
 
 		if err == leveldb.ErrNotFound {
-			http.NotFound(w, r)
+			writeError(w, http.StatusNotFound, path+" not found")
 			return
 		}
 		// TODO: delete ItemId -> path
@@ -310,7 +963,8 @@ func (s *Server) ServeList(w http.ResponseWriter, r *http.Request, path string)
 	if err != nil {
 		msg := fmt.Sprint(err)
 		glog.Error(msg)
-		http.Error(w, "Error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "failed to list "+path)
+		return
 	}
 
 	w.Header()["Content-type"] = []string{"application/json"}
@@ -320,38 +974,139 @@ func (s *Server) ServeList(w http.ResponseWriter, r *http.Request, path string)
 	}
 }
 
+// CountResult is the number of objects under a directory, and per value
+// of the by field if given.
+type CountResult struct {
+	Count int            `json:"count"`
+	By    map[string]int `json:"by,omitempty"`
+	// Missing is the number of objects without the by field.
+	Missing int `json:"missing,omitempty"`
+}
+
+// ServeCount counts the objects under dir, decoding the metadata only for
+// the by parameter.  The non-string values of by are counted in JSON.
+func (s *Server) ServeCount(w http.ResponseWriter, r *http.Request, dir string) {
+	by := r.URL.Query().Get("by")
+	result := CountResult{}
+	if by != "" {
+		result.By = map[string]int{}
+	}
+	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(dir)), nil)
+	for iter.Next() {
+		key := string(iter.Key())
+		if strings.HasSuffix(key, "/_index") || strings.HasSuffix(key, "/_index"+_IndexBySuffix) ||
+			strings.HasSuffix(key, "/"+_VideoInfoKey) {
+			continue
+		}
+		result.Count++
+		if by == "" {
+			continue
+		}
+		meta := ItemMeta{}
+		if _, err := meta.UnmarshalMsg(iter.Value()); err != nil {
+			glog.Error("failed to unmarshal metadata from db ", err)
+		}
+		value, ok := meta.MetaData[by]
+		if !ok {
+			result.Missing++
+			continue
+		}
+		group, ok := value.(string)
+		if !ok {
+			data, _ := json.Marshal(value)
+			group = string(data)
+		}
+		result.By[group]++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		glog.Error(err)
+		writeError(w, http.StatusInternalServerError, "failed to count "+dir)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Error(err)
+	}
+}
+
 func (s *Server) ServeGet(w http.ResponseWriter, r *http.Request) {
+	if s.opts.MaxBodyBytes > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxBodyBytes)
+	}
+
 	path := r.URL.Path
 
-	if strings.HasSuffix(path, "/") {
+	if strings.HasPrefix(path, "/_jobs/") {
+		s.ServeJob(w, r, path[len("/_jobs/"):])
+		return
+	} else if strings.HasSuffix(path, "/") {
 		s.ServeList(w, r, path)
 		return
 	} else if path == "/"+_PathSeqNS {
 		s.ServeList(w, r, _PathSeqNS)
 		return
+	} else if path == "/_stats" {
+		s.ServeStats(w, r)
+		return
+	} else if strings.HasSuffix(path, "/_count") {
+		s.ServeCount(w, r, path[:len(path)-len("_count")])
+		return
+	} else if strings.HasSuffix(path, "/_dedupe") {
+		s.Dedupe(w, r, path[:len(path)-len("_dedupe")])
+		return
+	} else if strings.HasSuffix(path, "/"+_VideoInfoKey) {
+		s.ServeVideoInfo(w, r, path)
+		return
 	}
 
-	if _, err := s.Db.Get([]byte(path), nil); err != nil {
+	path, query, err := s.lookupKey(r)
+	if err != nil {
 		if err == leveldb.ErrNotFound {
 			glog.Error(path, " not found")
-			http.NotFound(w, r)
+			writeError(w, http.StatusNotFound, path+" not found")
 			return
 		}
 		msg := fmt.Sprintf("error while reading %s: %v", path, err)
 		glog.Error(msg)
-		http.Error(w, "Error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "failed to read "+path)
 		return
 	}
+	if path != r.URL.Path {
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath, r.URL.RawQuery = path, "", query
+	}
 
-	resp, err := s.GetApply(r)
+	resp, err := s.GetApply(withRemoteDepth(r))
 	if err != nil {
-		statusCode := http.StatusInternalServerError
-		if resp == nil {
+		if r.Context().Err() != nil {
+			// the client has gone
+			glog.Info(path, " canceled: ", err)
+			return
+		}
+		if resp != nil && resp.StatusCode >= 400 {
+			s.relayUpstreamError(w, r, resp, err)
+			return
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if code, ok := errorStatus(err); ok {
+			glog.Error(err, code)
+			if code == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", strconv.Itoa(int(_RetryAfter/time.Second)))
+			}
+			writeError(w, code, causeOf(err).Error())
+			return
+		}
+		code := failureStatus(err)
+		glog.Error(err, code)
+		if code == http.StatusInternalServerError {
+			writeError(w, code, "failed to process "+path)
 		} else {
-			statusCode = resp.StatusCode
+			writeError(w, code, causeOf(err).Error())
 		}
-		glog.Error(err, statusCode)
-		http.Error(w, "Error", statusCode)
 		return
 	}
 
@@ -360,182 +1115,726 @@ func (s *Server) ServeGet(w http.ResponseWriter, r *http.Request) {
 	copyHeader(w, resp, "Etag")
 	copyHeader(w, resp, "Content-Length")
 	copyHeader(w, resp, "Content-Type")
+	copyHeader(w, resp, ResolvedURLHeader)
+	copyHeader(w, resp, PadLeftHeader)
+	copyHeader(w, resp, PadTopHeader)
+	copyHeader(w, resp, FramePtsHeader)
+	defer resp.Body.Close()
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	io.Copy(w, resp.Body)
 }
 
+// relayUpstreamError responds 502 to the error status of the upstream,
+// which is told in UpstreamStatusHeader, with the body of it.  The status
+// of the origin is kept through the istores in between.
+func (s *Server) relayUpstreamError(w http.ResponseWriter, r *http.Request, resp *http.Response, err error) {
+	defer resp.Body.Close()
+	glog.Error(err, http.StatusBadGateway)
+	copyHeader(w, resp, "Content-Type")
+	copyHeader(w, resp, UpstreamStatusHeader)
+	if w.Header().Get(UpstreamStatusHeader) == "" {
+		w.Header().Set(UpstreamStatusHeader, strconv.Itoa(resp.StatusCode))
+	}
+	w.WriteHeader(http.StatusBadGateway)
+	if r.Method != "HEAD" {
+		io.Copy(w, resp.Body)
+	}
+}
+
 func (s *Server) GetApply(r *http.Request) (*http.Response, error) {
 	path := r.URL.Path
 
 	Url := extractTargetURL(path)
 	if Url == "" {
-		// TODO: return NotFound?
-		return nil, fmt.Errorf("target not found in path %s", path)
+		return nil, &StatusError{http.StatusBadRequest, fmt.Sprintf("target not found in path %s", path)}
+	}
+	steps, err := parseApply(r, s.opts.MaxInputPixels)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := parseEncodeOptions(r.URL.Query())
+	if err != nil {
+		return nil, err
 	}
 
 	if glog.V(2) {
 		glog.Info("GetApply ", Url)
 	}
 
-	resp, err := s.Client.Get(Url)
+	ctx, err := s.withSelfChain(r.Context(), path)
 	if err != nil {
+		return nil, err
+	}
+	if err := s.loadOverlays(ctx, steps); err != nil {
+		return nil, err
+	}
+	// the transforms read the target whole, so it is shared by the others
+	// for the same target, while a plain GET streams it.  The images are
+	// limited by MaxInputBytes, but the videos are not.
+	if len(steps) > 0 {
+		limit := s.opts.MaxInputBytes
+		if isVideoStep(steps[0].name) {
+			limit = 0
+		}
+		ctx = withSharedInput(ctx, limit)
+	}
+	req, err := newTargetRequest(ctx, Url)
+	if err != nil {
+		return nil, err
+	}
+	s.forwardHeader(req, r)
+	var resp *http.Response
+	if stored := s.storedResponse(path); stored != nil {
+		resp = stored
+	} else if r.Method == "HEAD" && len(steps) == 0 {
+		resp, err = s.head(req)
+	} else {
+		resp, err = s.Client.Do(req)
+	}
+	if err != nil {
+		if _, ok := errorStatus(err); ok {
+			// e.g. a redirect refused by checkRedirect
+			return nil, err
+		}
 		if resp != nil {
 			return resp, fmt.Errorf("remote URL %q returned status: %v\n%v", Url, resp.Status, err)
 		}
 		return resp, err
 	}
 
-	return handleApply(resp, r)
+	if resp.StatusCode >= 400 {
+		// not to be taken for the client's fault, relayed by ServeGet
+		return resp, &StatusError{http.StatusBadGateway,
+			fmt.Sprintf("remote URL %q returned status: %v", Url, resp.Status)}
+	}
+
+	resolved := resolvedURL(Url, resp)
+	if resolved != Url && glog.V(1) {
+		glog.Info(Url, " resolved to ", resolved)
+	}
+
+	if len(steps) == 0 {
+		resp.Header.Set(ResolvedURLHeader, resolved)
+		return resp, nil
+	}
+	if !isVideoStep(steps[0].name) {
+		if err := checkImageType(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		// the fetch refuses a larger input by itself, but not the cached
+		// or stored one
+		if s.opts.MaxInputBytes > 0 {
+			body := &limitedBody{ReadCloser: resp.Body, limit: s.opts.MaxInputBytes}
+			if resp.ContentLength > s.opts.MaxInputBytes {
+				resp.Body.Close()
+				return nil, body.tooLarge()
+			}
+			resp.Body = body
+		}
+	}
+
+	key, err := derivedKey(Url, resp, steps, enc)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	newresp, err := s.applyDerived(key, resp, r, steps, enc)
+	if err != nil {
+		return nil, err
+	}
+	switch last := steps[len(steps)-1]; last.name {
+	case "phash", "stats", "palette":
+		if save, _ := parseSave(last.args); save {
+			var err error
+			if last.name == "phash" {
+				err = s.savePhash(path, newresp)
+			} else {
+				err = s.saveOutput(path, last.name, newresp)
+			}
+			if err != nil {
+				newresp.Body.Close()
+				return nil, err
+			}
+		}
+	}
+	newresp.Header.Set(ResolvedURLHeader, resolved)
+	return newresp, nil
 }
 
-func handleApply(resp *http.Response, r *http.Request) (newresp *http.Response, err error) {
-	apply := r.FormValue("apply")
+// head fetches the headers of req by HEAD, unless the object is in the
+// cache.  The transformed outputs need the whole object instead.
+func (s *Server) head(req *http.Request) (*http.Response, error) {
+	req.Method = "HEAD"
+	// the cache is bypassed with the forwarded headers
+	if s.Cache != nil && req.Header.Get("Cache-Control") == "" {
+		if resp, err := httpcache.CachedResponse(s.Cache, req); err == nil && resp != nil {
+			return resp, nil
+		}
+	}
+	return s.headClient.Do(req)
+}
 
-	var img []byte
+// resolvedURL returns the URL that served resp fetched for Url.  self URL
+// is resolved by the nested GetApply.
+func resolvedURL(Url string, resp *http.Response) string {
+	if strings.HasPrefix(Url, "self://") {
+		if resolved := resp.Header.Get(ResolvedURLHeader); resolved != "" {
+			return resolved
+		}
+		return Url
+	}
+	if resp.Request != nil && resp.Request.URL != nil {
+		return resp.Request.URL.String()
+	}
+	return Url
+}
+
+// applyProc returns the image function of apply by args, or nil if it
+// changes nothing.
+func applyProc(apply string, args Values) (imageProc, error) {
 	switch apply {
 	case "adjustBrightness":
-		percentage, err := strconv.ParseFloat(r.FormValue("percentage"), 64)
-		if img, err = adjustBrightness(resp.Body, percentage); err != nil {
+		percentage, err := args.float("percentage")
+		if err != nil {
 			return nil, err
 		}
+		return adjustBrightness(percentage), nil
 
 	case "adjustContrast":
-		percentage, err := strconv.ParseFloat(r.FormValue("percentage"), 64)
-		if img, err = adjustContrast(resp.Body, percentage); err != nil {
+		percentage, err := args.float("percentage")
+		if err != nil {
 			return nil, err
 		}
+		return adjustContrast(percentage), nil
 
 	case "adjustGamma":
-		gamma, err := strconv.ParseFloat(r.FormValue("gamma"), 64)
-		if img, err = adjustGamma(resp.Body, gamma); err != nil {
+		gamma, err := args.float("gamma")
+		if err != nil {
 			return nil, err
 		}
+		return adjustGamma(gamma), nil
+
+	case "adjustHue":
+		percentage, err := args.float("percentage")
+		if err != nil {
+			return nil, err
+		}
+		return adjustHue(percentage), nil
+
+	case "adjustSaturation":
+		percentage, err := args.float("percentage")
+		if err != nil {
+			return nil, err
+		}
+		return adjustSaturation(percentage), nil
+
+	case "hsl":
+		hsl, err := args.floats("h", "s", "l")
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range []string{"h", "s", "l"} {
+			limit := 100.0
+			if key == "h" {
+				limit = 180
+			}
+			if !(hsl[i] >= -limit && hsl[i] <= limit) {
+				return nil, fmt.Errorf("invalid %s %v, must be -%v..%v", key, hsl[i], limit, limit)
+			}
+		}
+		return adjustHSL(hsl[0], hsl[1], hsl[2]), nil
 
 	case "adjustSigmoid":
-		midpoint, err := strconv.ParseFloat(r.FormValue("midpoint"), 64)
-		factor, err := strconv.ParseFloat(r.FormValue("factor"), 64)
-		if img, err = adjustSigmoid(resp.Body, midpoint, factor); err != nil {
+		midpoint, err := args.float("midpoint")
+		if err != nil {
+			return nil, err
+		}
+		factor, err := args.float("factor")
+		if err != nil {
 			return nil, err
 		}
+		return adjustSigmoid(midpoint, factor), nil
 
 	case "blur":
-		sigma, _ := strconv.ParseFloat(r.FormValue("sigma"), 64)
-		if img, err = blur(resp.Body, sigma); err != nil {
+		sigma, err := args.float("sigma")
+		if err != nil {
+			return nil, err
+		}
+		return blur(sigma), nil
+
+	case "blurRegion":
+		sigma, err := args.float("sigma")
+		if err != nil {
+			return nil, err
+		}
+		if sigma <= 0 {
+			return nil, fmt.Errorf("invalid sigma %v", sigma)
+		}
+		rects, err := args.rects()
+		if err != nil {
+			return nil, err
+		}
+		if len(rects) == 0 {
+			return nil, fmt.Errorf("rects is missing")
+		}
+		return blurRegion(sigma, rects), nil
+
+	case "border":
+		width, err := args.ints("width")
+		if err != nil {
 			return nil, err
 		}
+		if width[0] <= 0 {
+			return nil, fmt.Errorf("invalid border width %d", width[0])
+		}
+		hex := args.Get("color")
+		if hex == "" {
+			hex = "000000"
+		}
+		col, err := parseHexColor(hex)
+		if err != nil {
+			return nil, err
+		}
+		return border(width[0], col), nil
 
 	case "crop":
-		x1, err := strconv.Atoi(r.FormValue("x1"))
-		y1, err := strconv.Atoi(r.FormValue("y1"))
-		x2, err := strconv.Atoi(r.FormValue("x2"))
-		y2, err := strconv.Atoi(r.FormValue("y2"))
-		if x1 == 0 && y1 == 0 && x2 == 0 && y2 == 0 {
-			return resp, nil
+		if region := args.Get("region"); region != "" {
+			anchor, ok := lookupAnchor(region)
+			if !ok {
+				return nil, fmt.Errorf("unknown region %s", region)
+			}
+			wh, err := args.floats("w", "h")
+			if err != nil {
+				return nil, err
+			}
+			if wh[0] <= 0 || wh[0] > 1 || wh[1] <= 0 || wh[1] > 1 {
+				return nil, fmt.Errorf("invalid region size %vx%v, must be in (0, 1]", wh[0], wh[1])
+			}
+			return cropRegion(anchor, wh[0], wh[1]), nil
+		}
+		if s := args.Get("rel"); s != "" {
+			rel, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rel %q", s)
+			}
+			if rel {
+				xy, err := args.floats("x1", "y1", "x2", "y2")
+				if err != nil {
+					return nil, err
+				}
+				for i := range xy {
+					xy[i] = math.Max(0, math.Min(1, xy[i]))
+				}
+				if xy[2] <= xy[0] || xy[3] <= xy[1] {
+					return nil, fmt.Errorf("empty crop (%v, %v)-(%v, %v)", xy[0], xy[1], xy[2], xy[3])
+				}
+				return cropRel(xy[0], xy[1], xy[2], xy[3]), nil
+			}
+		}
+		xy, err := args.ints("x1", "y1", "x2", "y2")
+		if err != nil {
+			return nil, err
+		}
+		if xy[0] == 0 && xy[1] == 0 && xy[2] == 0 && xy[3] == 0 {
+			return nil, nil
+		}
+		return crop(xy[0], xy[1], xy[2], xy[3]), nil
+
+	case "autocrop":
+		tolerance := _DefaultAutocropTolerance
+		if args.Get("tolerance") != "" {
+			ts, err := args.ints("tolerance")
+			if err != nil {
+				return nil, err
+			}
+			tolerance = ts[0]
+		}
+		if tolerance < 0 || tolerance > 255 {
+			return nil, fmt.Errorf("invalid tolerance %d, must be 0..255", tolerance)
+		}
+		return autocrop(tolerance), nil
+
+	case "convert":
+		// the format is checked by parseApply, and encoded by runApply
+		if args.Get("format") == "" {
+			return nil, fmt.Errorf("format is required")
 		}
-		if img, err = crop(resp.Body, x1, y1, x2, y2); err != nil {
+		return nil, nil
+
+	case "cropCenter":
+		wh, err := args.ints("w", "h")
+		if err != nil {
 			return nil, err
 		}
+		if wh[0] <= 0 || wh[1] <= 0 {
+			return nil, fmt.Errorf("invalid crop size %dx%d", wh[0], wh[1])
+		}
+		return cropCenter(wh[0], wh[1]), nil
 
 	case "drawRect":
-		if err = r.ParseForm(); err == nil {
-			// rects=x1/100,y1/100,x2/200,y2/200,r/255,g/0,b/0
-			opts := []*drawRectOptions{}
-			for _, val := range r.Form["rects"] {
-				subvalues := parseSubValues(val)
-				opt := &drawRectOptions{
-					X1: subvalues.GetInt("x1", 0),
-					Y1: subvalues.GetInt("y1", 0),
-					X2: subvalues.GetInt("x2", 0),
-					Y2: subvalues.GetInt("y2", 0),
-					R:  uint8(subvalues.GetInt("r", 0)),
-					G:  uint8(subvalues.GetInt("g", 0)),
-					B:  uint8(subvalues.GetInt("b", 0)),
+		// rects=x1/100,y1/100,x2/200,y2/200,r/255,g/0,b/0,a/128,thickness/3,fill/false,label/cat
+		opts := []*drawRectOptions{}
+		for _, val := range args.Values["rects"] {
+			subvalues, err := parseSubValues(val)
+			if err != nil {
+				return nil, err
+			}
+			opt := &drawRectOptions{
+				X1: subvalues.GetInt("x1", 0),
+				Y1: subvalues.GetInt("y1", 0),
+				X2: subvalues.GetInt("x2", 0),
+				Y2: subvalues.GetInt("y2", 0),
+				R:  uint8(subvalues.GetInt("r", 0)),
+				G:  uint8(subvalues.GetInt("g", 0)),
+				B:  uint8(subvalues.GetInt("b", 0)),
+				A:  uint8(subvalues.GetInt("a", 255)),
+
+				Thickness: subvalues.GetInt("thickness", 1),
+				Label:     subvalues.Get("label"),
+				LabelSize: subvalues.GetInt("size", _DefaultLabelSize),
+			}
+			if a := subvalues.GetInt("a", 255); a < 0 || a > 255 {
+				return nil, fmt.Errorf("invalid a %d, must be 0..255", a)
+			}
+			if opt.Thickness < 1 {
+				return nil, fmt.Errorf("invalid thickness %d", opt.Thickness)
+			}
+			if fill := subvalues.Get("fill"); fill != "" {
+				if opt.Fill, err = strconv.ParseBool(fill); err != nil {
+					return nil, fmt.Errorf("invalid fill %q", fill)
 				}
-				opts = append(opts, opt)
 			}
-			if img, err = drawRect(resp.Body, opts); err != nil {
-				return nil, err
+			if opt.LabelSize < 1 || opt.LabelSize > _MaxTextSize {
+				return nil, fmt.Errorf("invalid size %d, must be 1..%d", opt.LabelSize, _MaxTextSize)
 			}
+			opts = append(opts, opt)
 		}
+		return drawRect(opts), nil
 
-	case "fit":
-		w, err := strconv.Atoi(r.FormValue("w"))
-		h, err := strconv.Atoi(r.FormValue("h"))
-		if img, err = fit(resp.Body, w, h); err != nil {
+	case "drawshape":
+		shapes, err := parseShapes(args.Get("shapes"))
+		if err != nil {
 			return nil, err
 		}
+		return drawShapes(shapes), nil
 
-	case "flipH":
-		if img, err = flipH(resp.Body); err != nil {
+	case "drawtext":
+		texts, err := parseDrawText(args)
+		if err != nil {
 			return nil, err
 		}
+		return drawText(texts), nil
 
-	case "flipV":
-		if img, err = flipV(resp.Body); err != nil {
+	case "convolve":
+		p, err := parseConvolve(args)
+		if err != nil {
 			return nil, err
 		}
+		return convolve(p), nil
 
-	case "grayscale":
-		if img, err = grayscale(resp.Body); err != nil {
+	case "edges":
+		return edges(), nil
+
+	case "fill":
+		wh, err := args.ints("w", "h")
+		if err != nil {
 			return nil, err
 		}
+		if wh[0] <= 0 || wh[1] <= 0 {
+			return nil, fmt.Errorf("invalid fill size %dx%d", wh[0], wh[1])
+		}
+		anchor, ok := lookupAnchor(args.Get("anchor"))
+		if !ok {
+			return nil, fmt.Errorf("unknown anchor %s", args.Get("anchor"))
+		}
+		return fill(wh[0], wh[1], anchor), nil
+
+	case "fit":
+		wh, err := args.ints("w", "h")
+		if err != nil {
+			return nil, err
+		}
+		return fit(wh[0], wh[1]), nil
+
+	case "flipH":
+		return flipH(), nil
+
+	case "flipV":
+		return flipV(), nil
+
+	case "grayscale":
+		return grayscale(), nil
 
 	case "invert":
-		if img, err = invert(resp.Body); err != nil {
+		return invert(), nil
+
+	case "vignette":
+		strength := 0.4
+		if args.Get("strength") != "" {
+			var err error
+			if strength, err = args.float("strength"); err != nil {
+				return nil, err
+			}
+		}
+		if !(strength >= 0 && strength <= 1) {
+			return nil, fmt.Errorf("invalid strength %v, must be 0..1", strength)
+		}
+		return vignette(strength), nil
+
+	case "sepia":
+		return sepia(), nil
+
+	case "tint":
+		if args.Get("color") == "" {
+			return nil, fmt.Errorf("color is required")
+		}
+		col, err := parseHexColor(args.Get("color"))
+		if err != nil {
 			return nil, err
 		}
+		strength := 0.5
+		if args.Get("strength") != "" {
+			if strength, err = args.float("strength"); err != nil {
+				return nil, err
+			}
+		}
+		if !(strength >= 0 && strength <= 1) {
+			return nil, fmt.Errorf("invalid strength %v, must be 0..1", strength)
+		}
+		return tint(col, strength), nil
 
-	case "sharpen":
-		sigmoid, err := strconv.ParseFloat(r.FormValue("sigmoid"), 64)
-		if img, err = sharpen(resp.Body, sigmoid); err != nil {
+	case "overlay":
+		// made by loadOverlays
+		_, err := parseOverlay(args)
+		return nil, err
+
+	case "pad":
+		p, err := parsePad(args)
+		if err != nil {
 			return nil, err
 		}
+		return pad(p), nil
 
-	case "transpose":
-		if img, err = transpose(resp.Body); err != nil {
+	case "normalize":
+		clip := 0.0
+		if args.Get("clip") != "" {
+			var err error
+			if clip, err = args.float("clip"); err != nil {
+				return nil, err
+			}
+		}
+		if !(clip >= 0 && clip < 50) {
+			return nil, fmt.Errorf("invalid clip %v, must be 0 to less than 50", clip)
+		}
+		return normalize(clip), nil
+
+	case "pixelate":
+		block := _DefaultPixelateBlock
+		if args.Get("block") != "" {
+			bs, err := args.ints("block")
+			if err != nil {
+				return nil, err
+			}
+			block = bs[0]
+		}
+		if block < 2 {
+			return nil, fmt.Errorf("invalid block %d, must be 2 or more", block)
+		}
+		rects, err := args.rects()
+		if err != nil {
 			return nil, err
 		}
+		return pixelate(block, rects), nil
 
-	case "transverse":
-		if img, err = transverse(resp.Body); err != nil {
+	case "redact":
+		regions, err := parseRedact(args)
+		if err != nil {
 			return nil, err
 		}
+		return redact(regions), nil
 
-	case "resize":
-		w, err := strconv.Atoi(r.FormValue("w"))
-		h, err := strconv.Atoi(r.FormValue("h"))
-		if w == 0 && h == 0 {
-			return resp, nil
+	case "quantize":
+		n := 256
+		if args.Get("colors") != "" {
+			ns, err := args.ints("colors")
+			if err != nil {
+				return nil, err
+			}
+			n = ns[0]
 		}
-		if img, err = resize(resp.Body, w, h); err != nil {
+		if n < 2 || n > 256 {
+			return nil, fmt.Errorf("invalid colors %d, must be 2..256", n)
+		}
+		dither := false
+		if s := args.Get("dither"); s != "" {
+			var err error
+			if dither, err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("invalid dither %q", s)
+			}
+		}
+		return quantize(n, dither), nil
+
+	case "round":
+		switch shape := args.Get("shape"); shape {
+		case "circle":
+			return round(0, true), nil
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown shape %q", shape)
+		}
+		radius, err := args.float("radius")
+		if err != nil {
 			return nil, err
 		}
+		if radius <= 0 {
+			return nil, fmt.Errorf("invalid radius %v", radius)
+		}
+		return round(radius, false), nil
 
-	case "frame":
-		sec, err := strconv.Atoi(r.FormValue("sec"))
-		if img, err = frame(resp.Body, sec); err != nil {
+	case "rotate":
+		if args.Get("angle") == "" {
+			return nil, fmt.Errorf("angle is required")
+		}
+		angle, err := args.float("angle")
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(angle) || math.IsInf(angle, 0) {
+			return nil, fmt.Errorf("invalid angle %v", angle)
+		}
+		hex := args.Get("bg")
+		if hex == "" {
+			hex = "ffffff"
+		}
+		bg, err := parseHexColor(hex)
+		if err != nil {
 			return nil, err
 		}
+		return rotate(angle, bg), nil
 
-		buf := new(bytes.Buffer)
-		fmt.Fprintf(buf, "%s %s\n", resp.Proto, resp.Status)
-		fmt.Fprintf(buf, "Content-Length: %d\n", len(img))
-		fmt.Fprintf(buf, "Content-type: image/jpeg\n\n")
-		buf.Write(img)
+	case "autoorient":
+		// by the EXIF of the input, in runApply
+		return exifOrient(1), nil
 
-		return http.ReadResponse(bufio.NewReader(buf), r)
+	case "sharpen":
+		sigmoid, err := args.float("sigmoid")
+		if err != nil {
+			return nil, err
+		}
+		return sharpen(sigmoid), nil
 
-	default:
+	case "transpose":
+		return transpose(), nil
+
+	case "transverse":
+		return transverse(), nil
+
+	case "resize":
+		wh, err := args.ints("w", "h")
+		if err != nil {
+			return nil, err
+		}
+		if wh[0] == 0 && wh[1] == 0 {
+			return nil, nil
+		}
+		return resize(wh[0], wh[1]), nil
+
+	case "thumbnail":
+		whs, err := args.ints("w", "h", "size")
+		if err != nil {
+			return nil, err
+		}
+		w, h := whs[0], whs[1]
+		if whs[2] > 0 {
+			w, h = whs[2], whs[2]
+		}
+		if w < 0 || h < 0 {
+			return nil, fmt.Errorf("invalid thumbnail size %dx%d", w, h)
+		}
+		if w == 0 && h == 0 {
+			return nil, nil
+		}
+		gravity := args.Get("gravity")
+		smart := strings.ToLower(gravity) == "smart"
+		anchor, ok := lookupAnchor(gravity)
+		if !ok && !smart {
+			return nil, fmt.Errorf("unknown gravity %s", gravity)
+		}
+		upscale := false
+		if s := args.Get("upscale"); s != "" {
+			if upscale, err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("invalid upscale %q", s)
+			}
+		}
+		return thumbnail(w, h, anchor, smart, upscale), nil
+	}
+	return nil, fmt.Errorf("unknown function")
+}
+
+// handleApply transforms resp by steps, encoding by enc, under the limit of
+// the transforms or the frame extractions.  resp is returned as is if the
+// steps change nothing, with the body runApply has read put back.
+func (s *Server) handleApply(resp *http.Response, r *http.Request, steps []applyStep, enc encodeOptions) (newresp *http.Response, err error) {
+	limiter := s.transforms
+	if isVideoStep(steps[0].name) {
+		limiter = s.frames
+	}
+	release, err := limiter.acquire(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	input := io.Reader(resp.Body)
+	read := getBuffer()
+	if !isVideoStep(steps[0].name) {
+		input = io.TeeReader(resp.Body, read)
+	}
+	img, header, err := runApply(r.Context(), input, steps, enc, decodeOptions{MaxPixels: s.opts.MaxInputPixels})
+	if err != nil {
+		putBuffer(read)
+		return nil, err
+	}
+	if img == nil {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(read, resp.Body), resp.Body}
 		return resp, nil
 	}
+	putBuffer(read)
 	defer resp.Body.Close()
 
 	buf := new(bytes.Buffer)
 	fmt.Fprintf(buf, "%s %s\n", resp.Proto, resp.Status)
+	if isVideoStep(steps[0].name) {
+		fmt.Fprintf(buf, "Content-Length: %d\n", len(img))
+		header.Write(buf)
+		buf.WriteString("\n")
+		buf.Write(img)
+		return http.ReadResponse(bufio.NewReader(buf), r)
+	}
+
+	// the headers of the upstream bytes no longer apply to img
 	excludes := map[string]bool{
-		"Content-Length": true,
-		"Cache-Control":  true,
+		"Content-Length":   true,
+		"Content-Type":     true,
+		"Content-Encoding": true,
+		"Content-Md5":      true,
+		"Content-Range":    true,
+		"Accept-Ranges":    true,
+		"Cache-Control":    true,
+		PadLeftHeader:      true,
+		PadTopHeader:       true,
+		FramePtsHeader:     true,
 	}
 	resp.Header.WriteSubset(buf, excludes)
+	header.Write(buf)
 	fmt.Fprintf(buf, "Date: %s\n", time.Now().Format(time.RFC1123))
 	fmt.Fprintf(buf, "Cache-Control: max-age=1000000\n")
 	fmt.Fprintf(buf, "Content-Length: %d\n\n", len(img))
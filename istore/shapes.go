@@ -0,0 +1,261 @@
+package istore
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+	"strings"
+)
+
+// _MaxShapeCoord bounds the coordinates and the sizes of drawshape, so that
+// a line far outside the image is not walked for long.
+const _MaxShapeCoord = 1 << 16
+
+// shape is an entry of drawshape, a polygon, line or circle.
+type shape struct {
+	Type   string   `json:"type"`
+	Points [][2]int `json:"points"`
+	X1     int      `json:"x1"`
+	Y1     int      `json:"y1"`
+	X2     int      `json:"x2"`
+	Y2     int      `json:"y2"`
+	CX     int      `json:"cx"`
+	CY     int      `json:"cy"`
+	R      *int     `json:"r"`
+	// Color is RRGGBB or RRGGBBAA, black by default, and Alpha (default
+	// 255) multiplies its alpha.
+	Color     string `json:"color"`
+	Alpha     *int   `json:"alpha"`
+	Thickness *int   `json:"thickness"`
+	Fill      bool   `json:"fill"`
+
+	col color.NRGBA
+}
+
+// parseShapes reads the JSON array of the shapes.  A bad one fails with
+// its index from 1.
+func parseShapes(s string) ([]*shape, error) {
+	if s == "" {
+		return nil, fmt.Errorf("shapes is missing")
+	}
+	var shapes []*shape
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&shapes); err != nil {
+		return nil, fmt.Errorf("invalid shapes: %v", err)
+	}
+	if len(shapes) == 0 {
+		return nil, fmt.Errorf("shapes is empty")
+	}
+	for i, sh := range shapes {
+		if sh == nil {
+			return nil, fmt.Errorf("shape %d: null", i+1)
+		}
+		if err := sh.check(); err != nil {
+			return nil, fmt.Errorf("shape %d: %v", i+1, err)
+		}
+	}
+	return shapes, nil
+}
+
+// check validates sh, and resolves its color.
+func (sh *shape) check() error {
+	var coords []int
+	switch sh.Type {
+	case "polygon":
+		if len(sh.Points) < 3 {
+			return fmt.Errorf("polygon needs 3 points or more, got %d", len(sh.Points))
+		}
+		area := 0
+		for i, p := range sh.Points {
+			q := sh.Points[(i+1)%len(sh.Points)]
+			area += p[0]*q[1] - q[0]*p[1]
+			coords = append(coords, p[0], p[1])
+		}
+		if area == 0 {
+			return fmt.Errorf("zero area polygon")
+		}
+	case "line":
+		coords = []int{sh.X1, sh.Y1, sh.X2, sh.Y2}
+	case "circle":
+		if sh.R == nil || *sh.R <= 0 {
+			return fmt.Errorf("circle needs the positive r")
+		}
+		coords = []int{sh.CX, sh.CY, *sh.R}
+	default:
+		return fmt.Errorf("unknown type %q, must be polygon, line or circle", sh.Type)
+	}
+	for _, n := range coords {
+		if n < -_MaxShapeCoord || n > _MaxShapeCoord {
+			return fmt.Errorf("coordinate %d out of ±%d", n, _MaxShapeCoord)
+		}
+	}
+
+	if sh.Thickness == nil {
+		sh.Thickness = new(int)
+		*sh.Thickness = 1
+	}
+	if *sh.Thickness < 1 || *sh.Thickness > _MaxShapeCoord {
+		return fmt.Errorf("invalid thickness %d", *sh.Thickness)
+	}
+	alpha := 255
+	if sh.Alpha != nil {
+		if alpha = *sh.Alpha; alpha < 0 || alpha > 255 {
+			return fmt.Errorf("invalid alpha %d, must be 0..255", alpha)
+		}
+	}
+	sh.col = color.NRGBA{A: 255}
+	if sh.Color != "" {
+		col, err := parseHexColor(sh.Color)
+		if err != nil {
+			return err
+		}
+		sh.col = col.(color.NRGBA)
+	}
+	sh.col.A = uint8(int(sh.col.A) * alpha / 255)
+	return nil
+}
+
+// drawShapes draws the shapes one after another, each blended once over
+// the image by the mask of its pixels.
+func drawShapes(shapes []*shape) imageProc {
+	return func(m image.Image) image.Image {
+		bounds := m.Bounds()
+		m2 := image.NewRGBA(bounds)
+		draw.Draw(m2, bounds, m, bounds.Min, draw.Src)
+		for _, sh := range shapes {
+			mask := image.NewAlpha(bounds)
+			sh.draw(mask)
+			draw.DrawMask(m2, bounds, image.NewUniform(sh.col), image.ZP, mask, bounds.Min, draw.Over)
+		}
+		return m2
+	}
+}
+
+// draw sets the pixels of sh in mask.  The outlines are centered on the
+// path, and a fill includes the outline of 1 pixel.
+func (sh *shape) draw(mask *image.Alpha) {
+	t := *sh.Thickness
+	switch sh.Type {
+	case "polygon":
+		if sh.Fill {
+			pts := make([][2]float64, len(sh.Points))
+			for i, p := range sh.Points {
+				pts[i] = [2]float64{float64(p[0]) + 0.5, float64(p[1]) + 0.5}
+			}
+			fillPolygon(mask, pts)
+			t = 1
+		}
+		for i, p := range sh.Points {
+			q := sh.Points[(i+1)%len(sh.Points)]
+			strokeLine(mask, p[0], p[1], q[0], q[1], t)
+		}
+	case "line":
+		strokeLine(mask, sh.X1, sh.Y1, sh.X2, sh.Y2, t)
+	case "circle":
+		cx, cy, r := float64(sh.CX)+0.5, float64(sh.CY)+0.5, float64(*sh.R)
+		if sh.Fill {
+			fillRing(mask, cx, cy, -1, r+0.5)
+		} else {
+			fillRing(mask, cx, cy, r-float64(t)/2, r+float64(t)/2)
+		}
+	}
+}
+
+// strokeLine sets the line from x1, y1 to x2, y2 of the width in mask, by
+// Bresenham for the width 1, otherwise by the rectangle along the line with
+// the round caps.
+func strokeLine(mask *image.Alpha, x1, y1, x2, y2, width int) {
+	if width <= 1 {
+		plotLine(mask, x1, y1, x2, y2)
+		return
+	}
+	ax, ay := float64(x1)+0.5, float64(y1)+0.5
+	bx, by := float64(x2)+0.5, float64(y2)+0.5
+	half := float64(width) / 2
+	if length := math.Hypot(bx-ax, by-ay); length > 0 {
+		nx, ny := -(by-ay)/length*half, (bx-ax)/length*half
+		fillPolygon(mask, [][2]float64{{ax + nx, ay + ny}, {bx + nx, by + ny}, {bx - nx, by - ny}, {ax - nx, ay - ny}})
+	}
+	fillRing(mask, ax, ay, -1, half)
+	fillRing(mask, bx, by, -1, half)
+}
+
+// plotLine sets the pixels of the line by Bresenham, skipping the ones
+// outside mask.
+func plotLine(mask *image.Alpha, x1, y1, x2, y2 int) {
+	dx, dy := absInt(x2-x1), -absInt(y2-y1)
+	sx, sy := 1, 1
+	if x2 < x1 {
+		sx = -1
+	}
+	if y2 < y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		mask.SetAlpha(x1, y1, color.Alpha{255})
+		if x1 == x2 && y1 == y2 {
+			return
+		}
+		if e2 := 2 * e; e2 >= dy {
+			e += dy
+			x1 += sx
+		}
+		if e2 := 2 * e; e2 <= dx {
+			e += dx
+			y1 += sy
+		}
+	}
+}
+
+// fillPolygon sets the pixels of mask whose centers are inside pts by the
+// even-odd rule, a scanline at a time.
+func fillPolygon(mask *image.Alpha, pts [][2]float64) {
+	bounds := mask.Bounds()
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, p := range pts {
+		minY, maxY = math.Min(minY, p[1]), math.Max(maxY, p[1])
+	}
+	y0 := maxInt(bounds.Min.Y, int(math.Floor(minY)))
+	y1 := minInt(bounds.Max.Y, int(math.Ceil(maxY)))
+	var xs []float64
+	for y := y0; y < y1; y++ {
+		sy := float64(y) + 0.5
+		xs = xs[:0]
+		for i, p := range pts {
+			q := pts[(i+1)%len(pts)]
+			if (p[1] <= sy) != (q[1] <= sy) {
+				xs = append(xs, p[0]+(sy-p[1])*(q[0]-p[0])/(q[1]-p[1]))
+			}
+		}
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			// the pixels whose centers are in [xs[i], xs[i+1])
+			x0 := maxInt(bounds.Min.X, int(math.Ceil(xs[i]-0.5)))
+			x1 := minInt(bounds.Max.X, int(math.Ceil(xs[i+1]-0.5)))
+			for x := x0; x < x1; x++ {
+				mask.SetAlpha(x, y, color.Alpha{255})
+			}
+		}
+	}
+}
+
+// fillRing sets the pixels of mask whose centers are farther than inner
+// and up to outer from cx, cy.
+func fillRing(mask *image.Alpha, cx, cy, inner, outer float64) {
+	r := image.Rect(int(math.Floor(cx-outer)), int(math.Floor(cy-outer)),
+		int(math.Ceil(cx+outer))+1, int(math.Ceil(cy+outer))+1).Intersect(mask.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+			if d := dx*dx + dy*dy; d <= outer*outer && (inner < 0 || d > inner*inner) {
+				mask.SetAlpha(x, y, color.Alpha{255})
+			}
+		}
+	}
+}
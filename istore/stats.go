@@ -0,0 +1,85 @@
+package istore
+
+import (
+	"image"
+	"math"
+)
+
+// StatsKey is the metadata key of the statistics saved by stats.
+const StatsKey = "stats"
+
+// the luminance below or above which a pixel is dark or bright, and the
+// fraction of such pixels for the image to be near black or white
+const (
+	_DarkLuminance   = 16
+	_BrightLuminance = 239
+	_NearFraction    = 0.98
+)
+
+// ChannelStats is a statistic of each channel.
+type ChannelStats struct {
+	R         float64 `json:"r"`
+	G         float64 `json:"g"`
+	B         float64 `json:"b"`
+	Luminance float64 `json:"luminance"`
+}
+
+// ImageStats is the output of stats, where Histogram is the pixels of each
+// luminance from 0 to 255 by ITU-R BT.601.  The image is near black or
+// white if 98% of the pixels are darker than 16 or brighter than 239.
+type ImageStats struct {
+	Width     int          `json:"width"`
+	Height    int          `json:"height"`
+	Format    string       `json:"format"`
+	Mean      ChannelStats `json:"mean"`
+	Stddev    ChannelStats `json:"stddev"`
+	Histogram []int        `json:"histogram"`
+	NearBlack bool         `json:"near_black"`
+	NearWhite bool         `json:"near_white"`
+}
+
+// imageStats computes the statistics of m decoded from format, in 8 bits
+// per channel.
+func imageStats(m image.Image, format string) *ImageStats {
+	bounds := m.Bounds()
+	st := &ImageStats{
+		Width:     bounds.Dx(),
+		Height:    bounds.Dy(),
+		Format:    format,
+		Histogram: make([]int, 256),
+	}
+	var sum, sq [4]float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := m.At(x, y).RGBA()
+			l := (299*r + 587*g + 114*b + 500) / 1000
+			st.Histogram[l>>8]++
+			for i, v := range [4]uint32{r, g, b, l} {
+				f := float64(v >> 8)
+				sum[i] += f
+				sq[i] += f * f
+			}
+		}
+	}
+	n := float64(st.Width * st.Height)
+	var mean, stddev [4]float64
+	for i := range sum {
+		mean[i] = sum[i] / n
+		stddev[i] = math.Sqrt(math.Max(sq[i]/n-mean[i]*mean[i], 0))
+	}
+	st.Mean = ChannelStats{mean[0], mean[1], mean[2], mean[3]}
+	st.Stddev = ChannelStats{stddev[0], stddev[1], stddev[2], stddev[3]}
+
+	dark, bright := 0, 0
+	for l, count := range st.Histogram {
+		if l < _DarkLuminance {
+			dark += count
+		}
+		if l > _BrightLuminance {
+			bright += count
+		}
+	}
+	st.NearBlack = float64(dark) >= _NearFraction*n
+	st.NearWhite = float64(bright) >= _NearFraction*n
+	return st
+}
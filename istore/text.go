@@ -0,0 +1,237 @@
+package istore
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	_DefaultTextSize  = 16
+	_MaxTextSize      = 512
+	_DefaultLabelSize = 12
+)
+
+// textArgs is an annotation of drawtext.
+type textArgs struct {
+	text string
+	// at is the top left of the text, or of its box if bg is given.
+	at   image.Point
+	size float64
+	col  color.Color
+	// bg is the color of the box behind the text, or nil for none.
+	bg color.Color
+	// width is the width wrapping the lines, or 0 for up to the right edge
+	// of the image.
+	width int
+}
+
+// parseDrawText reads the annotation of the text, x, y, size, r, g, b, bg
+// and w parameters, and the ones of texts, each of them in the form of
+// parseSubValues like text/Hello,x/10,y/10.
+func parseDrawText(args Values) ([]*textArgs, error) {
+	var texts []*textArgs
+	if args.Get("text") != "" {
+		t, err := parseTextArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, t)
+	}
+	for _, val := range args.Values["texts"] {
+		subvalues, err := parseSubValues(val)
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseTextArgs(subvalues)
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, t)
+	}
+	if len(texts) == 0 {
+		return nil, fmt.Errorf("text is missing")
+	}
+	return texts, nil
+}
+
+// parseTextArgs reads text, x and y (default 0), size in pixels (default
+// 16), r, g and b (default black), bg (RRGGBB or RRGGBBAA) and w of an
+// annotation.
+func parseTextArgs(args Values) (*textArgs, error) {
+	t := &textArgs{text: args.Get("text"), size: _DefaultTextSize}
+	if t.text == "" {
+		return nil, fmt.Errorf("text is missing")
+	}
+	ns, err := args.ints("x", "y", "r", "g", "b", "w")
+	if err != nil {
+		return nil, err
+	}
+	t.at = image.Pt(ns[0], ns[1])
+	for i, key := range []string{"r", "g", "b"} {
+		if n := ns[2+i]; n < 0 || n > 255 {
+			return nil, fmt.Errorf("invalid %s %d, must be 0..255", key, n)
+		}
+	}
+	t.col = color.NRGBA{uint8(ns[2]), uint8(ns[3]), uint8(ns[4]), 255}
+	if t.width = ns[5]; t.width < 0 {
+		return nil, fmt.Errorf("invalid w %d", t.width)
+	}
+	if args.Get("size") != "" {
+		if t.size, err = args.float("size"); err != nil {
+			return nil, err
+		}
+		if t.size < 1 || t.size > _MaxTextSize {
+			return nil, fmt.Errorf("invalid size %v, must be 1..%d", t.size, _MaxTextSize)
+		}
+	}
+	if args.Get("bg") != "" {
+		if t.bg, err = parseHexColor(args.Get("bg")); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func drawText(texts []*textArgs) imageProc {
+	return func(m image.Image) image.Image {
+		r := m.Bounds()
+		m2 := image.NewRGBA(r)
+		draw.Draw(m2, r, m, r.Min, draw.Src)
+		for _, t := range texts {
+			renderText(m2, t)
+		}
+		return m2
+	}
+}
+
+var (
+	textFontOnce sync.Once
+	textFont     *opentype.Font
+	textFontErr  error
+)
+
+// textFace returns the face of the bundled Go Regular at size in pixels.
+// The face is not safe for the concurrent use, so each drawing makes one.
+func textFace(size float64) (font.Face, error) {
+	textFontOnce.Do(func() {
+		textFont, textFontErr = opentype.Parse(goregular.TTF)
+	})
+	if textFontErr != nil {
+		return nil, textFontErr
+	}
+	return opentype.NewFace(textFont, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+}
+
+// renderText draws t on dst, wrapping the lines at the width.  The box of
+// bg is padded by size/8 around the lines.
+func renderText(dst draw.Image, t *textArgs) {
+	face, err := textFace(t.size)
+	if err != nil {
+		// the bundled font is known good
+		panic(err)
+	}
+	defer face.Close()
+
+	pad := 0
+	if t.bg != nil {
+		pad = int(t.size / 8)
+	}
+	width := t.width
+	if width == 0 {
+		width = dst.Bounds().Max.X - t.at.X - 2*pad
+	}
+	lines := wrapText(face, t.text, width)
+	metrics := face.Metrics()
+	height := metrics.Height.Ceil()
+
+	if t.bg != nil {
+		textWidth := 0
+		for _, line := range lines {
+			if w := font.MeasureString(face, line).Ceil(); w > textWidth {
+				textWidth = w
+			}
+		}
+		box := image.Rect(t.at.X, t.at.Y, t.at.X+textWidth+2*pad, t.at.Y+len(lines)*height+2*pad)
+		draw.Draw(dst, box, image.NewUniform(t.bg), image.ZP, draw.Over)
+	}
+	d := &font.Drawer{Dst: dst, Src: image.NewUniform(t.col), Face: face}
+	for i, line := range lines {
+		d.Dot = fixed.P(t.at.X+pad, t.at.Y+pad+i*height)
+		d.Dot.Y += metrics.Ascent
+		d.DrawString(line)
+	}
+}
+
+// wrapText splits s into the lines at the newlines, and at the last space
+// before the line exceeds width, or at the rune if it has no space like
+// CJK.  A line has a rune at least.
+func wrapText(face font.Face, s string, width int) []string {
+	var lines []string
+	for _, para := range strings.Split(s, "\n") {
+		rs := []rune(para)
+		start, space := 0, -1
+		var advance fixed.Int26_6
+		for i := 0; i < len(rs); i++ {
+			if rs[i] == ' ' {
+				space = i
+			}
+			a, _ := face.GlyphAdvance(rs[i])
+			if i > start {
+				a += face.Kern(rs[i-1], rs[i])
+			}
+			if (advance+a).Ceil() > width && i > start {
+				end, next := i, i
+				if space > start {
+					end, next = space, space+1
+				}
+				lines = append(lines, strings.TrimRight(string(rs[start:end]), " "))
+				start, space, advance = next, -1, 0
+				// measures again from the start of the next line
+				i = start - 1
+				continue
+			}
+			advance += a
+		}
+		lines = append(lines, string(rs[start:]))
+	}
+	return lines
+}
+
+// drawLabel draws the label of the rect r in the box of col at its top
+// left, above the rect if it has the room, otherwise inside.  The text is
+// black or white, whichever is readable on col.
+func drawLabel(dst draw.Image, opt *drawRectOptions, r image.Rectangle, col color.NRGBA) {
+	size := float64(opt.LabelSize)
+	if size == 0 {
+		size = _DefaultLabelSize
+	}
+	t := &textArgs{text: opt.Label, size: size, col: color.White, bg: col}
+	if 299*int(col.R)+587*int(col.G)+114*int(col.B) > 128*1000 {
+		t.col = color.Black
+	}
+	face, err := textFace(size)
+	if err != nil {
+		panic(err)
+	}
+	height := face.Metrics().Height.Ceil() + 2*int(size/8)
+	face.Close()
+
+	t.at = image.Pt(r.Min.X, r.Min.Y-height)
+	if t.at.Y < dst.Bounds().Min.Y {
+		t.at.Y = r.Min.Y
+	}
+	renderText(dst, t)
+}
@@ -0,0 +1,65 @@
+package istore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// newTLSConfig builds the TLS config of upstream fetches by opts.  It
+// returns nil if nothing is configured, to use the defaults.
+func newTLSConfig(opts *Options) (*tls.Config, error) {
+	if len(opts.CAFiles) == 0 && opts.ClientCert == "" && !opts.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if len(opts.CAFiles) > 0 {
+		// the system roots are trusted as well
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range opts.CAFiles {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", file)
+			}
+		}
+		config.RootCAs = pool
+	}
+	if opts.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if opts.InsecureSkipVerify {
+		glog.Warning("InsecureSkipVerify: upstream TLS certificates are NOT verified, never use this in production")
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// newTransport returns the transport of upstream fetches configured by
+// opts.  It falls back to the default TLS config if opts is invalid.
+func newTransport(opts *Options) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	config, err := newTLSConfig(opts)
+	if err != nil {
+		glog.Error("falling back to the default TLS config: ", err)
+		return transport
+	}
+	if config != nil {
+		transport.TLSClientConfig = config
+	}
+	return transport
+}
@@ -0,0 +1,232 @@
+package istore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	_DefaultGIFFps   = 10
+	_MaxGIFFps       = 50
+	_DefaultGIFWidth = 320
+	// _MaxGIFFrames bounds the range by fps, and _MaxGIFPixels of the
+	// animated GIF the frames held until the palette is made.
+	_MaxGIFFrames = 300
+)
+
+// gifArgs is the arguments of gif and clip.
+type gifArgs struct {
+	start, end time.Duration
+	fps, width int
+	// format is gif or webp
+	format string
+	// maxPixels bounds the frames as frameArgs
+	maxPixels int64
+}
+
+// parseGIFArgs reads start (default 0) and end in seconds as sec of frame,
+// fps (1.._MaxGIFFps, default 10) and w (default 320, 0 for the video
+// width) of gif, whose frames are up to maxPixels.
+func parseGIFArgs(args Values, maxPixels int64) (*gifArgs, error) {
+	p := &gifArgs{fps: _DefaultGIFFps, width: _DefaultGIFWidth, format: "gif", maxPixels: maxPixels}
+	var err error
+	if p.start, err = parseFrameSec(args.Get("start")); err != nil {
+		return nil, fmt.Errorf("invalid start %q", args.Get("start"))
+	}
+	if args.Get("end") == "" {
+		return nil, fmt.Errorf("end is required")
+	}
+	if p.end, err = parseFrameSec(args.Get("end")); err != nil {
+		return nil, fmt.Errorf("invalid end %q", args.Get("end"))
+	}
+	if p.end <= p.start {
+		return nil, fmt.Errorf("end %v is not after start %v", p.end.Seconds(), p.start.Seconds())
+	}
+	if err = p.parseOutput(args); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseClipArgs reads start (default 0) and duration or end in seconds as
+// sec of frame, fps, w as gif and format (gif or webp, default gif) of clip.
+func parseClipArgs(args Values, maxPixels int64) (*gifArgs, error) {
+	p := &gifArgs{fps: _DefaultGIFFps, width: _DefaultGIFWidth, format: "gif", maxPixels: maxPixels}
+	switch f := args.Get("format"); f {
+	case "":
+	case "gif", "webp":
+		p.format = f
+	default:
+		return nil, fmt.Errorf("unsupported clip format %q, must be gif or webp", f)
+	}
+	var err error
+	if p.start, err = parseFrameSec(args.Get("start")); err != nil {
+		return nil, fmt.Errorf("invalid start %q", args.Get("start"))
+	}
+	switch {
+	case args.Get("duration") != "" && args.Get("end") != "":
+		return nil, fmt.Errorf("duration and end are exclusive")
+	case args.Get("end") != "":
+		if p.end, err = parseFrameSec(args.Get("end")); err != nil {
+			return nil, fmt.Errorf("invalid end %q", args.Get("end"))
+		}
+		if p.end <= p.start {
+			return nil, fmt.Errorf("end %v is not after start %v", p.end.Seconds(), p.start.Seconds())
+		}
+	case args.Get("duration") != "":
+		duration, err := parseFrameSec(args.Get("duration"))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid duration %q", args.Get("duration"))
+		}
+		p.end = p.start + duration
+	default:
+		return nil, fmt.Errorf("duration or end is required")
+	}
+	if err = p.parseOutput(args); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseOutput reads fps and w, and bounds the frames of the range.
+func (p *gifArgs) parseOutput(args Values) error {
+	if args.Get("fps") != "" {
+		fps, err := args.ints("fps")
+		if err != nil {
+			return err
+		}
+		if p.fps = fps[0]; p.fps < 1 || p.fps > _MaxGIFFps {
+			return fmt.Errorf("invalid fps %d, must be 1..%d", p.fps, _MaxGIFFps)
+		}
+	}
+	if args.Get("w") != "" {
+		w, err := args.ints("w")
+		if err != nil {
+			return err
+		}
+		if p.width = w[0]; p.width < 0 {
+			return fmt.Errorf("invalid w %d", p.width)
+		}
+	}
+	if n := p.frames(); n > _MaxGIFFrames {
+		return fmt.Errorf("too many frames %d, must be up to %d, reduce fps or the range", n, _MaxGIFFrames)
+	}
+	// at least a row each
+	return checkFramePixels(image.Pt(p.width, 1), p.frames(), p.maxPixels)
+}
+
+// at returns the time of the i-th frame of the GIF.
+func (p *gifArgs) at(i int) time.Duration {
+	return p.start + time.Duration(i)*time.Second/time.Duration(p.fps)
+}
+
+// frames returns the number of the frames of the GIF from start to end.
+func (p *gifArgs) frames() int {
+	return int((p.end-p.start)/(time.Second/time.Duration(p.fps))) + 1
+}
+
+// delay returns the time of the i-th frame in 1/100 seconds.
+func (p *gifArgs) delay(i int) int {
+	return i * 100 / p.fps
+}
+
+// videoClip makes the looping GIF or WebP by format of the video of input
+// from start to end at fps, each frame scaled to width by the decoder, and
+// returns it with the content type.  It stops decoding at the frame of the
+// last of the clip.
+func videoClip(ctx context.Context, input io.Reader, p *gifArgs, enc encodeOptions) ([]byte, string, error) {
+	var frames []image.Image
+	// the first frame of the GIF each of frames covers
+	var firsts []int
+	next, pixels := 0, 0
+	var err error
+	last := p.frames()
+	decodeErr := decodeFrames(ctx, input, frameArgs{at: p.start, size: image.Pt(p.width, 0), frames: last, maxPixels: p.maxPixels}, func(i int, at time.Duration, img func() *image.RGBA) bool {
+		if at > p.end {
+			return false
+		}
+		if at < p.at(next) {
+			return true
+		}
+		m := img()
+		if pixels += m.Bounds().Dx() * m.Bounds().Dy(); pixels > _MaxGIFPixels {
+			err = &StatusError{http.StatusBadRequest, "too large clip, reduce w, fps or the range"}
+			return false
+		}
+		frames = append(frames, m)
+		firsts = append(firsts, next)
+		for p.at(next) <= at {
+			next++
+		}
+		return next < last
+	})
+	if decodeErr != nil {
+		return nil, "", decodeErr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if len(frames) == 0 {
+		return nil, "", fmt.Errorf("no frame from %v to %v", p.start, p.end)
+	}
+	if p.format == "webp" {
+		data, err := encodeClipWebP(frames, firsts, p, enc.Quality)
+		return data, "image/webp", err
+	}
+	data, err := encodeGIF(frames, firsts, p)
+	return data, "image/gif", err
+}
+
+// encodeGIF encodes frames, each shown from the firsts frame of the GIF at
+// fps up to the next, so the delays follow the video slower than fps.  The
+// frames share the palette of median cut.
+func encodeGIF(frames []image.Image, firsts []int, p *gifArgs) ([]byte, error) {
+	pal := medianCutPalette(frames, 256)
+
+	// the last frame lasts until the end
+	last := p.frames()
+	anim := &gif.GIF{}
+	for i, m := range frames {
+		bounds := m.Bounds()
+		dst := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), pal)
+		draw.Draw(dst, dst.Bounds(), m, bounds.Min, draw.Src)
+		end := last
+		if i+1 < len(firsts) {
+			end = firsts[i+1]
+		}
+		anim.Image = append(anim.Image, dst)
+		anim.Delay = append(anim.Delay, p.delay(end)-p.delay(firsts[i]))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeClipWebP encodes frames in the looping WebP by quality as
+// encodeGIF, with the delays in milliseconds.
+func encodeClipWebP(frames []image.Image, firsts []int, p *gifArgs, quality int) ([]byte, error) {
+	last := p.frames()
+	durations := make([]int, len(frames))
+	for i := range frames {
+		end := last
+		if i+1 < len(firsts) {
+			end = firsts[i+1]
+		}
+		durations[i] = int((p.at(end) - p.at(firsts[i])) / time.Millisecond)
+	}
+	buf := new(bytes.Buffer)
+	if err := encodeAnimatedWebP(buf, frames, durations, quality); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,236 @@
+package istore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/umitanuki/gmf"
+)
+
+// _VideoInfoKey is the key under the directory of _expand holding the
+// videoInfo of the video.
+const _VideoInfoKey = "_video"
+
+// _ProbePackets is the number of the video packets read to tell the frame
+// rate of the container counting no frames.
+const _ProbePackets = 120
+
+// videoInfo is the metadata of the video, with the duration in seconds, the
+// container format, the codec and the size of the video stream, its frame
+// rate and its bit rate in bits per second.  video is the key of the video
+// if stored by _expand.
+type videoInfo struct {
+	Video     string  `json:"video,omitempty"`
+	Duration  float64 `json:"duration"`
+	Format    string  `json:"format"`
+	Codec     string  `json:"codec"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	FrameRate float64 `json:"frame_rate"`
+	BitRate   int     `json:"bit_rate"`
+}
+
+// openVideo opens the video of input for gmf, made seekable by
+// seekableInput and read until ctx is done, and returns its container format
+// by sniffFormat.  The returned func closes it.
+func openVideo(ctx context.Context, input io.Reader) (*gmf.FmtCtx, string, func(), error) {
+	reader, remove, err := seekableInput(input)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	head := make([]byte, _SniffBytes)
+	n, err := io.ReadFull(reader, head)
+	if err == nil || err == io.ErrUnexpectedEOF || err == io.EOF {
+		_, err = reader.Seek(int64(-n), io.SeekCurrent)
+	}
+	if err != nil {
+		remove()
+		return nil, "", nil, err
+	}
+	format := sniffFormat(head[:n])
+	handlers := makeInputHandlers(ctx, reader)
+
+	inctx := gmf.NewCtx()
+	ioctx, err := gmf.NewAVIOContext(inctx, handlers)
+	if err != nil {
+		inctx.CloseInputAndRelease()
+		remove()
+		return nil, "", nil, err
+	}
+	inctx.SetPb(ioctx)
+	closeVideo := func() {
+		gmf.Release(ioctx)
+		inctx.CloseInputAndRelease()
+		remove()
+	}
+
+	if err = inctx.OpenInput("dummy"); err != nil {
+		closeVideo()
+		if ctx.Err() != nil {
+			return nil, "", nil, ctx.Err()
+		}
+		glog.Error(err)
+		return nil, "", nil, err
+	}
+	return inctx, format, closeVideo, nil
+}
+
+// _SniffBytes is the size of the head of the video read by sniffFormat.
+const _SniffBytes = 512
+
+// sniffFormat returns the name of the demuxer of ffmpeg for the container
+// whose magic starts head, or "" if unknown.
+func sniffFormat(head []byte) string {
+	// the type of the first box
+	if len(head) >= 8 {
+		switch string(head[4:8]) {
+		case "ftyp", "moov", "mdat", "free", "skip", "wide":
+			return "mov,mp4,m4a,3gp,3g2,mj2"
+		}
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("\x1a\x45\xdf\xa3")):
+		return "matroska,webm"
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && string(head[8:12]) == "AVI ":
+		return "avi"
+	case bytes.HasPrefix(head, []byte("FLV")):
+		return "flv"
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return "ogg"
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "gif"
+	case bytes.HasPrefix(head, []byte("YUV4MPEG2")):
+		return "yuv4mpegpipe"
+	case bytes.HasPrefix(head, []byte("\x30\x26\xb2\x75\x8e\x66\xcf\x11")):
+		return "asf"
+	case len(head) >= 4 && binary.BigEndian.Uint32(head) == 0x000001ba:
+		return "mpeg"
+	// the sync byte of two packets of 188 bytes
+	case len(head) > 188 && head[0] == 0x47 && head[188] == 0x47:
+		return "mpegts"
+	}
+	return ""
+}
+
+// probeVideo returns the videoInfo of inctx opened, from the container and
+// its best video stream, whose decoder is closed after.  The frame rate is
+// the average over the stream, or over the first _ProbePackets packets if
+// the container counts no frames, which leaves inctx read past them.
+func probeVideo(inctx *gmf.FmtCtx) (*videoInfo, error) {
+	stream, err := inctx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	cc := stream.CodecCtx()
+	// This is necessary to avoid leaking thread used by codec.
+	defer cc.Close()
+	info := &videoInfo{
+		Codec:  cc.Codec().Name(),
+		Width:  cc.Width(),
+		Height: cc.Height(),
+	}
+	// in microseconds, or negative if unknown
+	if d := inctx.Duration(); d > 0 {
+		info.Duration = float64(d) / 1e6
+	}
+	info.FrameRate = averageFrameRate(stream)
+	if info.FrameRate == 0 {
+		info.FrameRate = packetFrameRate(inctx, stream)
+	}
+	info.BitRate = cc.BitRate()
+	return info, nil
+}
+
+// averageFrameRate returns the frames per second of stream over its
+// duration, or zero if the container counts no frames.
+func averageFrameRate(stream *gmf.Stream) float64 {
+	// in the time base of the stream
+	tb := stream.TimeBase().AVR()
+	if n, d := stream.NbFrames(), stream.Duration(); n > 0 && d > 0 && tb.Num > 0 && tb.Den > 0 {
+		return float64(n) * float64(tb.Den) / (float64(d) * float64(tb.Num))
+	}
+	return 0
+}
+
+// packetFrameRate returns the frames per second of stream over the spread
+// of the timestamps of its first _ProbePackets packets read from inctx, or
+// zero if they are too few.
+func packetFrameRate(inctx *gmf.FmtCtx, stream *gmf.Stream) float64 {
+	tb := stream.TimeBase().AVR()
+	if tb.Num <= 0 || tb.Den <= 0 {
+		return 0
+	}
+	n, first, last := 0, 0, 0
+	for n < _ProbePackets {
+		packet := inctx.GetNextPacket()
+		if packet == nil {
+			break
+		}
+		// negative if no timestamp
+		pts := packet.Pts()
+		if packet.StreamIndex() == stream.Index() && pts >= 0 {
+			if n == 0 || pts < first {
+				first = pts
+			}
+			if n == 0 || pts > last {
+				last = pts
+			}
+			n++
+		}
+		gmf.Release(packet)
+	}
+	if n < 2 || last <= first {
+		return 0
+	}
+	return float64(n-1) * float64(tb.Den) / (float64(last-first) * float64(tb.Num))
+}
+
+// probe returns the videoInfo of input, reading the header and the stream
+// info but no frames.  It aborts with ctx.Err() once ctx is done.
+func probe(ctx context.Context, input io.Reader) (*videoInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	inctx, format, closeVideo, err := openVideo(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	defer closeVideo()
+	info, err := probeVideo(inctx)
+	if err != nil {
+		return nil, err
+	}
+	info.Format = format
+	return info, nil
+}
+
+// ServeVideoInfo returns the videoInfo stored at path by _expand.
+func (s *Server) ServeVideoInfo(w http.ResponseWriter, r *http.Request, path string) {
+	data, err := s.Db.Get([]byte(path), nil)
+	if err == leveldb.ErrNotFound {
+		writeError(w, http.StatusNotFound, path+" not found")
+		return
+	} else if err != nil {
+		glog.Error(err)
+		writeError(w, http.StatusInternalServerError, "failed to read "+path)
+		return
+	}
+	meta := ItemMeta{}
+	if _, err := meta.UnmarshalMsg(data); err != nil {
+		glog.Error("failed to unmarshal metadata from db ", err)
+		writeError(w, http.StatusInternalServerError, "failed to read "+path)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(meta.MetaData); err != nil {
+		glog.Error(err)
+	}
+}
@@ -0,0 +1,189 @@
+package istore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	_DefaultSpriteCols  = 5
+	_DefaultSpriteWidth = 160
+	// _MaxSpriteCells and _MaxSpritePixels bound the sheet.
+	_MaxSpriteCells  = 400
+	_MaxSpritePixels = 32 << 20
+)
+
+// spriteArgs is the arguments of sprite.
+type spriteArgs struct {
+	start, end, step time.Duration
+	cols, width      int
+	manifest         bool
+	// maxPixels bounds the frames as frameArgs
+	maxPixels int64
+}
+
+// parseSpriteArgs reads start (default 0), end and step (default 1) in
+// seconds as sec of frame, cols (default 5), w (default 160, 0 for the video
+// width) and manifest of sprite, whose frames are up to maxPixels.
+func parseSpriteArgs(args Values, maxPixels int64) (*spriteArgs, error) {
+	p := &spriteArgs{step: time.Second, cols: _DefaultSpriteCols, width: _DefaultSpriteWidth, maxPixels: maxPixels}
+	var err error
+	if p.start, err = parseFrameSec(args.Get("start")); err != nil {
+		return nil, fmt.Errorf("invalid start %q", args.Get("start"))
+	}
+	if args.Get("end") == "" {
+		return nil, fmt.Errorf("end is required")
+	}
+	if p.end, err = parseFrameSec(args.Get("end")); err != nil {
+		return nil, fmt.Errorf("invalid end %q", args.Get("end"))
+	}
+	if p.end < p.start {
+		return nil, fmt.Errorf("end %v is before start %v", p.end.Seconds(), p.start.Seconds())
+	}
+	if s := args.Get("step"); s != "" {
+		if p.step, err = parseFrameSec(s); err != nil || p.step <= 0 {
+			return nil, fmt.Errorf("invalid step %q", s)
+		}
+	}
+	if n := p.cells(); n > _MaxSpriteCells {
+		return nil, fmt.Errorf("too many cells %d, must be up to %d", n, _MaxSpriteCells)
+	}
+	ns, err := args.ints("cols", "w")
+	if err != nil {
+		return nil, err
+	}
+	if args.Get("cols") != "" {
+		if p.cols = ns[0]; p.cols < 1 {
+			return nil, fmt.Errorf("invalid cols %d", p.cols)
+		}
+	}
+	if args.Get("w") != "" {
+		if p.width = ns[1]; p.width < 0 {
+			return nil, fmt.Errorf("invalid w %d", p.width)
+		}
+	}
+	if s := args.Get("manifest"); s != "" {
+		if p.manifest, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("invalid manifest %q", s)
+		}
+	}
+	// at least a row each
+	if err := checkFramePixels(image.Pt(p.width, 1), p.cells(), maxPixels); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// cells returns the number of the cells from start to end by step.
+func (p *spriteArgs) cells() int {
+	return int((p.end-p.start)/p.step) + 1
+}
+
+// at returns the time of the i-th cell.
+func (p *spriteArgs) at(i int) time.Duration {
+	return p.start + time.Duration(i)*p.step
+}
+
+// spriteCell is the cell of the sheet in the manifest, with the time
+// requested and the time of the frame in it, in seconds.
+type spriteCell struct {
+	X   int     `json:"x"`
+	Y   int     `json:"y"`
+	Sec float64 `json:"sec"`
+	Pts float64 `json:"pts"`
+}
+
+// spriteManifest is the manifest of the sheet.
+type spriteManifest struct {
+	Width      int          `json:"width"`
+	Height     int          `json:"height"`
+	Cols       int          `json:"cols"`
+	Rows       int          `json:"rows"`
+	CellWidth  int          `json:"cell_width"`
+	CellHeight int          `json:"cell_height"`
+	Cells      []spriteCell `json:"cells"`
+}
+
+// spriteSheet places the frames of the video in the cells of sprite.
+type spriteSheet struct {
+	p     *spriteArgs
+	sheet *image.RGBA
+	cell  image.Point
+	cells []spriteCell
+}
+
+// add places the frame at ts in the cells from the next up to ts, as each
+// takes the first frame at or after its time, and tells whether more cells
+// are left.
+func (s *spriteSheet) add(ts time.Duration, img func() *image.RGBA) (bool, error) {
+	next, total := len(s.cells), s.p.cells()
+	if ts < s.p.at(next) {
+		return true, nil
+	}
+	frame := img()
+	if s.sheet == nil {
+		s.cell = frame.Bounds().Size()
+		cols := s.p.cols
+		if cols > total {
+			cols = total
+		}
+		rows := (total + cols - 1) / cols
+		if s.cell.X*cols*s.cell.Y*rows > _MaxSpritePixels {
+			return false, &StatusError{http.StatusBadRequest, "too large sprite, reduce w, cols or the cells"}
+		}
+		s.sheet = image.NewRGBA(image.Rect(0, 0, s.cell.X*cols, s.cell.Y*rows))
+	}
+	for ; next < total && s.p.at(next) <= ts; next++ {
+		pos := image.Pt(next%s.p.cols*s.cell.X, next/s.p.cols*s.cell.Y)
+		draw.Draw(s.sheet, image.Rectangle{pos, pos.Add(s.cell)}, frame, frame.Bounds().Min, draw.Src)
+		s.cells = append(s.cells, spriteCell{X: pos.X, Y: pos.Y, Sec: s.p.at(next).Seconds(), Pts: ts.Seconds()})
+	}
+	return next < total, nil
+}
+
+// encode returns the sheet up to the row of the last frame in JPEG by enc,
+// or the manifest in JSON, with the content type.
+func (s *spriteSheet) encode(enc encodeOptions) ([]byte, string, error) {
+	if len(s.cells) == 0 {
+		return nil, "", fmt.Errorf("no frame from %v to %v", s.p.start, s.p.end)
+	}
+	m := &spriteManifest{Cols: s.p.cols, Rows: (len(s.cells) + s.p.cols - 1) / s.p.cols, Cells: s.cells}
+	if m.Rows == 1 {
+		m.Cols = len(s.cells)
+	}
+	m.CellWidth, m.CellHeight = s.cell.X, s.cell.Y
+	m.Width, m.Height = s.cell.X*m.Cols, s.cell.Y*m.Rows
+	if s.p.manifest {
+		data, err := json.Marshal(m)
+		return data, "application/json", err
+	}
+	data, err := encodeImage(s.sheet.SubImage(image.Rect(0, 0, m.Width, m.Height)), "jpeg", enc)
+	return data, "image/jpeg", err
+}
+
+// videoSprite makes the sprite of the video of input in one pass from
+// start, each frame scaled to width by the decoder.  The sheet ends at the
+// last frame of the video if it is before end.
+func videoSprite(ctx context.Context, input io.Reader, p *spriteArgs, enc encodeOptions) ([]byte, string, error) {
+	s := &spriteSheet{p: p}
+	var err error
+	decodeErr := decodeFrames(ctx, input, frameArgs{at: p.start, size: image.Pt(p.width, 0), frames: p.cells(), maxPixels: p.maxPixels}, func(i int, ts time.Duration, img func() *image.RGBA) bool {
+		var more bool
+		more, err = s.add(ts, img)
+		return more
+	})
+	if decodeErr != nil {
+		return nil, "", decodeErr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return s.encode(enc)
+}
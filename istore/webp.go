@@ -0,0 +1,582 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"net/http"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// The WebP output is in the lossless format (VP8L), with the subtract
+// green and predictor transforms and the backward references of the runs.
+// See https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+
+const (
+	_WebPMaxSide = 1 << 14
+	// _WebPPredictorBits is log2 of the side of the blocks sharing a
+	// predictor.
+	_WebPPredictorBits = 5
+	_WebPMaxLength     = 4096
+	// the distance codes of the pixel above and of the pixel on the left
+	webpDistAbove = 1
+	webpDistLeft  = 2
+)
+
+// the predictors tried for each block, the left, the top and their average
+var webpPredictors = []int{1, 2, 7}
+
+// the order of the code lengths of the code length code
+var webpCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// encodeWebP encodes m in lossless WebP.  quality of 80 or less rounds off
+// the low bits of the colors, a bit per 20, trading the exactness for the
+// size, while the alpha is kept.
+func encodeWebP(w io.Writer, m image.Image, quality int) error {
+	data, _, err := encodeVP8L(m, quality)
+	if err != nil {
+		return err
+	}
+	return writeRIFF(w, webpChunk("VP8L", data))
+}
+
+// encodeAnimatedWebP encodes frames of the same size in the looping WebP,
+// each lossless as encodeWebP by quality and shown for durations in
+// milliseconds.
+func encodeAnimatedWebP(w io.Writer, frames []image.Image, durations []int, quality int) error {
+	size := frames[0].Bounds().Size()
+	var chunks []byte
+	alpha := false
+	for i, m := range frames {
+		data, a, err := encodeVP8L(m, quality)
+		if err != nil {
+			return err
+		}
+		alpha = alpha || a
+		// at the origin, not blended with and not disposed to the background
+		anmf := make([]byte, 16)
+		putUint24(anmf[6:], uint32(size.X-1))
+		putUint24(anmf[9:], uint32(size.Y-1))
+		putUint24(anmf[12:], uint32(durations[i]))
+		anmf[15] = 1 << 1
+		chunks = append(chunks, webpChunk("ANMF", append(anmf, webpChunk("VP8L", data)...))...)
+	}
+
+	const alphaBit, animationBit = 1 << 4, 1 << 1
+	vp8x := make([]byte, 10)
+	vp8x[0] = animationBit
+	if alpha {
+		vp8x[0] |= alphaBit
+	}
+	putUint24(vp8x[4:], uint32(size.X-1))
+	putUint24(vp8x[7:], uint32(size.Y-1))
+	// the transparent background, and the loop count 0 to loop forever
+	anim := make([]byte, 6)
+	head := append(webpChunk("VP8X", vp8x), webpChunk("ANIM", anim)...)
+	return writeRIFF(w, append(head, chunks...))
+}
+
+// encodeVP8L returns the lossless bitstream of m, and whether it has the
+// alpha.
+func encodeVP8L(m image.Image, quality int) ([]byte, bool, error) {
+	bounds := m.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > _WebPMaxSide || height > _WebPMaxSide {
+		return nil, false, &StatusError{http.StatusBadRequest,
+			fmt.Sprintf("too large %dx%d for webp, must be up to %d", width, height, _WebPMaxSide)}
+	}
+	src := imaging.Clone(m)
+	shift := uint((100 - quality) / 20)
+	alpha := false
+	pix := make([]uint32, width*height)
+	for i := range pix {
+		p := src.Pix[i*4 : i*4+4]
+		if p[3] == 0 {
+			// the colors of the transparent pixels are invisible
+			continue
+		}
+		alpha = alpha || p[3] != 0xff
+		r, g, b := roundBits(p[0], shift), roundBits(p[1], shift), roundBits(p[2], shift)
+		// subtract green
+		pix[i] = uint32(p[3])<<24 | uint32(r-g)<<16 | uint32(g)<<8 | uint32(b-g)
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	// subtract green
+	bw.write(1, 1)
+	bw.write(2, 2)
+	// predictor
+	modes, mw := predictWebP(pix, width, height)
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(_WebPPredictorBits-2, 3)
+	writeWebPImage(bw, modes, mw, false)
+	bw.write(0, 1)
+	writeWebPImage(bw, pix, width, true)
+	return bw.bytes(), alpha, nil
+}
+
+// webpChunk returns the RIFF chunk of fourcc with data, padded to even.
+func webpChunk(fourcc string, data []byte) []byte {
+	chunk := make([]byte, 8, 8+len(data)+1)
+	copy(chunk, fourcc)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// writeRIFF writes the WebP file of chunks.
+func writeRIFF(w io.Writer, chunks []byte) error {
+	header := make([]byte, 12)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+len(chunks)))
+	copy(header[8:], "WEBP")
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(chunks)
+	return err
+}
+
+// putUint24 puts v in the 3 bytes of b in little endian.
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// roundBits rounds v to the multiple of 1 << shift.
+func roundBits(v uint8, shift uint) uint8 {
+	if shift == 0 {
+		return v
+	}
+	r := (int(v) + 1<<(shift-1)) >> shift << shift
+	if r > 0xff {
+		return 0xff
+	}
+	return uint8(r)
+}
+
+// predictWebP replaces pix with the residuals of the predictor of the
+// least error for each block, and returns the modes of the blocks as the
+// image of mw in width.
+func predictWebP(pix []uint32, width, height int) (modes []uint32, mw int) {
+	side := 1 << _WebPPredictorBits
+	mw = (width + side - 1) / side
+	mh := (height + side - 1) / side
+	modes = make([]uint32, mw*mh)
+	for by := 0; by < mh; by++ {
+		for bx := 0; bx < mw; bx++ {
+			best, bestErr := 0, -1
+			for _, mode := range webpPredictors {
+				e := 0
+				for y := by * side; y < height && y < (by+1)*side; y++ {
+					for x := bx * side; x < width && x < (bx+1)*side; x++ {
+						e += residualError(subPixels(pix[y*width+x], webpPredict(pix, width, x, y, mode)))
+					}
+				}
+				if bestErr < 0 || e < bestErr {
+					best, bestErr = mode, e
+				}
+			}
+			modes[by*mw+bx] = uint32(best) << 8
+		}
+	}
+	// from the end, as the predictions take the original pixels
+	for y := height - 1; y >= 0; y-- {
+		for x := width - 1; x >= 0; x-- {
+			mode := int(modes[(y>>_WebPPredictorBits)*mw+x>>_WebPPredictorBits] >> 8)
+			i := y*width + x
+			pix[i] = subPixels(pix[i], webpPredict(pix, width, x, y, mode))
+		}
+	}
+	return modes, mw
+}
+
+// webpPredict returns the prediction of the pixel at (x, y) by mode.
+func webpPredict(pix []uint32, width, x, y, mode int) uint32 {
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return pix[x-1]
+	case x == 0:
+		return pix[(y-1)*width]
+	}
+	left, top := pix[y*width+x-1], pix[(y-1)*width+x]
+	switch mode {
+	case 1:
+		return left
+	case 2:
+		return top
+	}
+	var avg uint32
+	for s := uint(0); s < 32; s += 8 {
+		avg |= ((left>>s&0xff + top>>s&0xff) / 2) << s
+	}
+	return avg
+}
+
+// subPixels subtracts b from a in each channel.
+func subPixels(a, b uint32) uint32 {
+	var d uint32
+	for s := uint(0); s < 32; s += 8 {
+		d |= ((a>>s - b>>s) & 0xff) << s
+	}
+	return d
+}
+
+// residualError is the sum of the residuals of the channels of d, taken as
+// signed.
+func residualError(d uint32) int {
+	e := 0
+	for s := uint(0); s < 32; s += 8 {
+		v := int(int8(d >> s))
+		if v < 0 {
+			v = -v
+		}
+		e += v
+	}
+	return e
+}
+
+// webpToken is a literal pixel, or a backward reference of length if not 0.
+type webpToken struct {
+	pixel        uint32
+	length, dist int
+}
+
+// writeWebPImage writes the entropy coded image of pix in width, with the
+// runs of the pixels on the left or above as the backward references.  The
+// main image tells no meta prefix codes.
+func writeWebPImage(bw *bitWriter, pix []uint32, width int, main bool) {
+	var tokens []webpToken
+	for i := 0; i < len(pix); {
+		length, dist := 0, 0
+		if i >= 1 {
+			n := 0
+			for i+n < len(pix) && n < _WebPMaxLength && pix[i+n] == pix[i-1] {
+				n++
+			}
+			length, dist = n, webpDistLeft
+		}
+		if i >= width {
+			n := 0
+			for i+n < len(pix) && n < _WebPMaxLength && pix[i+n] == pix[i+n-width] {
+				n++
+			}
+			if n > length {
+				length, dist = n, webpDistAbove
+			}
+		}
+		if length < 3 {
+			tokens = append(tokens, webpToken{pixel: pix[i]})
+			i++
+			continue
+		}
+		tokens = append(tokens, webpToken{length: length, dist: dist})
+		i += length
+	}
+
+	green := make([]int, 256+24)
+	red, blue, alpha := make([]int, 256), make([]int, 256), make([]int, 256)
+	dist := make([]int, 40)
+	for _, t := range tokens {
+		if t.length == 0 {
+			green[t.pixel>>8&0xff]++
+			red[t.pixel>>16&0xff]++
+			blue[t.pixel&0xff]++
+			alpha[t.pixel>>24]++
+			continue
+		}
+		prefix, _, _ := prefixCode(t.length)
+		green[256+prefix]++
+		prefix, _, _ = prefixCode(t.dist)
+		dist[prefix]++
+	}
+
+	// no color cache
+	bw.write(0, 1)
+	if main {
+		// no meta prefix codes
+		bw.write(0, 1)
+	}
+	codes := make([]*huffmanCode, 5)
+	for i, counts := range [][]int{green, red, blue, alpha, dist} {
+		codes[i] = writeHuffmanCode(bw, counts)
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].write(bw, int(t.pixel>>8&0xff))
+			codes[1].write(bw, int(t.pixel>>16&0xff))
+			codes[2].write(bw, int(t.pixel&0xff))
+			codes[3].write(bw, int(t.pixel>>24))
+			continue
+		}
+		prefix, n, extra := prefixCode(t.length)
+		codes[0].write(bw, 256+prefix)
+		bw.write(uint32(extra), n)
+		prefix, n, extra = prefixCode(t.dist)
+		codes[4].write(bw, prefix)
+		bw.write(uint32(extra), n)
+	}
+}
+
+// prefixCode returns the prefix code of the length or the distance v, and
+// its extra bits.
+func prefixCode(v int) (prefix int, n uint, extra int) {
+	v--
+	if v < 4 {
+		return v, 0, 0
+	}
+	h := bits.Len(uint(v)) - 1
+	second := v >> uint(h-1) & 1
+	return 2*h + second, uint(h - 1), v & (1<<uint(h-1) - 1)
+}
+
+// bitWriter packs the bits from the least significant.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+// write writes the n low bits of v, n up to 32.
+func (w *bitWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nacc
+	w.nacc += n
+	for w.nacc >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nacc -= 8
+	}
+}
+
+// bytes flushes the bits written, padded by zero.
+func (w *bitWriter) bytes() []byte {
+	if w.nacc > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nacc = 0, 0
+	}
+	return w.buf
+}
+
+// huffmanCode is the canonical prefix code of the lengths.  The codes are
+// bit reversed, as they are read from the most significant bit.
+type huffmanCode struct {
+	lengths []uint8
+	codes   []uint16
+}
+
+func newHuffmanCode(lengths []uint8) *huffmanCode {
+	var count, next [16]int
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		codes[s] = uint16(bits.Reverse16(uint16(c)) >> (16 - l))
+	}
+	return &huffmanCode{lengths, codes}
+}
+
+func (h *huffmanCode) write(bw *bitWriter, symbol int) {
+	bw.write(uint32(h.codes[symbol]), uint(h.lengths[symbol]))
+}
+
+// writeHuffmanCode writes the code for the counts of the symbols, as the
+// simple code if up to two symbols under 256 are used.
+func writeHuffmanCode(bw *bitWriter, counts []int) *huffmanCode {
+	var used []int
+	for s, n := range counts {
+		if n > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		lengths := make([]uint8, len(counts))
+		bw.write(1, 1)
+		bw.write(uint32(len(used)-1), 1)
+		if used[0] <= 1 {
+			bw.write(0, 1)
+			bw.write(uint32(used[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			bw.write(uint32(used[1]), 8)
+			lengths[used[0]], lengths[used[1]] = 1, 1
+		}
+		return newHuffmanCode(lengths)
+	}
+
+	lengths := huffmanLengths(counts, 15)
+	// the lengths by 0..15, 16 repeating the previous 3..6 times, and 17 and
+	// 18 for the zeros 3..10 and 11..138 times, with the extra bits
+	type token struct{ symbol, extra int }
+	var tokens []token
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		n := 1
+		for i+n < len(lengths) && lengths[i+n] == l {
+			n++
+		}
+		i += n
+		if l == 0 {
+			for n >= 11 {
+				k := min(n, 138)
+				tokens = append(tokens, token{18, k - 11})
+				n -= k
+			}
+			if n >= 3 {
+				tokens = append(tokens, token{17, n - 3})
+				n = 0
+			}
+		} else {
+			tokens = append(tokens, token{int(l), 0})
+			n--
+			for n >= 3 {
+				k := min(n, 6)
+				tokens = append(tokens, token{16, k - 3})
+				n -= k
+			}
+		}
+		for ; n > 0; n-- {
+			tokens = append(tokens, token{int(l), 0})
+		}
+	}
+	counts19 := make([]int, 19)
+	for _, t := range tokens {
+		counts19[t.symbol]++
+	}
+	code := newHuffmanCode(huffmanLengths(counts19, 7))
+	last := 3
+	for i, s := range webpCodeLengthOrder {
+		if code.lengths[s] > 0 && i > last {
+			last = i
+		}
+	}
+	bw.write(0, 1)
+	bw.write(uint32(last+1-4), 4)
+	for _, s := range webpCodeLengthOrder[:last+1] {
+		bw.write(uint32(code.lengths[s]), 3)
+	}
+	// the lengths of all the symbols
+	bw.write(0, 1)
+	extraBits := map[int]uint{16: 2, 17: 3, 18: 7}
+	for _, t := range tokens {
+		code.write(bw, t.symbol)
+		if n, ok := extraBits[t.symbol]; ok {
+			bw.write(uint32(t.extra), n)
+		}
+	}
+	return newHuffmanCode(lengths)
+}
+
+// huffmanLengths returns the code lengths of the counts up to maxLength.
+// The rare symbols are counted more until the tree fits, and a symbol is
+// added if less than two are used.
+func huffmanLengths(counts []int, maxLength int) []uint8 {
+	var used []int
+	for s, n := range counts {
+		if n > 0 {
+			used = append(used, s)
+		}
+	}
+	for len(used) < 2 {
+		s := 0
+		if len(used) == 1 && used[0] == 0 {
+			s = 1
+		}
+		used = append(used, s)
+	}
+	n := len(used)
+	lengths := make([]uint8, len(counts))
+	for floor := 1; ; floor *= 2 {
+		weight := func(s int) int { return max(counts[s], floor) }
+		sort.SliceStable(used, func(i, j int) bool { return weight(used[i]) < weight(used[j]) })
+		// the leaves at 0..n-1 and the internal nodes after, both in the
+		// order of the weights
+		weights := make([]int, n, 2*n-1)
+		for i, s := range used {
+			weights[i] = weight(s)
+		}
+		parent := make([]int, 2*n-1)
+		leaf, internal := 0, n
+		for k := n; k < 2*n-1; k++ {
+			var pair [2]int
+			for i := range pair {
+				if leaf < n && (internal >= k || weights[leaf] <= weights[internal]) {
+					pair[i] = leaf
+					leaf++
+				} else {
+					pair[i] = internal
+					internal++
+				}
+			}
+			weights = append(weights, weights[pair[0]]+weights[pair[1]])
+			parent[pair[0]], parent[pair[1]] = k, k
+		}
+		depth := make([]int, 2*n-1)
+		for k := 2*n - 3; k >= 0; k-- {
+			depth[k] = depth[parent[k]] + 1
+		}
+		fits := true
+		for i, s := range used {
+			lengths[s] = uint8(depth[i])
+			fits = fits && depth[i] <= maxLength
+		}
+		if fits {
+			return lengths
+		}
+	}
+}
+
+// rejectAnimatedWebP fails with 415 if input is an animated WebP, which
+// the decoder does not support.  The peeked bytes are put back.
+func rejectAnimatedWebP(input io.Reader) (io.Reader, error) {
+	head := make([]byte, 21)
+	n, err := io.ReadFull(input, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	input = io.MultiReader(bytes.NewReader(head), input)
+	const animationBit = 1 << 1
+	if n == len(head) && string(head[:4]) == "RIFF" && string(head[8:16]) == "WEBPVP8X" && head[20]&animationBit != 0 {
+		return input, &StatusError{http.StatusUnsupportedMediaType, "animated WebP is not supported"}
+	}
+	return input, nil
+}
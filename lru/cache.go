@@ -3,9 +3,6 @@ package lru
 import (
 	"container/list"
 	"sync"
-
-	"github.com/gregjones/httpcache/diskcache"
-	"github.com/peterbourgon/diskv"
 )
 
 type Cache struct {
@@ -13,8 +10,7 @@ type Cache struct {
 	currentBytes int
 	ll           *list.List
 	cache        map[string]*list.Element
-	mu           sync.RWMutex
-	d            *diskcache.Cache
+	mu           sync.Mutex
 }
 
 type entry struct {
@@ -23,23 +19,10 @@ type entry struct {
 }
 
 func New(maxBytes int) *Cache {
-	// TODO: not used yet.
-	// - Set diskcache when memorycache is set, but asyncronously
-	// - async diskcache should be synchronized with the same key
-	// - Get tests both in-memory and then diskcache
-	// - Delete deletes both, while in-memory set doen't.
-	// - Need a way to pass diskcache option, disable diskcache (to pass test)
-	d := diskcache.NewWithDiskv(
-		diskv.New(diskv.Options{
-			BasePath:     "/tmp/istorecache",
-			CacheSizeMax: uint64(maxBytes * 10),
-		}),
-	)
 	return &Cache{
 		MaxBytes: maxBytes,
 		ll:       list.New(),
 		cache:    map[string]*list.Element{},
-		d:        d,
 	}
 }
 
@@ -66,8 +49,9 @@ func (c *Cache) Set(key string, value []byte) {
 }
 
 func (c *Cache) Get(key string) (value []byte, ok bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	// MoveToFront modifies the list, so this is not a read lock.
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	if ele, hit := c.cache[key]; hit {
 		c.ll.MoveToFront(ele)
@@ -85,6 +69,32 @@ func (c *Cache) Delete(key string) {
 	}
 }
 
+// Purge removes all the entries.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.cache = map[string]*list.Element{}
+	c.currentBytes = 0
+}
+
+// Len returns the number of entries.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+// Bytes returns the total size of the values.
+func (c *Cache) Bytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.currentBytes
+}
+
 func (c *Cache) removeElement(e *list.Element) {
 	c.ll.Remove(e)
 	kv := e.Value.(*entry)
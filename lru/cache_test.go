@@ -1,8 +1,14 @@
 package lru
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -41,3 +47,134 @@ func (_ *S) TestCache(c *C) {
 	_, found = cache.Get("9")
 	c.Check(found, Equals, false)
 }
+
+func (_ *S) TestCachePurge(c *C) {
+	cache := New(1024)
+	cache.Set("a", make([]byte, 100))
+	cache.Set("b", make([]byte, 200))
+	c.Check(cache.Len(), Equals, 2)
+	c.Check(cache.Bytes(), Equals, 300)
+
+	cache.Purge()
+	c.Check(cache.Len(), Equals, 0)
+	c.Check(cache.Bytes(), Equals, 0)
+	_, found := cache.Get("a")
+	c.Check(found, Equals, false)
+}
+
+func (_ *S) TestDiskCache(c *C) {
+	dir := c.MkDir()
+	cache, err := NewDisk(dir, 1024)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), []byte(strings.Repeat(strconv.Itoa(i), 100)))
+	}
+	c.Check(cache.Len(), Equals, 10)
+	c.Check(cache.Bytes(), Equals, 1000)
+
+	val, found := cache.Get("3")
+	c.Check(found, Equals, true)
+	c.Check(string(val), Equals, strings.Repeat("3", 100))
+
+	// "3" was used recently, so "0" and "1" are evicted.
+	cache.Set("big", make([]byte, 200))
+	for i := 0; i < 10; i++ {
+		_, found := cache.Get(strconv.Itoa(i))
+		c.Check(found, Equals, i > 1, Commentf("key = %d", i))
+	}
+	c.Check(cache.Bytes() <= 1024, Equals, true)
+
+	files, _ := ioutil.ReadDir(dir)
+	c.Check(len(files), Equals, cache.Len())
+
+	// reopen with smaller limit, the latest survives.
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, keyToFilename("big")), future, future)
+	cache2, err := NewDisk(dir, 500)
+	c.Assert(err, IsNil)
+	c.Check(cache2.Bytes() <= 500, Equals, true)
+	_, found = cache2.Get("big")
+	c.Check(found, Equals, true)
+
+	cache2.Delete("big")
+	_, found = cache2.Get("big")
+	c.Check(found, Equals, false)
+
+	cache2.Purge()
+	c.Check(cache2.Len(), Equals, 0)
+	files, _ = ioutil.ReadDir(dir)
+	c.Check(len(files), Equals, 0)
+}
+
+func (_ *S) TestDiskCacheForeignFiles(c *C) {
+	dir := c.MkDir()
+	ioutil.WriteFile(filepath.Join(dir, keyToFilename("a")), make([]byte, 100), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".tmp-123"), make([]byte, 50), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README"), make([]byte, 10), 0644)
+	ioutil.WriteFile(filepath.Join(dir, strings.ToUpper(keyToFilename("b"))), make([]byte, 10), 0644)
+
+	cache, err := NewDisk(dir, 1024)
+	c.Assert(err, IsNil)
+	c.Check(cache.Len(), Equals, 1)
+	c.Check(cache.Bytes(), Equals, 100)
+	_, found := cache.Get("a")
+	c.Check(found, Equals, true)
+	// the partial write is removed
+	_, err = os.Stat(filepath.Join(dir, ".tmp-123"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// the others are neither counted nor removed
+	cache.Purge()
+	files, _ := ioutil.ReadDir(dir)
+	c.Assert(len(files), Equals, 2)
+	c.Check(files[0].Name(), Equals, strings.ToUpper(keyToFilename("b")))
+	c.Check(files[1].Name(), Equals, "README")
+}
+
+func (_ *S) TestDiskCacheConcurrent(c *C) {
+	dir := c.MkDir()
+	cache, err := NewDisk(dir, 1000)
+	c.Assert(err, IsNil)
+
+	// the values are read whole or missed while they are replaced, deleted
+	// and evicted
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := strconv.Itoa((g + i) % 20)
+				switch i % 4 {
+				case 0:
+					cache.Set(key, []byte(strings.Repeat(key, 50+i%7)))
+				case 1:
+					cache.Delete(key)
+				default:
+					if val, found := cache.Get(key); found {
+						c.Check(strings.Trim(string(val), key), Equals, "", Commentf("key = %s", key))
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	c.Check(cache.Bytes() <= 1000, Equals, true)
+	files, _ := ioutil.ReadDir(dir)
+	size := 0
+	for _, f := range files {
+		size += int(f.Size())
+	}
+	c.Check(len(files), Equals, cache.Len())
+	c.Check(size, Equals, cache.Bytes())
+
+	// a file removed behind the cache is missed and forgotten
+	cache.Set("gone", []byte("x"))
+	os.Remove(filepath.Join(dir, keyToFilename("gone")))
+	n := cache.Len()
+	_, found := cache.Get("gone")
+	c.Check(found, Equals, false)
+	c.Check(cache.Len(), Equals, n-1)
+}
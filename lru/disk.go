@@ -0,0 +1,223 @@
+package lru
+
+import (
+	"container/list"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskCache stores values in files under Dir, and evicts the least recently
+// used ones when the total size exceeds MaxBytes.  The files survive restart
+// and the recency is restored from the modification time.
+type DiskCache struct {
+	Dir          string
+	MaxBytes     int
+	currentBytes int
+	ll           *list.List
+	cache        map[string]*list.Element
+	mu           sync.Mutex
+}
+
+type diskEntry struct {
+	name string
+	size int
+}
+
+// NewDisk opens the cache directory, creating it if necessary.
+func NewDisk(dir string, maxBytes int) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &DiskCache{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		ll:       list.New(),
+		cache:    map[string]*list.Element{},
+	}
+
+	// from the oldest, so the latest comes to the front.
+	sort.Sort(byModTime(infos))
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			// left by Set interrupted before the rename
+			os.Remove(c.path(info.Name()))
+			continue
+		}
+		// the other files in dir are not ours to evict
+		if !info.Mode().IsRegular() || !isKeyFilename(info.Name()) {
+			continue
+		}
+		ele := c.ll.PushFront(&diskEntry{info.Name(), int(info.Size())})
+		c.cache[info.Name()] = ele
+		c.currentBytes += int(info.Size())
+	}
+	c.evict()
+
+	return c, nil
+}
+
+func (c *DiskCache) Set(key string, value []byte) {
+	name := keyToFilename(key)
+
+	// write to temporary file first not to expose partial content.
+	tmp, err := ioutil.TempFile(c.Dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(value)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), c.path(name)); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if ee, ok := c.cache[name]; ok {
+		c.ll.MoveToFront(ee)
+		c.currentBytes -= ee.Value.(*diskEntry).size
+		ee.Value.(*diskEntry).size = len(value)
+		c.currentBytes += len(value)
+	} else {
+		ele := c.ll.PushFront(&diskEntry{name, len(value)})
+		c.cache[name] = ele
+		c.currentBytes += len(value)
+	}
+	c.evict()
+}
+
+func (c *DiskCache) Get(key string) (value []byte, ok bool) {
+	name := keyToFilename(key)
+
+	c.mu.Lock()
+	ele, hit := c.cache[name]
+	if hit {
+		c.ll.MoveToFront(ele)
+	}
+	c.mu.Unlock()
+	if !hit {
+		return
+	}
+
+	// read out of the lock not to serialize the hits on the disk.  Set
+	// renames the whole file in place, and evict removes it.
+	value, err := ioutil.ReadFile(c.path(name))
+	if err != nil {
+		// removed behind us
+		c.mu.Lock()
+		if c.cache[name] == ele {
+			c.removeElement(ele)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(c.path(name), now, now)
+
+	return value, true
+}
+
+func (c *DiskCache) Delete(key string) {
+	name := keyToFilename(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ele, hit := c.cache[name]; hit {
+		c.removeElement(ele)
+	}
+}
+
+// Purge removes all the entries.
+func (c *DiskCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.ll.Len() > 0 {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Len returns the number of entries.
+func (c *DiskCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+// Bytes returns the total size of the files.
+func (c *DiskCache) Bytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.currentBytes
+}
+
+func (c *DiskCache) evict() {
+	for c.MaxBytes != 0 && c.currentBytes > c.MaxBytes {
+		ele := c.ll.Back()
+		if ele == nil {
+			break
+		}
+		c.removeElement(ele)
+	}
+}
+
+func (c *DiskCache) removeElement(e *list.Element) {
+	c.ll.Remove(e)
+	de := e.Value.(*diskEntry)
+	delete(c.cache, de.name)
+	c.currentBytes -= de.size
+	os.Remove(c.path(de.name))
+}
+
+func (c *DiskCache) path(name string) string {
+	return filepath.Join(c.Dir, name)
+}
+
+func keyToFilename(key string) string {
+	h := md5.New()
+	io.WriteString(h, key)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isKeyFilename tells if name is made by keyToFilename.
+func isKeyFilename(name string) bool {
+	sum, err := hex.DecodeString(name)
+	return err == nil && len(sum) == md5.Size && hex.EncodeToString(sum) == name
+}
+
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int {
+	return len(s)
+}
+
+func (s byModTime) Less(i, j int) bool {
+	return s[i].ModTime().Before(s[j].ModTime())
+}
+
+func (s byModTime) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -116,6 +116,7 @@ func (idx *Indexer) Encode(enc Encoder) error {
 		enc.Encode(p.link)
 		enc.Encode(p.items)
 	}
+	enc.Encode(idx.storage.free)
 
 	return nil
 }
@@ -144,6 +145,8 @@ func (idx *Indexer) Decode(dec Decoder) error {
 		dec.Decode(&idx.storage.pages[i].link)
 		dec.Decode(&idx.storage.pages[i].items)
 	}
+	// older index may not have the free list.
+	dec.Decode(&idx.storage.free)
 
 	return nil
 }
@@ -39,6 +39,11 @@ func NewIndexer(seed int64, bitsize int, vecsize int) *Indexer {
 	return idx
 }
 
+// VecSize returns the length of the vectors idx takes.
+func (idx *Indexer) VecSize() int {
+	return idx.vecsize
+}
+
 func (idx *Indexer) Add(itemid uint64, vec []float32) {
 	key := idx.distance.GetBitVector(idx.hyperplane, vec)
 	pageno, ok := idx.lookup[key.Uint32()]
@@ -49,6 +54,20 @@ func (idx *Indexer) Add(itemid uint64, vec []float32) {
 	idx.storage.Add(itemid, pageno)
 }
 
+// Remove removes item that was added with the vec.
+func (idx *Indexer) Remove(itemid uint64, vec []float32) {
+	key := idx.distance.GetBitVector(idx.hyperplane, vec)
+	pageno, ok := idx.lookup[key.Uint32()]
+	if !ok {
+		return
+	}
+	if head := idx.storage.Remove(itemid, pageno); head == -1 {
+		delete(idx.lookup, key.Uint32())
+	} else {
+		idx.lookup[key.Uint32()] = head
+	}
+}
+
 // mainly for debug and analysis
 func (idx *Indexer) GetBitVector(vec []float32) *bitvector.BitVector {
 	return idx.distance.GetBitVector(idx.hyperplane, vec)
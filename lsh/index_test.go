@@ -110,3 +110,47 @@ func (_ *S) TestPage(c *C) {
 	c.Check(page.CountItems(), Equals, len(page.items))
 	c.Check(page.Full(), Equals, true)
 }
+
+func (_ *S) TestStorageFreeList(c *C) {
+	storage := &Storage{}
+	head := storage.allocatePage()
+	npages := 3
+	nitems := npages * len(storage.getPage(head).items)
+
+	for round := 0; round < 5; round++ {
+		if head == -1 {
+			head = storage.allocatePage()
+		}
+		for i := 0; i < nitems; i++ {
+			storage.Add(uint64(i+1), head)
+		}
+		c.Check(len(storage.pages), Equals, npages)
+
+		for i := 0; i < nitems; i++ {
+			head = storage.Remove(uint64(i+1), head)
+		}
+		c.Check(head, Equals, -1)
+		c.Check(len(storage.free), Equals, npages)
+	}
+	c.Check(len(storage.pages), Equals, npages)
+}
+
+func (_ *S) TestIndexerRemove(c *C) {
+	gen := NewRandomVectorGen(42, 2)
+	data := gen.Generate(100)
+	index := NewIndexer(39, 8, 2)
+	for i, v := range data {
+		index.Add(uint64(i+1), v)
+	}
+	for i, v := range data {
+		if i%2 == 0 {
+			index.Remove(uint64(i+1), v)
+		}
+	}
+
+	items := index.Candidates(data[1], len(data))
+	c.Check(len(items), Equals, len(data)/2)
+	for _, itemid := range items {
+		c.Check(itemid%2, Equals, uint64(0))
+	}
+}
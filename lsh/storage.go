@@ -3,6 +3,8 @@ package lsh
 type Storage struct {
 	hash  []int32
 	pages []Page
+	// free holds page numbers reclaimed by Remove, reused by allocatePage.
+	free []int
 }
 
 type Page struct {
@@ -24,7 +26,8 @@ func (s *Storage) Add(itemid uint64, pageno int) int {
 	// Move to the new page if the current page is full.
 	if page.Full() {
 		newpageno := s.allocatePage()
-		page.Link(newpageno)
+		// allocatePage may move pages, so look it up again.
+		s.getPage(pageno).Link(newpageno)
 		page = s.getPage(newpageno)
 		pageno = newpageno
 	}
@@ -34,18 +37,64 @@ func (s *Storage) Add(itemid uint64, pageno int) int {
 	return pageno
 }
 
+// Remove removes item from the pages linked from pageno, and returns the
+// head page number of the chain after removal.  Pages that become empty are
+// unlinked and pushed to the free list.  It returns -1 if the whole chain
+// became empty.
+func (s *Storage) Remove(itemid uint64, pageno int) int {
+	head := pageno
+	prevno := -1
+	iter := s.pageIterator(pageno)
+	for iter.next() {
+		page := iter.page()
+		if !page.Remove(itemid) {
+			prevno = iter.pageno()
+			continue
+		}
+
+		if page.CountItems() == 0 {
+			next := page.Next()
+			if prevno == -1 {
+				head = next
+			} else {
+				s.getPage(prevno).Link(next)
+			}
+			s.freePage(iter.pageno())
+		}
+		break
+	}
+
+	return head
+}
+
 func (s *Storage) getPage(pageno int) *Page {
 	return &s.pages[pageno]
 }
 
-// allocatePage appends new page at the end of array, and returns the page number of it.
+// allocatePage returns the page number of a new page.  It reuses a page
+// from the free list if any, otherwise appends new page at the end of array.
 func (s *Storage) allocatePage() int {
+	if nfree := len(s.free); nfree > 0 {
+		n := s.free[nfree-1]
+		s.free = s.free[:nfree-1]
+		s.pages[n].Init()
+		return n
+	}
+
 	n := len(s.pages)
 	s.pages = append(s.pages, Page{})
 	s.pages[n].Init()
 	return n
 }
 
+// freePage pushes the page to the free list.
+func (s *Storage) freePage(pageno int) {
+	page := s.getPage(pageno)
+	page.nitems = 0
+	page.Init()
+	s.free = append(s.free, pageno)
+}
+
 // pageIter is an iterator over multiple pages that are linked.
 // Use this way:
 // 	iter := storage.pageIterator()
@@ -99,6 +148,19 @@ func (p *Page) Add(itemid uint64) {
 	p.nitems++
 }
 
+// Remove removes an item from this page, and returns true if found.  The
+// last item fills the hole, so the order of items is not preserved.
+func (p *Page) Remove(itemid uint64) bool {
+	for i := int32(0); i < p.nitems; i++ {
+		if p.items[i] == itemid {
+			p.nitems--
+			p.items[i] = p.items[p.nitems]
+			return true
+		}
+	}
+	return false
+}
+
 // Gets returns a slice of items that are in the page.
 func (p *Page) Gets() []uint64 {
 	itemlen := p.nitems